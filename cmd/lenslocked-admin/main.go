@@ -0,0 +1,411 @@
+// Command lenslocked-admin runs operations tasks against the
+// database and image storage without starting the server. It
+// reads the same .config.json as the server.
+//
+// Usage:
+//
+//	lenslocked-admin <command> [flags]
+//
+// Run a command with -h to see its flags.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/config"
+	"github.com/arnoldokoth/lenslocked.com/models"
+)
+
+// command is a task the tool can run, args are whatever came
+// after the command's name
+type command struct {
+	usage string
+	run   func(t *tool, args []string) error
+}
+
+// tool only connects to the database once a command has parsed
+// its flags, so -h works without one
+type tool struct {
+	cfg      config.Config
+	services *models.Services
+}
+
+// open sets up only the services the commands need, nothing
+// here sends email or talks to OAuth providers
+func (t *tool) open() (*models.Services, error) {
+	if t.services != nil {
+		return t.services, nil
+	}
+
+	store, err := t.cfg.Storage.NewStorage(t.cfg.HMACKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dbConfig := t.cfg.Database
+	services, err := models.NewServices(
+		models.WithGorm(dbConfig.Dialect(), dbConfig.ConnString()),
+		models.WithLogMode(false),
+		models.WithUser(t.cfg.HMACKey, t.cfg.Pepper),
+		models.WithSession(t.cfg.HMACKey),
+		models.WithAPIToken(t.cfg.HMACKey),
+		models.WithImage(store, t.cfg.Uploads.Limits()),
+		models.WithGallery(),
+		models.WithAudit(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	t.services = services
+
+	return services, nil
+}
+
+func (t *tool) close() {
+	if t.services != nil {
+		t.services.Close()
+	}
+}
+
+var commands = map[string]command{
+	"migrate":        {"create or update the database tables", migrate},
+	"reset":          {"drop every table and recreate them, deleting all data", reset},
+	"create-user":    {"create a user, optionally as an admin", createUser},
+	"disable-user":   {"stop a user signing in and sign them out everywhere", disableUser},
+	"enable-user":    {"let a disabled user sign in again", enableUser},
+	"reset-password": {"set a new password for a user, sign them out everywhere and revoke their API tokens", resetPassword},
+	"galleries":      {"list a user's galleries", listGalleries},
+	"reconcile":      {"import image files that have no database record and list records whose file is missing", reconcile},
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	t := &tool{cfg: config.LoadConfig()}
+	err := cmd.run(t, os.Args[2:])
+	t.close()
+	if err != nil {
+		log.Fatalln("ERROR:", err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: lenslocked-admin <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	w := tabwriter.NewWriter(os.Stderr, 0, 4, 2, ' ', 0)
+	for _, name := range []string{"migrate", "reset", "create-user", "disable-user",
+		"enable-user", "reset-password", "galleries", "reconcile"} {
+		fmt.Fprintf(w, "  %s\t%s\n", name, commands[name].usage)
+	}
+	w.Flush()
+}
+
+func migrate(t *tool, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fs.Parse(args)
+
+	services, err := t.open()
+	if err != nil {
+		return err
+	}
+
+	if err := services.AutoMigrate(); err != nil {
+		return err
+	}
+
+	log.Println("Database Migrated")
+	return nil
+}
+
+// reset only runs when -confirm names the database, so it can't
+// be run against the wrong one by accident
+func reset(t *tool, args []string) error {
+	fs := flag.NewFlagSet("reset", flag.ExitOnError)
+	confirm := fs.String("confirm", "", "name of the database to reset, required")
+	fs.Parse(args)
+
+	if *confirm != t.cfg.Database.Name {
+		return fmt.Errorf("this deletes everything in %q, run again with -confirm=%s to go ahead",
+			t.cfg.Database.Name, t.cfg.Database.Name)
+	}
+
+	services, err := t.open()
+	if err != nil {
+		return err
+	}
+
+	if err := services.DestructiveReset(); err != nil {
+		return err
+	}
+
+	log.Printf("Database %s Has Been Reset", t.cfg.Database.Name)
+	return nil
+}
+
+// createUser makes an account whose email address is treated as
+// verified. It is how the first admin gets created.
+func createUser(t *tool, args []string) error {
+	fs := flag.NewFlagSet("create-user", flag.ExitOnError)
+	name := fs.String("name", "", "the user's name")
+	emailAddress := fs.String("email", "", "the user's email address, required")
+	password := fs.String("password", "", "the user's password, read from stdin if not given")
+	admin := fs.Bool("admin", false, "make the user an admin")
+	fs.Parse(args)
+
+	services, err := t.open()
+	if err != nil {
+		return err
+	}
+
+	pw, err := passwordOrStdin(*password)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user := models.User{
+		Name:            *name,
+		EmailAddress:    *emailAddress,
+		Password:        pw,
+		Role:            models.RoleUser,
+		EmailVerifiedAt: &now,
+	}
+	if *admin {
+		user.Role = models.RoleAdmin
+	}
+	if err := services.User.Create(&user); err != nil {
+		return err
+	}
+
+	log.Printf("Created User #%d %s With Role %s", user.ID, user.EmailAddress, user.Role)
+	return nil
+}
+
+func disableUser(t *tool, args []string) error {
+	fs := flag.NewFlagSet("disable-user", flag.ExitOnError)
+	emailAddress := fs.String("email", "", "the user's email address, required")
+	fs.Parse(args)
+
+	services, err := t.open()
+	if err != nil {
+		return err
+	}
+
+	user, err := services.User.ByEmail(*emailAddress)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	user.DisabledAt = &now
+	if err := services.User.Update(user); err != nil {
+		return err
+	}
+	if err := services.Session.DeleteByUserID(user.ID); err != nil {
+		return err
+	}
+	audit(services, models.AuditAdminDisableUser, user)
+
+	log.Printf("Disabled User #%d %s", user.ID, user.EmailAddress)
+	return nil
+}
+
+func enableUser(t *tool, args []string) error {
+	fs := flag.NewFlagSet("enable-user", flag.ExitOnError)
+	emailAddress := fs.String("email", "", "the user's email address, required")
+	fs.Parse(args)
+
+	services, err := t.open()
+	if err != nil {
+		return err
+	}
+
+	user, err := services.User.ByEmail(*emailAddress)
+	if err != nil {
+		return err
+	}
+
+	user.DisabledAt = nil
+	if err := services.User.Update(user); err != nil {
+		return err
+	}
+	audit(services, models.AuditAdminEnableUser, user)
+
+	log.Printf("Enabled User #%d %s", user.ID, user.EmailAddress)
+	return nil
+}
+
+// resetPassword signs the user out everywhere and revokes their
+// API tokens, the same as a reset through the website, as
+// whoever knew the old password shouldn't keep access
+func resetPassword(t *tool, args []string) error {
+	fs := flag.NewFlagSet("reset-password", flag.ExitOnError)
+	emailAddress := fs.String("email", "", "the user's email address, required")
+	password := fs.String("password", "", "the new password, read from stdin if not given")
+	fs.Parse(args)
+
+	services, err := t.open()
+	if err != nil {
+		return err
+	}
+
+	user, err := services.User.ByEmail(*emailAddress)
+	if err != nil {
+		return err
+	}
+
+	pw, err := passwordOrStdin(*password)
+	if err != nil {
+		return err
+	}
+
+	user.Password = pw
+	if err := services.User.Update(user); err != nil {
+		return err
+	}
+	if err := services.Session.DeleteByUserID(user.ID); err != nil {
+		return err
+	}
+	if err := services.APIToken.RevokeByUserID(user.ID); err != nil {
+		return err
+	}
+	audit(services, models.AuditAdminResetPassword, user)
+
+	log.Printf("Reset The Password Of User #%d %s", user.ID, user.EmailAddress)
+	return nil
+}
+
+func listGalleries(t *tool, args []string) error {
+	fs := flag.NewFlagSet("galleries", flag.ExitOnError)
+	emailAddress := fs.String("email", "", "the user's email address, required")
+	fs.Parse(args)
+
+	services, err := t.open()
+	if err != nil {
+		return err
+	}
+
+	user, err := services.User.ByEmail(*emailAddress)
+	if err != nil {
+		return err
+	}
+
+	galleries, err := services.Gallery.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTITLE\tVISIBILITY\tIMAGES\tCREATED")
+	for _, gallery := range galleries {
+		images, err := services.Image.ByGalleryID(gallery.ID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", gallery.ID, gallery.Title, gallery.Visibility,
+			len(images), gallery.CreatedAt.Format("Jan 2, 2006"))
+	}
+
+	return w.Flush()
+}
+
+// reconcile fixes up storage and the database in both
+// directions. Records whose file has gone are only listed unless
+// -delete-orphans is given, so a storage outage can't wipe them.
+func reconcile(t *tool, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	deleteOrphans := fs.Bool("delete-orphans", false, "delete the records of images whose file is missing")
+	fs.Parse(args)
+
+	services, err := t.open()
+	if err != nil {
+		return err
+	}
+
+	imported, err := services.Image.Reconcile()
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d Image(s) From Storage", imported)
+
+	orphans, err := services.Image.Orphans()
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		log.Println("Every Image Record Has A File")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tGALLERY\tUSER\tFILENAME\tCREATED")
+	for _, image := range orphans {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\n", image.ID, image.GalleryID, image.UserID,
+			image.Filename, image.CreatedAt.Format("Jan 2, 2006"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if !*deleteOrphans {
+		log.Printf("%d Image Record(s) Have No File, Run Again With -delete-orphans To Delete Them", len(orphans))
+		return nil
+	}
+	for i := range orphans {
+		if err := services.Image.Delete(&orphans[i]); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Deleted %d Image Record(s) With No File", len(orphans))
+	return nil
+}
+
+// audit records a change made from the command line. There is
+// no signed in admin, so the event has no actor.
+func audit(services *models.Services, action string, user *models.User) {
+	event := models.AuditEvent{
+		Action:     action,
+		TargetType: models.AuditTargetUser,
+		TargetID:   user.ID,
+		Detail:     user.EmailAddress + " from the command line",
+	}
+	if err := services.Audit.Create(&event); err != nil {
+		log.Printf("audit() ERROR recording %s: %v", action, err)
+	}
+}
+
+// passwordOrStdin keeps passwords out of the shell history
+// unless they were given as a flag
+func passwordOrStdin(password string) (string, error) {
+	if password != "" {
+		return password, nil
+	}
+
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
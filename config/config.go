@@ -0,0 +1,307 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/storage"
+	"golang.org/x/oauth2"
+)
+
+// PostgresConfig ...
+type PostgresConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Name     string `json:"name"`
+}
+
+// Dialect ...
+func (c PostgresConfig) Dialect() string {
+	return "postgres"
+}
+
+// ConnString ...
+func (c PostgresConfig) ConnString() string {
+	if c.Password == "" {
+		return fmt.Sprintf("host=%s port=%d user=%s dbname=%s sslmode=disable",
+			c.Host, c.Port, c.Username, c.Name)
+	}
+
+	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		c.Host, c.Port, c.Username, c.Password, c.Name)
+}
+
+// DefaultPostgresConfig ...
+func DefaultPostgresConfig() PostgresConfig {
+	return PostgresConfig{
+		Host:     "localhost",
+		Port:     5432,
+		Username: "arnoldokoth",
+		Password: "Password123!",
+		Name:     "lenslocked_dev",
+	}
+}
+
+// Config ...
+type Config struct {
+	Port           int            `json:"port"`
+	Env            string         `json:"env"`
+	BaseURL        string         `json:"base_url"`
+	Pepper         string         `json:"pepper"`
+	HMACKey        string         `json:"hmac_key"`
+	EncryptionKey  string         `json:"encryption_key"`
+	PwResetMinutes int            `json:"pw_reset_minutes"`
+	Database       PostgresConfig `json:"database"`
+	Mailgun        MailgunConfig  `json:"mailgun"`
+	Dropbox        OAuthConfig    `json:"dropbox"`
+	Storage        StorageConfig  `json:"storage"`
+	Uploads        UploadConfig   `json:"uploads"`
+	// LoginStore is where failed logins are counted, "memory"
+	// or "database" when running more than one server
+	LoginStore string `json:"login_store"`
+	// AccountDeletionDays is how long users have to cancel
+	// deleting their account before it is purged
+	AccountDeletionDays int `json:"account_deletion_days"`
+
+	// OAuth holds every OAuth provider users can connect, keyed
+	// by the name used in the provider's URLs
+	OAuth map[string]OAuthConfig `json:"oauth"`
+	// OIDC holds the identity providers users can sign in with,
+	// keyed by the name used in the provider's URLs
+	OIDC map[string]OIDCConfig `json:"oidc"`
+}
+
+// IsProd ...
+func (c Config) IsProd() bool {
+	return c.Env == "production"
+}
+
+// OAuthProviders returns every configured OAuth provider. The
+// top level dropbox config predates OAuth and is still used
+// when there is no dropbox provider.
+func (c Config) OAuthProviders() map[string]OAuthConfig {
+	providers := make(map[string]OAuthConfig)
+	if c.Dropbox.ID != "" {
+		providers[models.OAuthDropbox] = c.Dropbox
+	}
+	for name, provider := range c.OAuth {
+		providers[name] = provider
+	}
+
+	return providers
+}
+
+// OAuthConfigs builds the oauth2 config for each provider,
+// redirecting back to BaseURL once the user is done
+func (c Config) OAuthConfigs() map[string]*oauth2.Config {
+	configs := make(map[string]*oauth2.Config)
+	for name, provider := range c.OAuthProviders() {
+		configs[name] = &oauth2.Config{
+			ClientID:     provider.ID,
+			ClientSecret: provider.Secret,
+			Endpoint: oauth2.Endpoint{
+				AuthURL:  provider.AuthURL,
+				TokenURL: provider.TokenURL,
+			},
+			RedirectURL: fmt.Sprintf("%s/oauth/%s/callback", strings.TrimSuffix(c.BaseURL, "/"), name),
+			Scopes:      provider.Scopes,
+		}
+	}
+
+	return configs
+}
+
+// OIDCClientConfig builds the oauth2 config for an identity
+// provider. Its endpoints are left empty, they are discovered
+// from the issuer when the provider is first used.
+func (c Config) OIDCClientConfig(name string, provider OIDCConfig) oauth2.Config {
+	scopes := provider.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	return oauth2.Config{
+		ClientID:     provider.ClientID,
+		ClientSecret: provider.ClientSecret,
+		RedirectURL:  fmt.Sprintf("%s/login/%s/callback", strings.TrimSuffix(c.BaseURL, "/"), name),
+		Scopes:       scopes,
+	}
+}
+
+// PwResetTTL returns how long a password reset token is valid for
+func (c Config) PwResetTTL() time.Duration {
+	return time.Duration(c.PwResetMinutes) * time.Minute
+}
+
+// AccountDeletionGrace returns how long deleted accounts are
+// kept for. Configs from before it existed get 14 days rather
+// than accounts being purged the moment they're deleted.
+func (c Config) AccountDeletionGrace() time.Duration {
+	days := c.AccountDeletionDays
+	if days <= 0 {
+		days = 14
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// DefaultConfig ...
+func DefaultConfig() Config {
+	return Config{
+		Port:                3000,
+		Env:                 "development",
+		BaseURL:             "http://localhost:3000",
+		Pepper:              "5881f867b9078bd1d3ce164cc2466b13c4028ea12df14dfee9a6465e8c0b39ee",
+		HMACKey:             "4ed10e653ae1c61f0d842491c00eba6bd0f34fa5702f75abb5a12aaba721c2a9",
+		EncryptionKey:       "b3b1c7f24d0e8a9f6c5d2e1a0f9b8c7d6e5f4a3b2c1d0e9f8a7b6c5d4e3f2a1b",
+		PwResetMinutes:      12 * 60,
+		AccountDeletionDays: 14,
+		Database:            DefaultPostgresConfig(),
+		Storage:             DefaultStorageConfig(),
+		Uploads:             DefaultUploadConfig(),
+	}
+}
+
+// MailgunConfig ...
+type MailgunConfig struct {
+	APIKey       string `json:"api_key"`
+	PublicAPIKey string `json:"public_api_key"`
+	Domain       string `json:"domain"`
+}
+
+// OAuthConfig ...
+type OAuthConfig struct {
+	ID       string   `json:"id"`
+	Secret   string   `json:"secret"`
+	AuthURL  string   `json:"auth_url"`
+	TokenURL string   `json:"token_url"`
+	Scopes   []string `json:"scopes"`
+	// APIURL and ContentURL override where API calls go, they
+	// default to the real service and only need setting to
+	// test against a fake one
+	APIURL     string `json:"api_url"`
+	ContentURL string `json:"content_url"`
+}
+
+// OIDCConfig is an OpenID Connect identity provider. Scopes
+// default to openid, email and profile.
+type OIDCConfig struct {
+	DisplayName  string   `json:"display_name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+	// AllowSignup creates an account for anyone who signs in
+	// through the provider without already having one
+	AllowSignup bool `json:"allow_signup"`
+}
+
+// StorageConfig selects where uploaded images are kept.
+// Driver is either "local" or "s3", the remaining fields
+// only apply to the s3 driver.
+type StorageConfig struct {
+	Driver    string `json:"driver"`
+	Dir       string `json:"dir"`
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+// DefaultStorageConfig ...
+func DefaultStorageConfig() StorageConfig {
+	return StorageConfig{
+		Driver: "local",
+		Dir:    "images",
+	}
+}
+
+// storageURLTTL is roughly how long links to stored images
+// keep working
+const storageURLTTL = time.Hour
+
+// NewStorage opens the storage the config selects. Locally
+// stored files are only served through URLs signed with
+// signingKey, S3 hands out presigned URLs so the bucket can
+// stay private.
+func (c StorageConfig) NewStorage(signingKey string) (storage.Storage, error) {
+	switch c.Driver {
+	case "", "local":
+		dir := c.Dir
+		if dir == "" {
+			dir = "images"
+		}
+		return storage.NewLocal(dir, "/images", storage.WithSignedURLs(signingKey, storageURLTTL)), nil
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:  c.Endpoint,
+			Region:    c.Region,
+			Bucket:    c.Bucket,
+			AccessKey: c.AccessKey,
+			SecretKey: c.SecretKey,
+			URLTTL:    storageURLTTL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", c.Driver)
+	}
+}
+
+// UploadConfig ...
+type UploadConfig struct {
+	MaxFileMB     int `json:"max_file_mb"`
+	MaxMegapixels int `json:"max_megapixels"`
+	QuotaMB       int `json:"quota_mb"`
+}
+
+// DefaultUploadConfig ...
+func DefaultUploadConfig() UploadConfig {
+	return UploadConfig{
+		MaxFileMB:     20,
+		MaxMegapixels: 50,
+		QuotaMB:       1024,
+	}
+}
+
+// Limits converts the config into the limits the image
+// service enforces, using the defaults for anything unset
+func (c UploadConfig) Limits() models.UploadLimits {
+	limits := models.DefaultUploadLimits()
+	if c.MaxFileMB > 0 {
+		limits.MaxFileSize = int64(c.MaxFileMB) << 20
+	}
+	if c.MaxMegapixels > 0 {
+		limits.MaxPixels = c.MaxMegapixels * 1000 * 1000
+	}
+	if c.QuotaMB > 0 {
+		limits.Quota = int64(c.QuotaMB) << 20
+	}
+
+	return limits
+}
+
+// LoadConfig ...
+func LoadConfig() Config {
+	file, err := os.Open(".config.json")
+	if err != nil {
+		log.Println("Using Default Config")
+		return DefaultConfig()
+	}
+
+	var c Config
+	decoder := json.NewDecoder(file)
+	err = decoder.Decode(&c)
+	if err != nil {
+		log.Fatalln("LoadConfig() ERROR:", err)
+	}
+
+	log.Println("Successfully Loaded .config File")
+	return c
+}
@@ -9,7 +9,9 @@ import (
 type privateKey string
 
 const (
-	userKey privateKey = "user"
+	userKey    privateKey = "user"
+	sessionKey privateKey = "session"
+	tokenKey   privateKey = "api_token"
 )
 
 // WithUser ...
@@ -27,3 +29,37 @@ func User(ctx context.Context) *models.User {
 
 	return nil
 }
+
+// WithSession ...
+func WithSession(ctx context.Context, session *models.Session) context.Context {
+	return context.WithValue(ctx, sessionKey, session)
+}
+
+// Session returns the session the current request was
+// authenticated with
+func Session(ctx context.Context) *models.Session {
+	if tmp := ctx.Value(sessionKey); tmp != nil {
+		if session, ok := tmp.(*models.Session); ok {
+			return session
+		}
+	}
+
+	return nil
+}
+
+// WithAPIToken ...
+func WithAPIToken(ctx context.Context, token *models.APIToken) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+// APIToken returns the API token the current request was
+// authenticated with, if any
+func APIToken(ctx context.Context) *models.APIToken {
+	if tmp := ctx.Value(tokenKey); tmp != nil {
+		if token, ok := tmp.(*models.APIToken); ok {
+			return token
+		}
+	}
+
+	return nil
+}
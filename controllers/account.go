@@ -0,0 +1,311 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/email"
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/views"
+)
+
+// NewAccount ...
+func NewAccount(us models.UserService, ss models.SessionService, ts models.APITokenService,
+	ads models.AccountDeletionService, as models.AuditService, emailer *email.Client) *Account {
+	return &Account{
+		SettingsView: views.NewView("bootstrap", "account/settings"),
+		ActivityView: views.NewView("bootstrap", "account/activity"),
+		us:           us,
+		ss:           ss,
+		ts:           ts,
+		ads:          ads,
+		as:           as,
+		emailer:      emailer,
+	}
+}
+
+// Account lets signed in users change their details
+type Account struct {
+	SettingsView *views.View
+	ActivityView *views.View
+	us           models.UserService
+	ss           models.SessionService
+	ts           models.APITokenService
+	ads          models.AccountDeletionService
+	as           models.AuditService
+	emailer      *email.Client
+}
+
+// activityLimit is how many events the activity page shows
+const activityLimit = 50
+
+// AccountForm is used by every form on the settings page,
+// each one only fills in the fields it needs
+type AccountForm struct {
+	Name            string `schema:"name"`
+	EmailAddress    string `schema:"email"`
+	CurrentPassword string `schema:"current_password"`
+	NewPassword     string `schema:"new_password"`
+}
+
+// AccountData ...
+type AccountData struct {
+	Name         string
+	EmailAddress string
+	Verified     bool
+	// PendingEmail is the address the user is changing to
+	// until they verify it
+	PendingEmail string
+	// DeleteAfter is set once the user has asked for their
+	// account to be deleted
+	DeleteAfter *time.Time
+	GraceDays   int
+}
+
+// Settings ...
+// GET /account
+func (a *Account) Settings(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	a.render(w, r, vd)
+}
+
+// Activity shows what has recently been done by or to the
+// user's account so they can spot anything they don't recognise
+// GET /account/activity
+func (a *Account) Activity(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	events, err := a.as.Search(models.AuditQuery{UserID: user.ID, Limit: activityLimit})
+	if err != nil {
+		log.Println("account.Activity() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	vd.Yield = events
+
+	a.ActivityView.Render(w, r, vd)
+}
+
+// UpdateName ...
+// POST /account/name
+func (a *Account) UpdateName(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AccountForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("account.UpdateName() ERROR:", err)
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	user := *context.User(r.Context())
+	user.Name = form.Name
+	if err := a.us.As(auditActor(r)).Update(&user); err != nil {
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your Name Has Been Updated.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// UpdateEmail starts changing the user's email address. It
+// only changes once the link sent to the new address has been
+// followed, and the old one is told about the change in case
+// it wasn't the owner who asked for it.
+// POST /account/email
+func (a *Account) UpdateEmail(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AccountForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("account.UpdateEmail() ERROR:", err)
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	current := context.User(r.Context())
+	if err := a.us.CheckPassword(current, form.CurrentPassword, clientIP(r)); err != nil {
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	user := *current
+	token, err := a.us.As(auditActor(r)).ChangeEmail(&user, form.EmailAddress)
+	switch err {
+	case nil:
+	case models.ErrEmailUnchanged:
+		alert := views.Alert{
+			Level:   views.AlertLvlInfo,
+			Message: "That Is Already Your Email Address.",
+		}
+		views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+		return
+	default:
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	go a.emailer.EmailChangeRequested(user.Name, user.EmailAddress, user.PendingEmail)
+	go a.emailer.Verify(user.Name, user.PendingEmail, token)
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Please Check Your Inbox At " + user.PendingEmail + " And Follow The Link To Finish Changing Your Email Address.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// UpdatePassword changes the user's password once they have
+// entered their current one. Every other device is signed out,
+// API tokens are revoked and this one gets a new session.
+// POST /account/password
+func (a *Account) UpdatePassword(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AccountForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("account.UpdatePassword() ERROR:", err)
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	current := context.User(r.Context())
+	if err := a.us.CheckPassword(current, form.CurrentPassword, clientIP(r)); err != nil {
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+	if form.NewPassword == "" {
+		vd.SetAlert(models.ErrPasswordRequired)
+		a.render(w, r, vd)
+		return
+	}
+
+	user := *current
+	user.Password = form.NewPassword
+	if err := a.us.As(auditActor(r)).Update(&user); err != nil {
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	// the change isn't done until whoever knew the old
+	// password has been signed out
+	if err := signOutEverywhere(a.ss, a.ts, user.ID); err != nil {
+		log.Println("account.UpdatePassword() ERROR:", err)
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+	if err := startSession(w, r, a.ss, &user); err != nil {
+		log.Println("account.UpdatePassword() ERROR:", err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your Password Has Been Changed, Your Other Devices Have Been Signed Out And Your API Tokens Revoked.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// Delete schedules the user's account for deletion once they
+// have entered their password. They stay signed in so they can
+// cancel, every other device is signed out.
+// POST /account/delete
+func (a *Account) Delete(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AccountForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("account.Delete() ERROR:", err)
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	user := *context.User(r.Context())
+	if err := a.us.CheckPassword(&user, form.CurrentPassword, clientIP(r)); err != nil {
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	if err := a.ads.Schedule(&user); err != nil {
+		log.Println("account.Delete() ERROR:", err)
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	// the deletion only goes ahead once every other device is
+	// signed out, otherwise the user is told it failed and
+	// nothing is left scheduled
+	if err := a.ss.DeleteByUserID(user.ID); err != nil {
+		log.Println("account.Delete() ERROR:", err)
+		if err := a.ads.Cancel(&user); err != nil {
+			log.Println("account.Delete() Cancel ERROR:", err)
+		}
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+	if err := startSession(w, r, a.ss, &user); err != nil {
+		log.Println("account.Delete() ERROR:", err)
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	go a.emailer.DeletionScheduled(user.Name, user.EmailAddress, *user.DeleteAfter)
+
+	alert := views.Alert{
+		Level:   views.AlertLvlWarning,
+		Message: fmt.Sprintf("Your Account Will Be Deleted On %s. You Can Cancel Any Time Before Then.", user.DeleteAfter.Format("Jan 2, 2006")),
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// CancelDelete keeps an account that was scheduled for deletion
+// POST /account/delete/cancel
+func (a *Account) CancelDelete(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := *context.User(r.Context())
+	if err := a.ads.Cancel(&user); err != nil {
+		log.Println("account.CancelDelete() ERROR:", err)
+		vd.SetAlert(err)
+		a.render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your Account Will Not Be Deleted.",
+	}
+	views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+}
+
+// render shows the settings page with the user's saved details,
+// never what was submitted, so a failed change isn't mistaken
+// for a saved one
+func (a *Account) render(w http.ResponseWriter, r *http.Request, vd views.Data) {
+	user := context.User(r.Context())
+	vd.Yield = AccountData{
+		Name:         user.Name,
+		EmailAddress: user.EmailAddress,
+		Verified:     user.IsVerified(),
+		PendingEmail: user.PendingEmail,
+		DeleteAfter:  user.DeleteAfter,
+		GraceDays:    int(a.ads.Grace().Hours() / 24),
+	}
+
+	a.SettingsView.Render(w, r, vd)
+}
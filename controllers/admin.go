@@ -0,0 +1,395 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/views"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// adminSessionCookie holds the admin's own session token
+	// while they're impersonating someone
+	adminSessionCookie = "admin_session_token"
+	// impersonationTTL is how long an admin can be signed in as
+	// someone else before having to start again
+	impersonationTTL = time.Hour
+	// adminListLimit is how many users or galleries are listed
+	adminListLimit = 50
+	// adminAuditLimit is how many audit events are listed
+	adminAuditLimit = 200
+)
+
+// NewAdmin ...
+func NewAdmin(us models.UserService, ss models.SessionService, gs models.GalleryService,
+	as models.AuditService) *Admin {
+	return &Admin{
+		DashboardView: views.NewView("bootstrap", "admin/dashboard"),
+		UsersView:     views.NewView("bootstrap", "admin/users"),
+		GalleriesView: views.NewView("bootstrap", "admin/galleries"),
+		AuditView:     views.NewView("bootstrap", "admin/audit"),
+		us:            us,
+		ss:            ss,
+		gs:            gs,
+		as:            as,
+	}
+}
+
+// Admin is the area admins use to look after users and deal
+// with abuse. Everything that changes anything is audited.
+type Admin struct {
+	DashboardView *views.View
+	UsersView     *views.View
+	GalleriesView *views.View
+	AuditView     *views.View
+	us            models.UserService
+	ss            models.SessionService
+	gs            models.GalleryService
+	as            models.AuditService
+}
+
+// AdminSearchForm ...
+type AdminSearchForm struct {
+	Query string `schema:"q"`
+}
+
+// AdminUsersData ...
+type AdminUsersData struct {
+	Query string
+	Users []models.User
+}
+
+// AdminAuditForm filters the audit log, fields left empty
+// match everything
+type AdminAuditForm struct {
+	ActorID    uint   `schema:"actor"`
+	UserID     uint   `schema:"user"`
+	Action     string `schema:"action"`
+	TargetType string `schema:"target_type"`
+	TargetID   uint   `schema:"target_id"`
+}
+
+// AdminAuditData ...
+type AdminAuditData struct {
+	Form   AdminAuditForm
+	Events []models.AuditEvent
+}
+
+// AdminGalleriesData ...
+type AdminGalleriesData struct {
+	Query     string
+	Galleries []models.Gallery
+}
+
+// Dashboard shows what admins have done recently
+// GET /admin
+func (a *Admin) Dashboard(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	events, err := a.as.Search(models.AuditQuery{Action: "admin.", Limit: 50})
+	if err != nil {
+		log.Println("admin.Dashboard() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	vd.Yield = events
+
+	a.DashboardView.Render(w, r, vd)
+}
+
+// Users lists the newest users, or the ones whose name or email
+// address matches the search
+// GET /admin/users?q=
+func (a *Admin) Users(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AdminSearchForm
+	if err := parseURLParams(r, &form); err != nil {
+		log.Println("admin.Users() ERROR:", err)
+	}
+
+	users, err := a.us.Search(form.Query, adminListLimit)
+	if err != nil {
+		log.Println("admin.Users() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	vd.Yield = AdminUsersData{Query: form.Query, Users: users}
+
+	a.UsersView.Render(w, r, vd)
+}
+
+// Galleries lists the newest galleries, or the ones whose title
+// matches the search
+// GET /admin/galleries?q=
+func (a *Admin) Galleries(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AdminSearchForm
+	if err := parseURLParams(r, &form); err != nil {
+		log.Println("admin.Galleries() ERROR:", err)
+	}
+
+	galleries, err := a.gs.Search(form.Query, adminListLimit)
+	if err != nil {
+		log.Println("admin.Galleries() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	vd.Yield = AdminGalleriesData{Query: form.Query, Galleries: galleries}
+
+	a.GalleriesView.Render(w, r, vd)
+}
+
+// Audit searches everything that has been recorded in the
+// audit log
+// GET /admin/audit?actor=&user=&action=&target_type=&target_id=
+func (a *Admin) Audit(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form AdminAuditForm
+	if err := parseURLParams(r, &form); err != nil {
+		log.Println("admin.Audit() ERROR:", err)
+	}
+
+	events, err := a.as.Search(models.AuditQuery{
+		ActorID:    form.ActorID,
+		UserID:     form.UserID,
+		Action:     form.Action,
+		TargetType: form.TargetType,
+		TargetID:   form.TargetID,
+		Limit:      adminAuditLimit,
+	})
+	if err != nil {
+		log.Println("admin.Audit() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	vd.Yield = AdminAuditData{Form: form, Events: events}
+
+	a.AuditView.Render(w, r, vd)
+}
+
+// DisableUser stops the user signing in and signs them out
+// everywhere
+// POST /admin/users/:id/disable
+func (a *Admin) DisableUser(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	admin := context.User(r.Context())
+	if user.ID == admin.ID {
+		a.redirect(w, r, "/admin/users", views.AlertLvlError, "You Can't Disable Your Own Account.")
+		return
+	}
+
+	now := time.Now()
+	user.DisabledAt = &now
+	if err := a.us.As(auditActor(r)).Update(user); err != nil {
+		log.Println("admin.DisableUser() ERROR:", err)
+		a.redirect(w, r, "/admin/users", views.AlertLvlError, views.AlertMsgGeneric)
+		return
+	}
+	if err := a.ss.DeleteByUserID(user.ID); err != nil {
+		log.Println("admin.DisableUser() ERROR:", err)
+	}
+	a.audit(r, admin.ID, models.AuditAdminDisableUser, models.AuditTargetUser, user.ID, user.EmailAddress)
+
+	a.redirect(w, r, "/admin/users", views.AlertLvlSuccess, fmt.Sprintf("%s Has Been Disabled.", user.EmailAddress))
+}
+
+// EnableUser lets a disabled user sign in again
+// POST /admin/users/:id/enable
+func (a *Admin) EnableUser(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+
+	admin := context.User(r.Context())
+	user.DisabledAt = nil
+	if err := a.us.As(auditActor(r)).Update(user); err != nil {
+		log.Println("admin.EnableUser() ERROR:", err)
+		a.redirect(w, r, "/admin/users", views.AlertLvlError, views.AlertMsgGeneric)
+		return
+	}
+	a.audit(r, admin.ID, models.AuditAdminEnableUser, models.AuditTargetUser, user.ID, user.EmailAddress)
+
+	a.redirect(w, r, "/admin/users", views.AlertLvlSuccess, fmt.Sprintf("%s Has Been Enabled.", user.EmailAddress))
+}
+
+// Impersonate signs the admin in as the user so they can see
+// what the user sees. The admin's own session is put aside in
+// a cookie and given back by StopImpersonating.
+// POST /admin/users/:id/impersonate
+func (a *Admin) Impersonate(w http.ResponseWriter, r *http.Request) {
+	user, err := a.userByID(w, r)
+	if err != nil {
+		return
+	}
+	if user.IsAdmin() {
+		a.redirect(w, r, "/admin/users", views.AlertLvlError, "Admins Can't Be Impersonated.")
+		return
+	}
+
+	adminCookie, err := r.Cookie("session_token")
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	admin := context.User(r.Context())
+	session := models.Session{
+		UserID:         user.ID,
+		UserAgent:      r.UserAgent(),
+		IPAddress:      clientIP(r),
+		ExpiresAt:      time.Now().Add(impersonationTTL),
+		ImpersonatorID: admin.ID,
+	}
+	if err := a.ss.Create(&session); err != nil {
+		log.Println("admin.Impersonate() ERROR:", err)
+		a.redirect(w, r, "/admin/users", views.AlertLvlError, views.AlertMsgGeneric)
+		return
+	}
+	a.audit(r, admin.ID, models.AuditAdminImpersonate, models.AuditTargetUser, user.ID, user.EmailAddress)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookie,
+		Value:    adminCookie.Value,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    session.Token,
+		Path:     "/",
+		Expires:  session.ExpiresAt,
+		HttpOnly: true,
+	})
+
+	a.redirect(w, r, "/galleries", views.AlertLvlWarning, fmt.Sprintf("You Are Now Signed In As %s.", user.EmailAddress))
+}
+
+// StopImpersonating ends the impersonation and signs the admin
+// back in as themselves. It can't be behind RequireAdmin as the
+// signed in user is the one being impersonated.
+// POST /admin/impersonate/stop
+func (a *Admin) StopImpersonating(w http.ResponseWriter, r *http.Request) {
+	session := context.Session(r.Context())
+	if session == nil || !session.IsImpersonation() {
+		http.NotFound(w, r)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := a.ss.Delete(session.ID); err != nil {
+		log.Println("admin.StopImpersonating() ERROR:", err)
+	}
+
+	a.audit(r, session.ImpersonatorID, models.AuditAdminStopImpersonating,
+		models.AuditTargetUser, user.ID, user.EmailAddress)
+
+	// the admin's session is only given back if it's still
+	// theirs, otherwise they have to log in again
+	sessionCookie := http.Cookie{
+		Name:     "session_token",
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	}
+	if cookie, err := r.Cookie(adminSessionCookie); err == nil {
+		adminSession, err := a.ss.ByToken(cookie.Value)
+		if err == nil && adminSession.UserID == session.ImpersonatorID {
+			sessionCookie.Value = cookie.Value
+			sessionCookie.Expires = adminSession.ExpiresAt
+		}
+	}
+	http.SetCookie(w, &sessionCookie)
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminSessionCookie,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	})
+
+	if sessionCookie.Value == "" {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/admin/users", http.StatusFound)
+}
+
+// DeleteGallery removes an abusive gallery along with its image
+// files and share links
+// POST /admin/galleries/:id/delete
+func (a *Admin) DeleteGallery(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid Gallery ID", http.StatusNotFound)
+		return
+	}
+
+	gallery, err := a.gs.ByID(uint(id))
+	if err != nil {
+		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err := a.gs.As(auditActor(r)).Delete(gallery.ID); err != nil {
+		log.Println("admin.DeleteGallery() ERROR:", err)
+		a.redirect(w, r, "/admin/galleries", views.AlertLvlError, views.AlertMsgGeneric)
+		return
+	}
+	admin := context.User(r.Context())
+	detail := fmt.Sprintf("%q owned by user %d", gallery.Title, gallery.UserID)
+	a.audit(r, admin.ID, models.AuditAdminDeleteGallery, models.AuditTargetGallery, gallery.ID, detail)
+
+	a.redirect(w, r, "/admin/galleries", views.AlertLvlSuccess, "The Gallery Has Been Deleted.")
+}
+
+func (a *Admin) userByID(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid User ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	user, err := a.us.ByID(uint(id))
+	if err != nil {
+		http.Error(w, "User Not Found", http.StatusNotFound)
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// audit records what an admin just did. A failure is only
+// logged, the action has already happened by then.
+func (a *Admin) audit(r *http.Request, adminID uint, action, targetType string, targetID uint, detail string) {
+	event := models.AuditEvent{
+		ActorID:    adminID,
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		IPAddress:  clientIP(r),
+		UserAgent:  r.UserAgent(),
+		Detail:     detail,
+	}
+	if err := a.as.Create(&event); err != nil {
+		log.Printf("admin.audit() ERROR recording %s: %v", action, err)
+	}
+}
+
+func (a *Admin) redirect(w http.ResponseWriter, r *http.Request, url, level, message string) {
+	alert := views.Alert{
+		Level:   level,
+		Message: message,
+	}
+	views.RedirectAlert(w, r, url, http.StatusFound, alert)
+}
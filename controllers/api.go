@@ -0,0 +1,383 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/views"
+	"github.com/gorilla/mux"
+)
+
+// maxJSONBody is the largest JSON request body the API reads
+const maxJSONBody = 1 << 20
+
+// NewAPI ...
+func NewAPI(gs models.GalleryService, is models.ImageService) *API {
+	return &API{
+		gs: gs,
+		is: is,
+	}
+}
+
+// API serves the JSON version of the gallery and image
+// controllers under /api/v1
+type API struct {
+	gs models.GalleryService
+	is models.ImageService
+}
+
+// APIError is the body of every failed API request
+type APIError struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// APIGallery ...
+type APIGallery struct {
+	ID         uint      `json:"id"`
+	Title      string    `json:"title"`
+	Visibility string    `json:"visibility"`
+	Slug       string    `json:"slug"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// APIImage ...
+type APIImage struct {
+	ID        uint              `json:"id"`
+	GalleryID uint              `json:"gallery_id"`
+	Name      string            `json:"name"`
+	Caption   string            `json:"caption"`
+	Position  int               `json:"position"`
+	Size      int64             `json:"size"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	URL       string            `json:"url"`
+	Sizes     map[string]string `json:"sizes"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// APIGalleryForm is the body of gallery create and update
+// requests, fields left out of an update are unchanged
+type APIGalleryForm struct {
+	Title      *string `json:"title"`
+	Visibility *string `json:"visibility"`
+}
+
+func newAPIGallery(gallery *models.Gallery) APIGallery {
+	return APIGallery{
+		ID:         gallery.ID,
+		Title:      gallery.Title,
+		Visibility: gallery.Visibility,
+		Slug:       gallery.Slug,
+		CreatedAt:  gallery.CreatedAt,
+		UpdatedAt:  gallery.UpdatedAt,
+	}
+}
+
+func newAPIImage(image *models.Image) APIImage {
+	sizes := make(map[string]string)
+	for _, v := range image.Variants {
+		sizes[v.Name] = v.URL
+	}
+
+	return APIImage{
+		ID:        image.ID,
+		GalleryID: image.GalleryID,
+		Name:      image.Name(),
+		Caption:   image.Caption,
+		Position:  image.Position,
+		Size:      image.Size,
+		Width:     image.Width,
+		Height:    image.Height,
+		URL:       image.Path(),
+		Sizes:     sizes,
+		CreatedAt: image.CreatedAt,
+	}
+}
+
+// Galleries ...
+// GET /api/v1/galleries
+func (a *API) Galleries(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	galleries, err := a.gs.ByUserID(user.ID)
+	if err != nil {
+		log.Println("api.Galleries() ERROR:", err)
+		writeAPIError(w, err)
+		return
+	}
+
+	ret := make([]APIGallery, 0, len(galleries))
+	for i := range galleries {
+		ret = append(ret, newAPIGallery(&galleries[i]))
+	}
+
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// GalleryCreate ...
+// POST /api/v1/galleries
+func (a *API) GalleryCreate(w http.ResponseWriter, r *http.Request) {
+	// the same rule as /galleries/new, only verified users can
+	// create galleries
+	user := context.User(r.Context())
+	if !user.IsVerified() {
+		writeJSONError(w, http.StatusForbidden, "Please Verify Your Email Address Before Creating Galleries")
+		return
+	}
+
+	var form APIGalleryForm
+	if err := readJSON(w, r, &form); err != nil {
+		return
+	}
+
+	gallery := models.Gallery{UserID: user.ID}
+	form.apply(&gallery)
+
+	if err := a.gs.As(auditActor(r)).Create(&gallery); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, newAPIGallery(&gallery))
+}
+
+// Gallery ...
+// GET /api/v1/galleries/:id
+func (a *API) Gallery(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+// GalleryUpdate ...
+// PATCH /api/v1/galleries/:id
+func (a *API) GalleryUpdate(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var form APIGalleryForm
+	if err := readJSON(w, r, &form); err != nil {
+		return
+	}
+	form.apply(gallery)
+
+	if err := a.gs.As(auditActor(r)).Update(gallery); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newAPIGallery(gallery))
+}
+
+// GalleryDelete ...
+// DELETE /api/v1/galleries/:id
+func (a *API) GalleryDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	if err := a.gs.As(auditActor(r)).Delete(gallery.ID); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Images ...
+// GET /api/v1/galleries/:id/images
+func (a *API) Images(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	images, err := a.is.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println("api.Images() ERROR:", err)
+		writeAPIError(w, err)
+		return
+	}
+
+	ret := make([]APIImage, 0, len(images))
+	for i := range images {
+		ret = append(ret, newAPIImage(&images[i]))
+	}
+
+	writeJSON(w, http.StatusOK, ret)
+}
+
+// ImageUpload accepts the same multipart form as the HTML
+// upload, one or more files in the images field
+// POST /api/v1/galleries/:id/images
+func (a *API) ImageUpload(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	maxBody := a.is.Limits().MaxFileSize*maxUploadFiles + maxMultipartMem
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	if err := r.ParseMultipartForm(maxMultipartMem); err != nil {
+		log.Println("api.ImageUpload() ParseMultipartForm ERROR:", err)
+		writeJSONError(w, http.StatusBadRequest, "That Upload Was Too Large Or Could Not Be Read")
+		return
+	}
+
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "No Images Were Uploaded")
+		return
+	}
+	if len(files) > maxUploadFiles {
+		writeJSONError(w, http.StatusBadRequest,
+			fmt.Sprintf("Uploads Are Limited To %d Images At A Time", maxUploadFiles))
+		return
+	}
+
+	user := context.User(r.Context())
+	is := a.is.As(auditActor(r))
+	ret := make([]APIImage, 0, len(files))
+	for _, f := range files {
+		file, err := f.Open()
+		if err != nil {
+			writeAPIError(w, err)
+			return
+		}
+
+		image := models.Image{
+			GalleryID:    gallery.ID,
+			UserID:       user.ID,
+			OriginalName: f.Filename,
+		}
+		if err := is.Create(&image, file); err != nil {
+			writeAPIError(w, err)
+			return
+		}
+		ret = append(ret, newAPIImage(&image))
+	}
+
+	writeJSON(w, http.StatusCreated, ret)
+}
+
+// ImageDelete ...
+// DELETE /api/v1/galleries/:id/images/:imageID
+func (a *API) ImageDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := a.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["imageID"])
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Image Not Found")
+		return
+	}
+
+	image, err := a.is.ByID(uint(id))
+	if err == nil && image.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	if err := a.is.As(auditActor(r)).Delete(image); err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// galleryByID only finds galleries owned by the current user,
+// the API has no read only access to anyone else's
+func (a *API) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "Gallery Not Found")
+		return nil, err
+	}
+
+	gallery, err := a.gs.ByID(uint(id))
+	if err != nil {
+		writeAPIError(w, err)
+		return nil, err
+	}
+
+	user := context.User(r.Context())
+	if !gallery.IsOwnedBy(user) {
+		writeAPIError(w, models.ErrNotFound)
+		return nil, models.ErrNotFound
+	}
+
+	return gallery, nil
+}
+
+func (form *APIGalleryForm) apply(gallery *models.Gallery) {
+	if form.Title != nil {
+		gallery.Title = *form.Title
+	}
+	if form.Visibility != nil {
+		gallery.Visibility = *form.Visibility
+	}
+}
+
+// readJSON decodes the request body into dst, writing an error
+// response if it can't
+func readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Request Body Is Not Valid JSON")
+		return err
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("writeJSON() ERROR:", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, struct {
+		Error APIError `json:"error"`
+	}{APIError{Status: status, Message: message}})
+}
+
+// writeAPIError turns err into an error response. Errors meant
+// for users are returned as they are, anything else is logged
+// and hidden behind a generic message.
+func writeAPIError(w http.ResponseWriter, err error) {
+	if err == models.ErrNotFound {
+		writeJSONError(w, http.StatusNotFound, "Not Found")
+		return
+	}
+
+	if pErr, ok := err.(views.PublicError); ok {
+		writeJSONError(w, http.StatusUnprocessableEntity, pErr.Public())
+		return
+	}
+
+	log.Println("api ERROR:", err)
+	writeJSONError(w, http.StatusInternalServerError, ErrGeneric.Error())
+}
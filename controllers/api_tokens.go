@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/views"
+	"github.com/gorilla/mux"
+)
+
+// NewAPITokens ...
+func NewAPITokens(ts models.APITokenService) *APITokens {
+	return &APITokens{
+		TokensView: views.NewView("bootstrap", "users/tokens"),
+		ts:         ts,
+	}
+}
+
+// APITokens lets users manage the tokens their scripts use
+// to call the API
+type APITokens struct {
+	TokensView *views.View
+	ts         models.APITokenService
+}
+
+// APITokenForm ...
+type APITokenForm struct {
+	Name string `schema:"name"`
+	// Access is either read or write, write tokens can read too
+	Access string `schema:"access"`
+}
+
+// TokensData ...
+type TokensData struct {
+	Tokens []models.APIToken
+	// NewToken is only set right after a token is created, it's
+	// the one chance the user has to copy the raw token
+	NewToken *models.APIToken
+	Form     APITokenForm
+}
+
+// Index ...
+// GET /account/tokens
+func (t *APITokens) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	data, err := t.tokensData(r)
+	if err != nil {
+		log.Println("apiTokens.Index() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	vd.Yield = data
+
+	t.TokensView.Render(w, r, vd)
+}
+
+// Create ...
+// POST /account/tokens
+func (t *APITokens) Create(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form APITokenForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("apiTokens.Create() parseForm ERROR:", err)
+		vd.SetAlert(err)
+		t.TokensView.Render(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	token := models.APIToken{
+		UserID: user.ID,
+		Name:   form.Name,
+		Scopes: form.Access,
+	}
+	createErr := t.ts.Create(&token)
+
+	data, err := t.tokensData(r)
+	if err != nil {
+		log.Println("apiTokens.Create() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	vd.Yield = data
+
+	if createErr != nil {
+		data.Form = form
+		vd.SetAlert(createErr)
+		t.TokensView.Render(w, r, vd)
+		return
+	}
+
+	data.NewToken = &token
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Token Created. Copy It Now, You Won't Be Able To See It Again.",
+	}
+	t.TokensView.Render(w, r, vd)
+}
+
+// Revoke ...
+// POST /account/tokens/:id/revoke
+func (t *APITokens) Revoke(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid Token ID", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	tokens, err := t.ts.ByUserID(user.ID)
+	if err != nil {
+		log.Println("apiTokens.Revoke() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	found := false
+	for _, token := range tokens {
+		if token.ID == uint(id) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "Token Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err := t.ts.Revoke(uint(id)); err != nil {
+		log.Println("apiTokens.Revoke() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Token Revoked.",
+	}
+
+	views.RedirectAlert(w, r, "/account/tokens", http.StatusFound, alert)
+}
+
+func (t *APITokens) tokensData(r *http.Request) (*TokensData, error) {
+	user := context.User(r.Context())
+	tokens, err := t.ts.ByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokensData{
+		Tokens: tokens,
+		Form:   APITokenForm{Access: models.ScopeRead},
+	}, nil
+}
@@ -0,0 +1,235 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/dropbox"
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/views"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+// NewDropbox ...
+func NewDropbox(gs models.GalleryService, is models.ImageService, oas models.OAuthService,
+	config *oauth2.Config, cfgs ...dropbox.ClientConfig) *Dropbox {
+	return &Dropbox{
+		PickerView: views.NewView("bootstrap", "galleries/dropbox"),
+		gs:         gs,
+		is:         is,
+		oas:        oas,
+		config:     config,
+		cfgs:       cfgs,
+	}
+}
+
+// Dropbox imports images from a user's Dropbox into their
+// galleries
+type Dropbox struct {
+	PickerView *views.View
+	gs         models.GalleryService
+	is         models.ImageService
+	oas        models.OAuthService
+	config     *oauth2.Config
+	cfgs       []dropbox.ClientConfig
+}
+
+// DropboxPickerData ...
+type DropboxPickerData struct {
+	Gallery *models.Gallery
+	Path    string
+	// Parent is the folder above Path, empty at the root
+	Parent  string
+	Entries []dropbox.Entry
+}
+
+// DropboxImportForm ...
+type DropboxImportForm struct {
+	Files []string `schema:"files"`
+}
+
+// Picker lists a folder in the user's Dropbox so they can
+// choose images to import
+// GET /galleries/:id/images/dropbox
+func (d *Dropbox) Picker(w http.ResponseWriter, r *http.Request) {
+	gallery, err := d.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	client, err := d.client(w, r)
+	if err != nil {
+		return
+	}
+
+	folder := path.Clean("/" + r.URL.Query().Get("path"))
+	if folder == "/" {
+		folder = ""
+	}
+	entries, err := client.List(folder)
+	if err != nil {
+		log.Println("dropbox.Picker() ERROR:", err)
+		alert := views.Alert{
+			Level:   views.AlertLvlError,
+			Message: "We Couldn't Open That Dropbox Folder.",
+		}
+		views.RedirectAlert(w, r, fmt.Sprintf("/galleries/%d/edit", gallery.ID), http.StatusFound, alert)
+		return
+	}
+
+	data := DropboxPickerData{
+		Gallery: gallery,
+		Path:    folder,
+		Entries: entries,
+	}
+	if folder != "" {
+		data.Parent = path.Dir(folder)
+		if data.Parent == "/" {
+			data.Parent = ""
+		}
+	}
+
+	var vd views.Data
+	vd.Yield = data
+	d.PickerView.Render(w, r, vd)
+}
+
+// Import downloads the chosen files and adds them to the
+// gallery exactly as if they had been uploaded
+// POST /galleries/:id/images/dropbox
+func (d *Dropbox) Import(w http.ResponseWriter, r *http.Request) {
+	gallery, err := d.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	var form DropboxImportForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("dropbox.Import() parseForm ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusBadRequest)
+		return
+	}
+
+	editURL := fmt.Sprintf("/galleries/%d/edit", gallery.ID)
+	if len(form.Files) == 0 {
+		alert := views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: "No Images Were Selected.",
+		}
+		views.RedirectAlert(w, r, editURL, http.StatusFound, alert)
+		return
+	}
+	if len(form.Files) > maxUploadFiles {
+		alert := views.Alert{
+			Level:   views.AlertLvlError,
+			Message: fmt.Sprintf("Imports Are Limited To %d Images At A Time", maxUploadFiles),
+		}
+		views.RedirectAlert(w, r, editURL, http.StatusFound, alert)
+		return
+	}
+
+	client, err := d.client(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	is := d.is.As(auditActor(r))
+	imported := 0
+	var failed error
+	for _, file := range form.Files {
+		rc, err := client.Download(file)
+		if err != nil {
+			log.Printf("dropbox.Import() could not download %s: %v", file, err)
+			failed = err
+			continue
+		}
+
+		image := models.Image{
+			GalleryID:    gallery.ID,
+			UserID:       user.ID,
+			OriginalName: path.Base(file),
+		}
+		if err := is.Create(&image, rc); err != nil {
+			log.Printf("dropbox.Import() could not import %s: %v", file, err)
+			failed = err
+			continue
+		}
+		imported++
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: fmt.Sprintf("Imported %d Image(s) From Dropbox.", imported),
+	}
+	if failed != nil {
+		alert.Level = views.AlertLvlWarning
+		alert.Message = fmt.Sprintf("Imported %d Of %d Image(s) From Dropbox.", imported, len(form.Files))
+		if pErr, ok := failed.(views.PublicError); ok {
+			alert.Message += " " + pErr.Public()
+		}
+	}
+
+	views.RedirectAlert(w, r, editURL, http.StatusFound, alert)
+}
+
+// client returns a Dropbox client for the current user, sending
+// them off to connect their account if they haven't yet
+func (d *Dropbox) client(w http.ResponseWriter, r *http.Request) (*dropbox.Client, error) {
+	if d.config == nil {
+		http.Error(w, "Dropbox Import Is Not Available", http.StatusNotFound)
+		return nil, models.ErrNotFound
+	}
+
+	user := context.User(r.Context())
+	httpClient, err := d.oas.Client(r.Context(), d.config, user.ID, models.OAuthDropbox)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			alert := views.Alert{
+				Level:   views.AlertLvlInfo,
+				Message: "Connect Your Dropbox Account To Import Images From It.",
+			}
+			views.RedirectAlert(w, r, "/oauth/dropbox/connect", http.StatusFound, alert)
+		default:
+			log.Println("dropbox.client() ERROR:", err)
+			http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	return dropbox.NewClient(httpClient, d.cfgs...), nil
+}
+
+// galleryByID only finds galleries the current user owns
+func (d *Dropbox) galleryByID(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid Gallery ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	gallery, err := d.gs.ByID(uint(id))
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		default:
+			http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	user := context.User(r.Context())
+	if !gallery.IsOwnedBy(user) {
+		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		return nil, models.ErrNotFound
+	}
+
+	return gallery, nil
+}
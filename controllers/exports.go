@@ -0,0 +1,122 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/email"
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/views"
+)
+
+// NewExports ...
+func NewExports(es models.ExportService, emailer *email.Client) *Exports {
+	return &Exports{
+		ExportView: views.NewView("bootstrap", "account/export"),
+		es:         es,
+		emailer:    emailer,
+	}
+}
+
+// Exports lets users download a copy of everything we hold
+// about them
+type Exports struct {
+	ExportView *views.View
+	es         models.ExportService
+	emailer    *email.Client
+}
+
+// Index shows the state of the user's latest export
+// GET /account/export
+func (e *Exports) Index(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	exports, err := e.es.ByUserID(user.ID)
+	if err != nil {
+		log.Println("exports.Index() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(exports) > 0 {
+		vd.Yield = &exports[0]
+	}
+
+	e.ExportView.Render(w, r, vd)
+}
+
+// Create starts building an export in the background, the user
+// is emailed a link once it's ready
+// POST /account/export
+func (e *Exports) Create(w http.ResponseWriter, r *http.Request) {
+	user := *context.User(r.Context())
+	export, err := e.es.Start(&user)
+	if err != nil {
+		log.Println("exports.Create() ERROR:", err)
+		alert := views.Alert{
+			Level:   views.AlertLvlError,
+			Message: views.AlertMsgGeneric,
+		}
+		if pErr, ok := err.(views.PublicError); ok {
+			alert.Message = pErr.Public()
+		}
+		views.RedirectAlert(w, r, "/account/export", http.StatusFound, alert)
+		return
+	}
+
+	go e.build(&user, export)
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "We're Preparing Your Export And Will Email You A Link When It's Ready.",
+	}
+	views.RedirectAlert(w, r, "/account/export", http.StatusFound, alert)
+}
+
+func (e *Exports) build(user *models.User, export *models.Export) {
+	if err := e.es.Build(export); err != nil {
+		log.Println("exports.build() ERROR:", err)
+		return
+	}
+
+	e.emailer.ExportReady(user.Name, user.EmailAddress, export.Token, *export.ExpiresAt)
+}
+
+// Download sends the archive the emailed link is for. The user
+// has to be signed in as the owner as well as have the link.
+// GET /account/export/download?token=
+func (e *Exports) Download(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	export, err := e.es.ByToken(r.FormValue("token"))
+	if err != nil || export.UserID != user.ID {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	rc, err := e.es.Open(export)
+	switch err {
+	case nil:
+	case models.ErrExportExpired:
+		alert := views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: models.ErrExportExpired.Public(),
+		}
+		views.RedirectAlert(w, r, "/account/export", http.StatusFound, alert)
+		return
+	default:
+		log.Println("exports.Download() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Length", fmt.Sprint(export.Size))
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", "lenslocked-export-"+export.CreatedAt.Format("2006-01-02")+".zip"))
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Println("exports.Download() ERROR:", err)
+	}
+}
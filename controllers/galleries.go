@@ -1,10 +1,15 @@
 package controllers
 
 import (
+	"archive/zip"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"path"
 	"strconv"
+	"strings"
+	"unicode"
 
 	"github.com/arnoldokoth/lenslocked.com/context"
 	"github.com/arnoldokoth/lenslocked.com/models"
@@ -16,35 +21,42 @@ const (
 	showGallery     = "show_gallery"
 	editGallery     = "edit_gallery"
 	maxMultipartMem = 1 << 20
+	// maxUploadFiles is how many images can be sent at once
+	maxUploadFiles = 20
 )
 
 // NewGalleries ...
-func NewGalleries(gs models.GalleryService, is models.ImageService, router *mux.Router) *Galleries {
+func NewGalleries(gs models.GalleryService, is models.ImageService, sls models.ShareLinkService, router *mux.Router) *Galleries {
 	return &Galleries{
-		IndexView:  views.NewView("bootstrap", "galleries/index"),
-		CreateView: views.NewView("bootstrap", "galleries/new"),
-		ShowView:   views.NewView("bootstrap", "galleries/show"),
-		EditView:   views.NewView("bootstrap", "galleries/edit"),
-		gs:         gs,
-		is:         is,
-		router:     router,
+		IndexView:   views.NewView("bootstrap", "galleries/index"),
+		CreateView:  views.NewView("bootstrap", "galleries/new"),
+		ShowView:    views.NewView("bootstrap", "galleries/show"),
+		EditView:    views.NewView("bootstrap", "galleries/edit"),
+		SharePwView: views.NewView("bootstrap", "galleries/share_password"),
+		gs:          gs,
+		is:          is,
+		sls:         sls,
+		router:      router,
 	}
 }
 
 // Galleries ...
 type Galleries struct {
-	IndexView  *views.View
-	CreateView *views.View
-	ShowView   *views.View
-	EditView   *views.View
-	gs         models.GalleryService
-	is         models.ImageService
-	router     *mux.Router
+	IndexView   *views.View
+	CreateView  *views.View
+	ShowView    *views.View
+	EditView    *views.View
+	SharePwView *views.View
+	gs          models.GalleryService
+	is          models.ImageService
+	sls         models.ShareLinkService
+	router      *mux.Router
 }
 
 // GalleryForm ...
 type GalleryForm struct {
-	Title string `schema:"title"`
+	Title      string `schema:"title"`
+	Visibility string `schema:"visibility"`
 }
 
 // New ...
@@ -82,11 +94,12 @@ func (g *Galleries) Create(w http.ResponseWriter, r *http.Request) {
 	user := context.User(r.Context())
 
 	gallery := models.Gallery{
-		Title:  galleryForm.Title,
-		UserID: user.ID,
+		Title:      galleryForm.Title,
+		Visibility: galleryForm.Visibility,
+		UserID:     user.ID,
 	}
 
-	if err := g.gs.Create(&gallery); err != nil {
+	if err := g.gs.As(auditActor(r)).Create(&gallery); err != nil {
 		vd.SetAlert(err)
 		g.CreateView.Render(w, r, vd)
 		return
@@ -120,12 +133,52 @@ func (g *Galleries) galleryByID(w http.ResponseWriter, r *http.Request) (*models
 		return nil, err
 	}
 
+	// galleries the user isn't allowed to see don't exist as
+	// far as they're concerned
+	user := context.User(r.Context())
+	if !gallery.CanView(user) {
+		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		return nil, models.ErrNotFound
+	}
+
 	images, _ := g.is.ByGalleryID(gallery.ID)
 	gallery.Images = images
 
 	return gallery, nil
 }
 
+func (g *Galleries) galleryBySlug(w http.ResponseWriter, r *http.Request) (*models.Gallery, error) {
+	slug := mux.Vars(r)["slug"]
+	gallery, err := g.gs.BySlug(slug)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		default:
+			http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	user := context.User(r.Context())
+	if !gallery.CanViewBySlug(user) {
+		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		return nil, models.ErrNotFound
+	}
+
+	images, _ := g.is.ByGalleryID(gallery.ID)
+	gallery.Images = images
+
+	return gallery, nil
+}
+
+// GalleryShowData is a gallery along with where it can be
+// downloaded from, which depends on how the viewer reached it
+type GalleryShowData struct {
+	*models.Gallery
+	DownloadURL string
+}
+
 // Show ,,,
 // GET /galleries/:id
 func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
@@ -135,11 +188,96 @@ func (g *Galleries) Show(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vd.Yield = gallery
+	vd.Yield = GalleryShowData{
+		Gallery:     gallery,
+		DownloadURL: fmt.Sprintf("/galleries/%d/download", gallery.ID),
+	}
 
 	g.ShowView.Render(w, r, vd)
 }
 
+// ShowBySlug ...
+// GET /g/:slug
+func (g *Galleries) ShowBySlug(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+
+	vd.Yield = GalleryShowData{
+		Gallery:     gallery,
+		DownloadURL: fmt.Sprintf("/g/%s/download", gallery.Slug),
+	}
+
+	g.ShowView.Render(w, r, vd)
+}
+
+// Download streams every image in the gallery as a ZIP archive
+// GET /galleries/:id/download
+func (g *Galleries) Download(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	g.download(w, gallery)
+}
+
+// DownloadBySlug is Download for viewers of an unlisted gallery
+// GET /g/:slug/download
+func (g *Galleries) DownloadBySlug(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryBySlug(w, r)
+	if err != nil {
+		return
+	}
+
+	g.download(w, gallery)
+}
+
+// download writes the gallery's images to w as a ZIP archive.
+// Files are copied straight from storage into the response so
+// the archive is never held in memory.
+func (g *Galleries) download(w http.ResponseWriter, gallery *models.Gallery) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", archiveName(gallery.Title)+".zip"))
+
+	zw := zip.NewWriter(w)
+	names := make(map[string]int)
+	for i := range gallery.Images {
+		image := &gallery.Images[i]
+		rc, err := g.is.Open(image)
+		if err != nil {
+			log.Printf("galleries.Download() skipping %s: %v", image.Key(), err)
+			continue
+		}
+
+		// photos are already compressed so storing them as is
+		// saves CPU without making the archive much bigger
+		header := &zip.FileHeader{
+			Name:     uniqueName(names, image.Name()),
+			Method:   zip.Store,
+			Modified: image.CreatedAt,
+		}
+		fw, err := zw.CreateHeader(header)
+		if err == nil {
+			_, err = io.Copy(fw, rc)
+		}
+		rc.Close()
+		if err != nil {
+			// the response has already started so all that can
+			// be done is stop and leave the archive truncated
+			log.Println("galleries.Download() ERROR:", err)
+			return
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		log.Println("galleries.Download() ERROR:", err)
+	}
+}
+
 // Edit ,,,
 // GET /galleries/:id/edit
 func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
@@ -154,6 +292,7 @@ func (g *Galleries) Edit(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Gallery Not Found", http.StatusNotFound)
 		return
 	}
+	g.fillShareLinks(gallery)
 
 	vd.Yield = gallery
 	g.EditView.Render(w, r, vd)
@@ -184,7 +323,8 @@ func (g *Galleries) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	gallery.Title = galleryForm.Title
-	if err := g.gs.Update(gallery); err != nil {
+	gallery.Visibility = galleryForm.Visibility
+	if err := g.gs.As(auditActor(r)).Update(gallery); err != nil {
 		log.Println("g.gs.Update() ERROR:", err)
 		vd.SetAlert(err)
 		g.EditView.Render(w, r, vd)
@@ -216,13 +356,26 @@ func (g *Galleries) Upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// stop reading as soon as the request can't possibly be
+	// a batch of valid images
+	maxBody := g.is.Limits().MaxFileSize*maxUploadFiles + maxMultipartMem
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
 	err = r.ParseMultipartForm(maxMultipartMem)
 	if err != nil {
-		vd.SetAlert(err)
+		log.Println("galleries.Upload() ParseMultipartForm ERROR:", err)
+		vd.AlertError("That Upload Was Too Large Or Could Not Be Read")
 		g.EditView.Render(w, r, vd)
+		return
 	}
 
 	files := r.MultipartForm.File["images"]
+	if len(files) > maxUploadFiles {
+		vd.AlertError(fmt.Sprintf("Uploads Are Limited To %d Images At A Time", maxUploadFiles))
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	is := g.is.As(auditActor(r))
 	for _, f := range files {
 		// open uploaded files
 		file, err := f.Open()
@@ -234,7 +387,12 @@ func (g *Galleries) Upload(w http.ResponseWriter, r *http.Request) {
 
 		defer file.Close()
 
-		err = g.is.Create(gallery.ID, file, f.Filename)
+		image := models.Image{
+			GalleryID:    gallery.ID,
+			UserID:       user.ID,
+			OriginalName: f.Filename,
+		}
+		err = is.Create(&image, file)
 		if err != nil {
 			vd.SetAlert(err)
 			g.EditView.Render(w, r, vd)
@@ -250,8 +408,85 @@ func (g *Galleries) Upload(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, url.Path, http.StatusFound)
 }
 
+func (g *Galleries) imageByID(w http.ResponseWriter, r *http.Request, gallery *models.Gallery) (*models.Image, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["imageID"])
+	if err != nil {
+		http.Error(w, "Invalid Image ID", http.StatusNotFound)
+		return nil, err
+	}
+
+	image, err := g.is.ByID(uint(id))
+	if err == nil && image.GalleryID != gallery.ID {
+		err = models.ErrNotFound
+	}
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Image Not Found", http.StatusNotFound)
+		default:
+			http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	return image, nil
+}
+
+// ImageForm ...
+type ImageForm struct {
+	Caption  string `schema:"caption"`
+	Position int    `schema:"position"`
+}
+
+// ImageUpdate ...
+// POST /galleries/:id/images/:imageID/update
+func (g *Galleries) ImageUpdate(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	vd.Yield = gallery
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		return
+	}
+
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
+	}
+
+	var imageForm ImageForm
+	if err := parseForm(r, &imageForm); err != nil {
+		log.Println("galleries.ImageUpdate() parseForm ERROR:", err)
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	image.Caption = imageForm.Caption
+	image.Position = imageForm.Position
+	if err := g.is.As(auditActor(r)).Update(image); err != nil {
+		log.Println("g.is.Update() ERROR:", err)
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	url, err := g.router.Get(editGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
 // ImageDelete ...
-// POST /galleries/:id/images/:filename/delete
+// POST /galleries/:id/images/:imageID/delete
 func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 	gallery, err := g.galleryByID(w, r)
 	if err != nil {
@@ -264,13 +499,12 @@ func (g *Galleries) ImageDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	filename := mux.Vars(r)["filename"]
-	image := models.Image{
-		Filename:  filename,
-		GalleryID: gallery.ID,
+	image, err := g.imageByID(w, r, gallery)
+	if err != nil {
+		return
 	}
 
-	err = g.is.Delete(&image)
+	err = g.is.As(auditActor(r)).Delete(image)
 	if err != nil {
 		var vd views.Data
 		vd.SetAlert(err)
@@ -301,7 +535,7 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = g.gs.Delete(gallery.ID)
+	err = g.gs.As(auditActor(r)).Delete(gallery.ID)
 	if err != nil {
 		vd.SetAlert(err)
 		g.EditView.Render(w, r, vd)
@@ -311,3 +545,41 @@ func (g *Galleries) Delete(w http.ResponseWriter, r *http.Request) {
 	// TODO: Redirect To Galleries Index Page
 	http.Redirect(w, r, "/galleries", http.StatusFound)
 }
+
+// archiveName turns a gallery title into something safe to use
+// as the name of a downloaded file
+func archiveName(title string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_':
+			return r
+		case unicode.IsSpace(r):
+			return '-'
+		}
+		return -1
+	}, strings.TrimSpace(title))
+	if name == "" {
+		return "gallery"
+	}
+
+	return name
+}
+
+// uniqueName stops two images with the same name from
+// overwriting each other when the archive is extracted
+func uniqueName(seen map[string]int, name string) string {
+	seen[name]++
+	if seen[name] == 1 {
+		return name
+	}
+
+	ext := path.Ext(name)
+	for {
+		unique := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), seen[name], ext)
+		if seen[unique] == 0 {
+			seen[unique]++
+			return unique
+		}
+		seen[name]++
+	}
+}
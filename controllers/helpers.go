@@ -1,9 +1,13 @@
 package controllers
 
 import (
+	"net"
 	"net/http"
 	"net/url"
 
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/models"
+
 	schema "github.com/gorilla/Schema"
 )
 
@@ -33,3 +37,33 @@ func parseValues(values url.Values, dst interface{}) error {
 
 	return nil
 }
+
+// clientIP returns the address of the client that made the
+// request without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// auditActor returns who is making the request and from where,
+// for the services to record against what it changes. While an
+// admin is impersonating a user the admin is the actor.
+func auditActor(r *http.Request) models.Actor {
+	actor := models.Actor{
+		IPAddress: clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+	if user := context.User(r.Context()); user != nil {
+		actor.UserID = user.ID
+	}
+	if session := context.Session(r.Context()); session != nil && session.IsImpersonation() {
+		actor.UserID = session.ImpersonatorID
+		actor.OnBehalfOfID = session.UserID
+	}
+
+	return actor
+}
@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/models"
+)
+
+func TestAuditActor(t *testing.T) {
+	user := &models.User{}
+	user.ID = 1
+
+	r := httptest.NewRequest(http.MethodPost, "/galleries", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("User-Agent", "test")
+	ctx := context.WithUser(r.Context(), user)
+	ctx = context.WithSession(ctx, &models.Session{UserID: 1})
+
+	want := models.Actor{UserID: 1, IPAddress: "10.0.0.1", UserAgent: "test"}
+	if got := auditActor(r.WithContext(ctx)); got != want {
+		t.Errorf("auditActor() = %+v, want %+v", got, want)
+	}
+
+	ctx = context.WithSession(ctx, &models.Session{UserID: 1, ImpersonatorID: 9})
+	want = models.Actor{UserID: 9, OnBehalfOfID: 1, IPAddress: "10.0.0.1", UserAgent: "test"}
+	if got := auditActor(r.WithContext(ctx)); got != want {
+		t.Errorf("auditActor() while impersonating = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/rand"
+	"github.com/arnoldokoth/lenslocked.com/views"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oauthStateCookie    = "oauth_state"
+	oauthVerifierCookie = "oauth_verifier"
+	// oauthFlowTTL is how long a user has to finish connecting
+	// a provider before they have to start over
+	oauthFlowTTL = 10 * time.Minute
+)
+
+// NewOAuths ...
+func NewOAuths(oas models.OAuthService, configs map[string]*oauth2.Config) *OAuths {
+	return &OAuths{
+		oas:     oas,
+		configs: configs,
+	}
+}
+
+// OAuths connects users' accounts with any of the configured
+// OAuth providers, keyed by the name used in their URLs
+type OAuths struct {
+	oas     models.OAuthService
+	configs map[string]*oauth2.Config
+}
+
+// Connect sends the user off to the provider to grant us access
+// GET /oauth/:service/connect
+func (o *OAuths) Connect(w http.ResponseWriter, r *http.Request) {
+	service, config, ok := o.config(w, r)
+	if !ok {
+		return
+	}
+
+	state, err := rand.String(32)
+	if err != nil {
+		log.Println("oauths.Connect() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	verifier, err := pkceVerifier()
+	if err != nil {
+		log.Println("oauths.Connect() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cookiePath := "/oauth/" + service + "/"
+	setFlowCookie(w, cookiePath, oauthStateCookie, state, oauthFlowTTL)
+	setFlowCookie(w, cookiePath, oauthVerifierCookie, verifier, oauthFlowTTL)
+
+	url := config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// Callback is where the provider sends the user back to, it
+// swaps the code for a token and stores it for the user
+// GET /oauth/:service/callback
+func (o *OAuths) Callback(w http.ResponseWriter, r *http.Request) {
+	service, config, ok := o.config(w, r)
+	if !ok {
+		return
+	}
+
+	stateCookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		http.Error(w, "Invalid State Provided", http.StatusBadRequest)
+		return
+	}
+	verifierCookie, err := r.Cookie(oauthVerifierCookie)
+	if err != nil {
+		http.Error(w, "Invalid State Provided", http.StatusBadRequest)
+		return
+	}
+	// each flow can only be completed once
+	cookiePath := "/oauth/" + service + "/"
+	setFlowCookie(w, cookiePath, oauthStateCookie, "", -1)
+	setFlowCookie(w, cookiePath, oauthVerifierCookie, "", -1)
+
+	query := r.URL.Query()
+	state := query.Get("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(stateCookie.Value)) != 1 {
+		http.Error(w, "Invalid State Provided", http.StatusBadRequest)
+		return
+	}
+
+	if query.Get("error") != "" {
+		log.Printf("oauths.Callback() %s ERROR: %s %s", service, query.Get("error"), query.Get("error_description"))
+		alert := views.Alert{
+			Level:   views.AlertLvlWarning,
+			Message: fmt.Sprintf("%s Was Not Connected.", strings.Title(service)),
+		}
+		views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+		return
+	}
+
+	token, err := config.Exchange(r.Context(), query.Get("code"),
+		oauth2.SetAuthURLParam("code_verifier", verifierCookie.Value))
+	if err != nil {
+		log.Printf("oauths.Callback() %s Exchange ERROR: %v", service, err)
+		http.Error(w, "Could Not Connect To "+strings.Title(service), http.StatusBadRequest)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := o.save(user.ID, service, token); err != nil {
+		log.Println("oauths.Callback() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: fmt.Sprintf("%s Connected.", strings.Title(service)),
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// save stores token for the user, replacing whatever token we
+// had for the service before
+func (o *OAuths) save(userID uint, service string, token *oauth2.Token) error {
+	existing, err := o.oas.Find(userID, service)
+	switch err {
+	case nil:
+		if err := o.oas.Delete(existing.ID); err != nil {
+			return err
+		}
+	case models.ErrNotFound:
+	default:
+		return err
+	}
+
+	userOAuth := models.OAuth{
+		UserID:  userID,
+		Service: service,
+		Token:   *token,
+	}
+
+	return o.oas.Create(&userOAuth)
+}
+
+func (o *OAuths) config(w http.ResponseWriter, r *http.Request) (string, *oauth2.Config, bool) {
+	service := mux.Vars(r)["service"]
+	config, ok := o.configs[service]
+	if !ok {
+		http.Error(w, "Unknown OAuth Provider", http.StatusNotFound)
+		return "", nil, false
+	}
+
+	return service, config, true
+}
+
+// setFlowCookie stores part of an OAuth flow in a cookie scoped
+// to the provider's URLs so flows for different providers don't
+// interfere. A negative ttl deletes the cookie.
+func setFlowCookie(w http.ResponseWriter, path, name, value string, ttl time.Duration) {
+	cookie := http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if ttl < 0 {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Expires = time.Now().Add(ttl)
+	}
+
+	http.SetCookie(w, &cookie)
+}
+
+// pkceVerifier returns a new random PKCE code verifier
+func pkceVerifier() (string, error) {
+	b, err := rand.Bytes(32)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// pkceChallenge is the S256 code challenge for verifier, see
+// RFC 7636
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/oidc"
+	"github.com/arnoldokoth/lenslocked.com/rand"
+	"github.com/arnoldokoth/lenslocked.com/views"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+)
+
+const (
+	oidcStateCookie    = "oidc_state"
+	oidcNonceCookie    = "oidc_nonce"
+	oidcVerifierCookie = "oidc_verifier"
+)
+
+// OIDCProvider is an OpenID Connect identity provider users
+// can sign in with
+type OIDCProvider struct {
+	// DisplayName is shown on the login button
+	DisplayName string
+	Provider    *oidc.Provider
+	// Config is filled in with the provider's endpoints once
+	// they have been discovered
+	Config oauth2.Config
+	// AllowSignup creates accounts for people who sign in
+	// without already having one
+	AllowSignup bool
+}
+
+// LoginProvider is a provider shown on the login page
+type LoginProvider struct {
+	Name        string
+	DisplayName string
+}
+
+// NewOIDC ...
+func NewOIDC(users *Users, ids models.IdentityService, providers map[string]*OIDCProvider) *OIDC {
+	return &OIDC{
+		users:     users,
+		ids:       ids,
+		providers: providers,
+	}
+}
+
+// OIDC signs users in through external identity providers, the
+// sign in itself is the same as Users.Login
+type OIDC struct {
+	users     *Users
+	ids       models.IdentityService
+	providers map[string]*OIDCProvider
+}
+
+// LoginProviders lists the providers sorted by name
+func (o *OIDC) LoginProviders() []LoginProvider {
+	var ret []LoginProvider
+	for name, p := range o.providers {
+		ret = append(ret, LoginProvider{Name: name, DisplayName: p.DisplayName})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+
+	return ret
+}
+
+// Login sends the user to the provider to sign in
+// GET /login/:provider
+func (o *OIDC) Login(w http.ResponseWriter, r *http.Request) {
+	name, config, ok := o.config(w, r)
+	if !ok {
+		return
+	}
+
+	state, err := rand.String(32)
+	if err != nil {
+		log.Println("oidc.Login() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := rand.String(32)
+	if err != nil {
+		log.Println("oidc.Login() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+	verifier, err := pkceVerifier()
+	if err != nil {
+		log.Println("oidc.Login() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cookiePath := "/login/" + name + "/"
+	setFlowCookie(w, cookiePath, oidcStateCookie, state, oauthFlowTTL)
+	setFlowCookie(w, cookiePath, oidcNonceCookie, nonce, oauthFlowTTL)
+	setFlowCookie(w, cookiePath, oidcVerifierCookie, verifier, oauthFlowTTL)
+
+	url := config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("code_challenge", pkceChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// Callback verifies the ID token the provider issued and signs
+// in the user it belongs to
+// GET /login/:provider/callback
+func (o *OIDC) Callback(w http.ResponseWriter, r *http.Request) {
+	name, config, ok := o.config(w, r)
+	if !ok {
+		return
+	}
+	provider := o.providers[name]
+
+	var cookies [3]*http.Cookie
+	for i, cookieName := range []string{oidcStateCookie, oidcNonceCookie, oidcVerifierCookie} {
+		cookie, err := r.Cookie(cookieName)
+		if err != nil {
+			http.Error(w, "Invalid State Provided", http.StatusBadRequest)
+			return
+		}
+		cookies[i] = cookie
+		// each flow can only be completed once
+		setFlowCookie(w, "/login/"+name+"/", cookieName, "", -1)
+	}
+	stateCookie, nonceCookie, verifierCookie := cookies[0], cookies[1], cookies[2]
+
+	query := r.URL.Query()
+	state := query.Get("state")
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(stateCookie.Value)) != 1 {
+		http.Error(w, "Invalid State Provided", http.StatusBadRequest)
+		return
+	}
+
+	if query.Get("error") != "" {
+		log.Printf("oidc.Callback() %s ERROR: %s %s", name, query.Get("error"), query.Get("error_description"))
+		o.loginFailed(w, r, fmt.Sprintf("Signing In With %s Was Cancelled.", provider.DisplayName))
+		return
+	}
+
+	token, err := config.Exchange(r.Context(), query.Get("code"),
+		oauth2.SetAuthURLParam("code_verifier", verifierCookie.Value))
+	if err != nil {
+		log.Printf("oidc.Callback() %s Exchange ERROR: %v", name, err)
+		o.loginFailed(w, r, fmt.Sprintf("Could Not Sign In With %s.", provider.DisplayName))
+		return
+	}
+
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := provider.Provider.Verify(r.Context(), rawIDToken, config.ClientID, nonceCookie.Value)
+	if err != nil {
+		log.Printf("oidc.Callback() %s Verify ERROR: %v", name, err)
+		o.loginFailed(w, r, fmt.Sprintf("Could Not Sign In With %s.", provider.DisplayName))
+		return
+	}
+
+	ext := models.ExternalIdentity{
+		Provider:      name,
+		Subject:       idToken.Subject,
+		Email:         idToken.Email,
+		EmailVerified: idToken.EmailVerified,
+		Name:          idToken.Name,
+	}
+	user, err := o.ids.As(auditActor(r)).SignIn(ext, provider.AllowSignup)
+	if err != nil {
+		log.Printf("oidc.Callback() %s SignIn ERROR: %v", name, err)
+		if pErr, ok := err.(views.PublicError); ok {
+			o.loginFailed(w, r, pErr.Public())
+			return
+		}
+		o.loginFailed(w, r, views.AlertMsgGeneric)
+		return
+	}
+
+	if user.HasTwoFactor() {
+		alert := views.Alert{
+			Level:   views.AlertLvlInfo,
+			Message: "Enter The Code From Your Authenticator App To Finish Logging In.",
+		}
+		o.users.challenge(w, r, user, alert)
+		return
+	}
+
+	if err := o.users.signIn(w, r, user); err != nil {
+		log.Println("oidc.Callback() signIn ERROR:", err)
+		o.loginFailed(w, r, views.AlertMsgGeneric)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: fmt.Sprintf("Welcome Back %v!", user.Name),
+	}
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+func (o *OIDC) loginFailed(w http.ResponseWriter, r *http.Request, message string) {
+	alert := views.Alert{
+		Level:   views.AlertLvlError,
+		Message: message,
+	}
+	views.RedirectAlert(w, r, "/login", http.StatusFound, alert)
+}
+
+// config returns the provider's OAuth config, discovering its
+// endpoints the first time it is used
+func (o *OIDC) config(w http.ResponseWriter, r *http.Request) (string, *oauth2.Config, bool) {
+	name := mux.Vars(r)["provider"]
+	provider, ok := o.providers[name]
+	if !ok {
+		http.Error(w, "Unknown Identity Provider", http.StatusNotFound)
+		return "", nil, false
+	}
+
+	endpoint, err := provider.Provider.Endpoint(r.Context())
+	if err != nil {
+		log.Printf("oidc.config() %s ERROR: %v", name, err)
+		o.loginFailed(w, r, fmt.Sprintf("%s Is Not Available Right Now.", provider.DisplayName))
+		return "", nil, false
+	}
+
+	config := provider.Config
+	config.Endpoint = endpoint
+	return name, &config, true
+}
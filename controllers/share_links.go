@@ -0,0 +1,286 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/views"
+	"github.com/gorilla/mux"
+)
+
+// ShareLinkForm ...
+type ShareLinkForm struct {
+	Password      string `schema:"password"`
+	ExpiresInDays int    `schema:"expires_in_days"`
+}
+
+// fillShareLinks loads the gallery's share links so the owner
+// can manage them from the edit page
+func (g *Galleries) fillShareLinks(gallery *models.Gallery) {
+	links, err := g.sls.ByGalleryID(gallery.ID)
+	if err != nil {
+		log.Println("galleries.fillShareLinks() ERROR:", err)
+		return
+	}
+	gallery.ShareLinks = links
+}
+
+// ShareCreate ...
+// POST /galleries/:id/share
+func (g *Galleries) ShareCreate(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+	vd.Yield = gallery
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		return
+	}
+
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("galleries.ShareCreate() parseForm ERROR:", err)
+		g.fillShareLinks(gallery)
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	link := models.ShareLink{
+		GalleryID: gallery.ID,
+		Password:  form.Password,
+	}
+	if form.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, form.ExpiresInDays)
+		link.ExpiresAt = &expiresAt
+	}
+
+	if err := g.sls.Create(&link); err != nil {
+		log.Println("g.sls.Create() ERROR:", err)
+		g.fillShareLinks(gallery)
+		vd.SetAlert(err)
+		g.EditView.Render(w, r, vd)
+		return
+	}
+
+	url, err := g.router.Get(editGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+// ShareDelete ...
+// POST /galleries/:id/share/:linkID/delete
+func (g *Galleries) ShareDelete(w http.ResponseWriter, r *http.Request) {
+	gallery, err := g.galleryByID(w, r)
+	if err != nil {
+		return
+	}
+
+	user := context.User(r.Context())
+	if gallery.UserID != user.ID {
+		http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		return
+	}
+
+	linkID, err := strconv.Atoi(mux.Vars(r)["linkID"])
+	if err != nil {
+		http.Error(w, "Invalid Share Link ID", http.StatusNotFound)
+		return
+	}
+
+	// only links belonging to this gallery can be deleted
+	g.fillShareLinks(gallery)
+	found := false
+	for _, link := range gallery.ShareLinks {
+		if link.ID == uint(linkID) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "Share Link Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err := g.sls.Delete(uint(linkID)); err != nil {
+		log.Println("g.sls.Delete() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	url, err := g.router.Get(editGallery).URL("id", fmt.Sprintf("%v", gallery.ID))
+	if err != nil {
+		http.Redirect(w, r, "/galleries", http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, url.Path, http.StatusFound)
+}
+
+func (g *Galleries) shareLinkByToken(w http.ResponseWriter, r *http.Request) (*models.ShareLink, error) {
+	link, err := g.sls.ByToken(mux.Vars(r)["token"])
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		default:
+			log.Println("g.sls.ByToken() ERROR:", err)
+			http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	if link.IsExpired() {
+		http.Error(w, "This Share Link Has Expired", http.StatusGone)
+		return nil, models.ErrNotFound
+	}
+
+	return link, nil
+}
+
+// shareCookieName is unique per link so unlocking one gallery
+// doesn't unlock any others
+func shareCookieName(link *models.ShareLink) string {
+	return fmt.Sprintf("share_%d", link.ID)
+}
+
+// Shared renders the gallery behind a share link, asking for
+// the link's password first if it has one
+// GET /s/:token
+func (g *Galleries) Shared(w http.ResponseWriter, r *http.Request) {
+	link, err := g.shareLinkByToken(w, r)
+	if err != nil {
+		return
+	}
+
+	if !g.shareUnlocked(r, link) {
+		var vd views.Data
+		vd.Yield = link.Token
+		g.SharePwView.Render(w, r, vd)
+		return
+	}
+
+	g.renderShared(w, r, link)
+}
+
+// SharedDownload is Download for viewers of a share link, who
+// have to have unlocked it first if it has a password
+// GET /s/:token/download
+func (g *Galleries) SharedDownload(w http.ResponseWriter, r *http.Request) {
+	link, err := g.shareLinkByToken(w, r)
+	if err != nil {
+		return
+	}
+	if !g.shareUnlocked(r, link) {
+		http.Redirect(w, r, "/s/"+link.Token, http.StatusFound)
+		return
+	}
+
+	gallery, err := g.sharedGallery(w, link)
+	if err != nil {
+		return
+	}
+
+	g.download(w, gallery)
+}
+
+// shareUnlocked reports whether the request carries the cookie
+// set when the link's password was entered
+func (g *Galleries) shareUnlocked(r *http.Request, link *models.ShareLink) bool {
+	var key string
+	if cookie, err := r.Cookie(shareCookieName(link)); err == nil {
+		key = cookie.Value
+	}
+
+	return g.sls.IsUnlocked(link, key)
+}
+
+// SharedUnlock ...
+// POST /s/:token
+func (g *Galleries) SharedUnlock(w http.ResponseWriter, r *http.Request) {
+	link, err := g.shareLinkByToken(w, r)
+	if err != nil {
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = link.Token
+
+	var form ShareLinkForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("galleries.SharedUnlock() parseForm ERROR:", err)
+		vd.SetAlert(err)
+		g.SharePwView.Render(w, r, vd)
+		return
+	}
+
+	if err := g.sls.CheckPassword(link, form.Password, clientIP(r)); err != nil {
+		vd.SetAlert(err)
+		g.SharePwView.Render(w, r, vd)
+		return
+	}
+
+	cookie := http.Cookie{
+		Name:     shareCookieName(link),
+		Value:    g.sls.UnlockKey(link),
+		Path:     "/s/" + link.Token,
+		HttpOnly: true,
+	}
+	if link.ExpiresAt != nil {
+		cookie.Expires = *link.ExpiresAt
+	}
+	http.SetCookie(w, &cookie)
+
+	http.Redirect(w, r, cookie.Path, http.StatusFound)
+}
+
+func (g *Galleries) renderShared(w http.ResponseWriter, r *http.Request, link *models.ShareLink) {
+	gallery, err := g.sharedGallery(w, link)
+	if err != nil {
+		return
+	}
+
+	if err := g.sls.IncrementViews(link.ID); err != nil {
+		log.Println("g.sls.IncrementViews() ERROR:", err)
+	}
+
+	var vd views.Data
+	vd.Yield = GalleryShowData{
+		Gallery:     gallery,
+		DownloadURL: fmt.Sprintf("/s/%s/download", link.Token),
+	}
+	g.ShowView.Render(w, r, vd)
+}
+
+// sharedGallery looks up the gallery behind link along with its
+// images, writing an error response if it can't
+func (g *Galleries) sharedGallery(w http.ResponseWriter, link *models.ShareLink) (*models.Gallery, error) {
+	gallery, err := g.gs.ByID(link.GalleryID)
+	if err != nil {
+		switch err {
+		case models.ErrNotFound:
+			http.Error(w, "Gallery Not Found", http.StatusNotFound)
+		default:
+			http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		}
+		return nil, err
+	}
+
+	images, _ := g.is.ByGalleryID(gallery.ID)
+	gallery.Images = images
+
+	return gallery, nil
+}
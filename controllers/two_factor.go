@@ -0,0 +1,314 @@
+package controllers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/views"
+)
+
+const (
+	twoFactorCookie = "two_factor"
+	// twoFactorCookieTTL matches how long the challenge whose
+	// token is in the cookie stays valid
+	twoFactorCookieTTL = 5 * time.Minute
+)
+
+// TwoFactorForm ...
+type TwoFactorForm struct {
+	Code     string `schema:"code"`
+	Password string `schema:"password"`
+}
+
+// TwoFactorData ...
+type TwoFactorData struct {
+	Enabled   bool
+	CodesLeft int
+	// Secret and URI are only set while the user is setting up
+	// their authenticator app
+	Secret string
+	URI    string
+}
+
+// challenge asks a user whose password checked out for their
+// code before signing them in
+func (u *Users) challenge(w http.ResponseWriter, r *http.Request, user *models.User, alert views.Alert) {
+	token, err := u.tfs.ChallengeToken(user)
+	if err != nil {
+		log.Println("users.challenge() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	cookie := http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    token,
+		Expires:  time.Now().Add(twoFactorCookieTTL),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &cookie)
+
+	views.RedirectAlert(w, r, "/2fa", http.StatusFound, alert)
+}
+
+// challengedUser returns the user the two factor cookie was
+// issued to, sending them back to log in if it's missing or
+// has expired
+func (u *Users) challengedUser(w http.ResponseWriter, r *http.Request) (*models.User, error) {
+	cookie, err := r.Cookie(twoFactorCookie)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil, err
+	}
+
+	user, err := u.tfs.ChallengeUser(cookie.Value)
+	if err != nil {
+		u.challengeFailed(w, r, "You Took Too Long To Enter Your Code, Please Log In Again.")
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// challengeFailed clears the two factor cookie and sends the
+// user back to log in with message
+func (u *Users) challengeFailed(w http.ResponseWriter, r *http.Request, message string) {
+	clearTwoFactorCookie(w)
+
+	alert := views.Alert{
+		Level:   views.AlertLvlWarning,
+		Message: message,
+	}
+	views.RedirectAlert(w, r, "/login", http.StatusFound, alert)
+}
+
+func clearTwoFactorCookie(w http.ResponseWriter) {
+	cookie := http.Cookie{
+		Name:     twoFactorCookie,
+		Value:    "",
+		Expires:  time.Now(),
+		HttpOnly: true,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// TwoFactorLogin asks for the code from the user's
+// authenticator app or one of their recovery codes
+// GET /2fa
+func (u *Users) TwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	if _, err := u.challengedUser(w, r); err != nil {
+		return
+	}
+
+	u.TwoFactorLoginView.Render(w, r, nil)
+}
+
+// CompleteTwoFactorLogin ...
+// POST /2fa
+func (u *Users) CompleteTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("users.CompleteTwoFactorLogin() ERROR:", err)
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+
+	cookie, err := r.Cookie(twoFactorCookie)
+	if err != nil {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	user, err := u.tfs.As(auditActor(r)).CompleteChallenge(cookie.Value, form.Code, clientIP(r))
+	switch err {
+	case nil:
+	case models.ErrTokenInvalid:
+		u.challengeFailed(w, r, "You Took Too Long To Enter Your Code, Please Log In Again.")
+		return
+	case models.ErrTwoFactorTooManyCodes:
+		u.challengeFailed(w, r, models.ErrTwoFactorTooManyCodes.Public())
+		return
+	default:
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+	clearTwoFactorCookie(w)
+
+	if err := u.signIn(w, r, user); err != nil {
+		vd.SetAlert(err)
+		u.TwoFactorLoginView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: fmt.Sprintf("Welcome Back %v!", user.Name),
+	}
+	left, err := u.tfs.RecoveryCodesLeft(user.ID)
+	if err == nil && left < 3 {
+		alert.Level = views.AlertLvlWarning
+		alert.Message = fmt.Sprintf("You Only Have %d Recovery Code(s) Left, Please Generate New Ones.", left)
+	}
+
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// TwoFactor shows whether two factor authentication is on and
+// walks the user through setting it up
+// GET /account/2fa
+func (u *Users) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	data := TwoFactorData{Enabled: user.HasTwoFactor()}
+
+	switch {
+	case user.HasTwoFactor():
+		left, err := u.tfs.RecoveryCodesLeft(user.ID)
+		if err != nil {
+			log.Println("users.TwoFactor() ERROR:", err)
+			http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.CodesLeft = left
+	case user.TOTPSecret != "":
+		secret, err := u.tfs.Secret(user)
+		if err != nil {
+			log.Println("users.TwoFactor() ERROR:", err)
+			http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+			return
+		}
+		data.Secret = secret
+		data.URI = u.tfs.ProvisioningURI(user, secret)
+	}
+
+	vd.Yield = data
+	u.TwoFactorView.Render(w, r, vd)
+}
+
+// EnrollTwoFactor generates a new secret for the user to add
+// to their authenticator app
+// POST /account/2fa/setup
+func (u *Users) EnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if _, err := u.tfs.Enroll(user); err != nil {
+		log.Println("users.EnrollTwoFactor() ERROR:", err)
+		u.twoFactorError(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/account/2fa", http.StatusFound)
+}
+
+// EnableTwoFactor turns two factor authentication on once the
+// user has entered a code from their app, the recovery codes
+// are only ever shown on the page it renders
+// POST /account/2fa/enable
+func (u *Users) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("users.EnableTwoFactor() ERROR:", err)
+		u.twoFactorError(w, r, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	codes, err := u.tfs.Enable(user, form.Code)
+	if err != nil {
+		u.twoFactorError(w, r, err)
+		return
+	}
+
+	var vd views.Data
+	vd.Alert = &views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Two-Factor Authentication Is On.",
+	}
+	vd.Yield = codes
+	u.RecoveryCodesView.Render(w, r, vd)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes
+// after checking their password
+// POST /account/2fa/recovery
+func (u *Users) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("users.RegenerateRecoveryCodes() ERROR:", err)
+		u.twoFactorError(w, r, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := u.us.CheckPassword(user, form.Password, clientIP(r)); err != nil {
+		u.twoFactorError(w, r, err)
+		return
+	}
+
+	codes, err := u.tfs.RegenerateRecoveryCodes(user)
+	if err != nil {
+		log.Println("users.RegenerateRecoveryCodes() ERROR:", err)
+		u.twoFactorError(w, r, err)
+		return
+	}
+
+	var vd views.Data
+	vd.Yield = codes
+	u.RecoveryCodesView.Render(w, r, vd)
+}
+
+// DisableTwoFactor turns two factor authentication off. The
+// user has to prove it's them again with both their password
+// and a code so a session left signed in isn't enough.
+// POST /account/2fa/disable
+func (u *Users) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var form TwoFactorForm
+	if err := parseForm(r, &form); err != nil {
+		log.Println("users.DisableTwoFactor() ERROR:", err)
+		u.twoFactorError(w, r, err)
+		return
+	}
+
+	user := context.User(r.Context())
+	if err := u.us.CheckPassword(user, form.Password, clientIP(r)); err != nil {
+		u.twoFactorError(w, r, err)
+		return
+	}
+	if err := u.tfs.Verify(user, form.Code); err != nil {
+		u.twoFactorError(w, r, err)
+		return
+	}
+
+	if err := u.tfs.Disable(user); err != nil {
+		log.Println("users.DisableTwoFactor() ERROR:", err)
+		u.twoFactorError(w, r, err)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlWarning,
+		Message: "Two-Factor Authentication Is Off.",
+	}
+	views.RedirectAlert(w, r, "/account/2fa", http.StatusFound, alert)
+}
+
+// twoFactorError sends the user back to the two factor page
+// with err as the alert
+func (u *Users) twoFactorError(w http.ResponseWriter, r *http.Request, err error) {
+	alert := views.Alert{
+		Level:   views.AlertLvlError,
+		Message: views.AlertMsgGeneric,
+	}
+	if pErr, ok := err.(views.PublicError); ok {
+		alert.Message = pErr.Public()
+	}
+
+	views.RedirectAlert(w, r, "/account/2fa", http.StatusFound, alert)
+}
@@ -5,13 +5,14 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/arnoldokoth/lenslocked.com/context"
 	"github.com/arnoldokoth/lenslocked.com/email"
 	"github.com/arnoldokoth/lenslocked.com/models"
-	"github.com/arnoldokoth/lenslocked.com/rand"
 	"github.com/arnoldokoth/lenslocked.com/views"
+	"github.com/gorilla/mux"
 )
 
 // ErrGeneric rendered when something goes wrong and we
@@ -19,21 +20,46 @@ import (
 var ErrGeneric = errors.New("Oops... Something Went Wrong")
 
 // NewUsers ...
-func NewUsers(us models.UserService, emailer *email.Client) *Users {
+func NewUsers(us models.UserService, ss models.SessionService, ts models.APITokenService,
+	tfs models.TwoFactorService, emailer *email.Client) *Users {
 	return &Users{
-		CreateView: views.NewView("bootstrap", "users/new"),
-		LoginView:  views.NewView("bootstrap", "users/login"),
-		us:         us,
-		emailer:    emailer,
+		CreateView:         views.NewView("bootstrap", "users/new"),
+		LoginView:          views.NewView("bootstrap", "users/login"),
+		TwoFactorLoginView: views.NewView("bootstrap", "users/two_factor_login"),
+		ForgotPwView:       views.NewView("bootstrap", "users/forgot_pw"),
+		ResetPwView:        views.NewView("bootstrap", "users/reset_pw"),
+		SessionsView:       views.NewView("bootstrap", "users/sessions"),
+		PrivacyView:        views.NewView("bootstrap", "users/privacy"),
+		TwoFactorView:      views.NewView("bootstrap", "users/two_factor"),
+		RecoveryCodesView:  views.NewView("bootstrap", "users/recovery_codes"),
+		us:                 us,
+		ss:                 ss,
+		ts:                 ts,
+		tfs:                tfs,
+		emailer:            emailer,
 	}
 }
 
 // Users ...
 type Users struct {
-	CreateView *views.View
-	LoginView  *views.View
-	us         models.UserService
-	emailer    *email.Client
+	CreateView         *views.View
+	LoginView          *views.View
+	TwoFactorLoginView *views.View
+	ForgotPwView       *views.View
+	ResetPwView        *views.View
+	SessionsView       *views.View
+	PrivacyView        *views.View
+	TwoFactorView      *views.View
+	RecoveryCodesView  *views.View
+	us                 models.UserService
+	ss                 models.SessionService
+	ts                 models.APITokenService
+	tfs                models.TwoFactorService
+	emailer            *email.Client
+
+	// LoginProviders are offered on the login page as another
+	// way to sign in
+	LoginProviders []LoginProvider
 }
 
 // SignupForm ...
@@ -75,17 +101,17 @@ func (u *Users) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := u.signIn(w, &user)
+	err := u.signIn(w, r, &user)
 	if err != nil {
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
-	go u.emailer.Welcome(user.Name, user.EmailAddress)
+	u.sendVerification(&user)
 
 	alert := views.Alert{
 		Level:   views.AlertLvlSuccess,
-		Message: "Welcome To LensLocked.com!",
+		Message: "Welcome To LensLocked.com! Please Check Your Inbox To Verify Your Email Address.",
 	}
 
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
@@ -97,11 +123,26 @@ type LoginForm struct {
 	Password     string `schema:"password"`
 }
 
+// LoginData ...
+type LoginData struct {
+	Form      LoginForm
+	Providers []LoginProvider
+}
+
+// LoginPage ...
+// GET /login
+func (u *Users) LoginPage(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	vd.Yield = LoginData{Providers: u.LoginProviders}
+	u.LoginView.Render(w, r, vd)
+}
+
 // Login ...
-// GET & POST /login
+// POST /login
 func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	var vd views.Data
 	var loginForm LoginForm
+	vd.Yield = LoginData{Providers: u.LoginProviders}
 	if err := parseForm(r, &loginForm); err != nil {
 		log.Println("u.Login() ERROR:", err)
 		vd.SetAlert(err)
@@ -109,7 +150,9 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := u.us.Authenticate(loginForm.EmailAddress, loginForm.Password)
+	vd.Yield = LoginData{Form: loginForm, Providers: u.LoginProviders}
+
+	user, err := u.us.As(auditActor(r)).Authenticate(loginForm.EmailAddress, loginForm.Password, clientIP(r))
 	if err != nil {
 		switch err {
 		case models.ErrNotFound:
@@ -121,7 +164,16 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = u.signIn(w, user)
+	if user.HasTwoFactor() {
+		alert := views.Alert{
+			Level:   views.AlertLvlInfo,
+			Message: "Enter The Code From Your Authenticator App To Finish Logging In.",
+		}
+		u.challenge(w, r, user, alert)
+		return
+	}
+
+	err = u.signIn(w, r, user)
 	if err != nil {
 		vd.SetAlert(err)
 		u.LoginView.Render(w, r, vd)
@@ -136,22 +188,42 @@ func (u *Users) Login(w http.ResponseWriter, r *http.Request) {
 	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
 }
 
-func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
-	if user.Remember == "" {
-		token, err := rand.RememberToken()
-		if err != nil {
-			return err
-		}
-		user.Remember = token
-		err = u.us.Update(user)
-		if err != nil {
-			return err
-		}
+// signIn starts a new session for the user on the device
+// making the request
+func (u *Users) signIn(w http.ResponseWriter, r *http.Request, user *models.User) error {
+	return startSession(w, r, u.ss, user)
+}
+
+// startSession is signIn for controllers that only have the
+// session service
+// signOutEverywhere revokes every session and API token the
+// user has, so whoever knew their old password loses access
+func signOutEverywhere(ss models.SessionService, ts models.APITokenService, userID uint) error {
+	if err := ss.DeleteByUserID(userID); err != nil {
+		return err
+	}
+
+	return ts.RevokeByUserID(userID)
+}
+
+func startSession(w http.ResponseWriter, r *http.Request, ss models.SessionService, user *models.User) error {
+	if user.IsDisabled() {
+		return models.ErrAccountDisabled
+	}
+
+	session := models.Session{
+		UserID:    user.ID,
+		UserAgent: r.UserAgent(),
+		IPAddress: clientIP(r),
+	}
+	if err := ss.Create(&session); err != nil {
+		return err
 	}
 
 	cookie := http.Cookie{
-		Name:     "remember_token",
-		Value:    user.Remember,
+		Name:     "session_token",
+		Value:    session.Token,
+		Expires:  session.ExpiresAt,
 		HttpOnly: true,
 	}
 
@@ -160,10 +232,10 @@ func (u *Users) signIn(w http.ResponseWriter, user *models.User) error {
 	return nil
 }
 
-// Logout ...
+// Logout only signs out the device making the request
 func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 	cookie := http.Cookie{
-		Name:     "remember_token",
+		Name:     "session_token",
 		Value:    "",
 		Expires:  time.Now(),
 		HttpOnly: true,
@@ -171,10 +243,292 @@ func (u *Users) Logout(w http.ResponseWriter, r *http.Request) {
 
 	http.SetCookie(w, &cookie)
 
-	user := context.User(r.Context())
-	token, _ := rand.RememberToken()
-	user.Remember = token
-	u.us.Update(user)
+	if session := context.Session(r.Context()); session != nil {
+		u.us.As(auditActor(r)).Logout(session)
+	}
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
+
+// SessionsData ...
+type SessionsData struct {
+	Sessions  []models.Session
+	CurrentID uint
+}
+
+// Sessions lists the devices the user is signed in on
+// GET /account/sessions
+func (u *Users) Sessions(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	user := context.User(r.Context())
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		log.Println("users.Sessions() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := SessionsData{Sessions: sessions}
+	if current := context.Session(r.Context()); current != nil {
+		data.CurrentID = current.ID
+	}
+	vd.Yield = data
+
+	u.SessionsView.Render(w, r, vd)
+}
+
+// RevokeSession signs out a single device
+// POST /account/sessions/:id/revoke
+func (u *Users) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid Session ID", http.StatusNotFound)
+		return
+	}
+
+	user := context.User(r.Context())
+	sessions, err := u.ss.ByUserID(user.ID)
+	if err != nil {
+		log.Println("users.RevokeSession() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	found := false
+	for _, session := range sessions {
+		if session.ID == uint(id) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		http.Error(w, "Session Not Found", http.StatusNotFound)
+		return
+	}
+
+	if err := u.ss.Delete(uint(id)); err != nil {
+		log.Println("users.RevokeSession() ERROR:", err)
+		http.Error(w, ErrGeneric.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Device Signed Out.",
+	}
+
+	views.RedirectAlert(w, r, "/account/sessions", http.StatusFound, alert)
+}
+
+// ResetPwForm is used both to request a password reset
+// and to complete one
+type ResetPwForm struct {
+	EmailAddress string `schema:"email"`
+	Token        string `schema:"token"`
+	Password     string `schema:"password"`
+}
+
+// InitiateReset ...
+// POST /forgot
+func (u *Users) InitiateReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		log.Println("users.InitiateReset() ERROR:", err)
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+
+	token, err := u.us.InitiateReset(form.EmailAddress)
+	if err != nil && err != models.ErrNotFound {
+		vd.SetAlert(err)
+		u.ForgotPwView.Render(w, r, vd)
+		return
+	}
+
+	// don't reveal whether an account exists for the email address
+	if err == nil {
+		if err := u.emailer.ResetPw(form.EmailAddress, token); err != nil {
+			vd.SetAlert(err)
+			u.ForgotPwView.Render(w, r, vd)
+			return
+		}
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "If An Account Exists For That Email Address, Instructions To Reset Your Password Have Been Sent.",
+	}
+
+	views.RedirectAlert(w, r, "/reset", http.StatusFound, alert)
+}
+
+// ResetPw ...
+// GET /reset
+func (u *Users) ResetPw(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseURLParams(r, &form); err != nil {
+		log.Println("users.ResetPw() ERROR:", err)
+		vd.SetAlert(err)
+	}
+
+	u.ResetPwView.Render(w, r, vd)
+}
+
+// CompleteReset ...
+// POST /reset
+func (u *Users) CompleteReset(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form ResetPwForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		log.Println("users.CompleteReset() ERROR:", err)
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	user, err := u.us.As(auditActor(r)).CompleteReset(form.Token, form.Password)
+	if err != nil {
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	// whoever knew the old password shouldn't stay signed in,
+	// so the reset isn't done until they've been signed out
+	if err := signOutEverywhere(u.ss, u.ts, user.ID); err != nil {
+		log.Println("users.CompleteReset() ERROR:", err)
+		vd.SetAlert(err)
+		u.ResetPwView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Your Password Has Been Reset!",
+	}
+	// the reset link only proves access to the user's email,
+	// it's not a way around their second factor
+	if user.HasTwoFactor() {
+		alert.Message += " Enter The Code From Your Authenticator App To Log In."
+		u.challenge(w, r, user, alert)
+		return
+	}
+	if err := u.signIn(w, r, user); err != nil {
+		log.Println("users.CompleteReset() ERROR:", err)
+		alert.Message += " Please Log In With Your New Password."
+		views.RedirectAlert(w, r, "/login", http.StatusFound, alert)
+		return
+	}
+
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+func (u *Users) sendVerification(user *models.User) {
+	token, err := u.us.VerificationToken(user)
+	if err != nil {
+		log.Println("users.sendVerification() ERROR:", err)
+		return
+	}
+
+	go u.emailer.Verify(user.Name, user.EmailAddress, token)
+}
+
+// VerifyForm ...
+type VerifyForm struct {
+	Token string `schema:"token"`
+}
+
+// Verify ...
+// GET /verify
+func (u *Users) Verify(w http.ResponseWriter, r *http.Request) {
+	var form VerifyForm
+	if err := parseURLParams(r, &form); err != nil {
+		log.Println("users.Verify() ERROR:", err)
+	}
+
+	user, err := u.us.VerifyEmail(form.Token)
+	if err != nil {
+		alert := views.Alert{
+			Level:   views.AlertLvlError,
+			Message: "That Verification Link Is Invalid Or Has Expired.",
+		}
+		views.RedirectAlert(w, r, "/", http.StatusFound, alert)
+		return
+	}
+
+	go u.emailer.Welcome(user.Name, user.EmailAddress)
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Thanks! Your Email Address Has Been Verified.",
+	}
+
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// ResendVerification ...
+// POST /verify/resend
+func (u *Users) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	if !user.IsVerified() {
+		u.sendVerification(user)
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlInfo,
+		Message: "A New Verification Link Has Been Sent To Your Email Address.",
+	}
+
+	views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+}
+
+// PrivacyForm ...
+type PrivacyForm struct {
+	KeepPhotoLocation bool `schema:"keep_photo_location"`
+}
+
+// Privacy ...
+// GET /account/privacy
+func (u *Users) Privacy(w http.ResponseWriter, r *http.Request) {
+	user := context.User(r.Context())
+	form := PrivacyForm{
+		KeepPhotoLocation: user.KeepPhotoLocation,
+	}
+
+	u.PrivacyView.Render(w, r, form)
+}
+
+// UpdatePrivacy ...
+// POST /account/privacy
+func (u *Users) UpdatePrivacy(w http.ResponseWriter, r *http.Request) {
+	var vd views.Data
+	var form PrivacyForm
+	vd.Yield = &form
+	if err := parseForm(r, &form); err != nil {
+		log.Println("users.UpdatePrivacy() ERROR:", err)
+		vd.SetAlert(err)
+		u.PrivacyView.Render(w, r, vd)
+		return
+	}
+
+	user := context.User(r.Context())
+	user.KeepPhotoLocation = form.KeepPhotoLocation
+	if err := u.us.As(auditActor(r)).Update(user); err != nil {
+		vd.SetAlert(err)
+		u.PrivacyView.Render(w, r, vd)
+		return
+	}
+
+	alert := views.Alert{
+		Level:   views.AlertLvlSuccess,
+		Message: "Privacy Settings Updated!",
+	}
+
+	views.RedirectAlert(w, r, "/account/privacy", http.StatusFound, alert)
+}
@@ -0,0 +1,195 @@
+package dropbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Default endpoints of the Dropbox v2 API
+const (
+	DefaultAPIURL     = "https://api.dropboxapi.com"
+	DefaultContentURL = "https://content.dropboxapi.com"
+)
+
+// Entry is a file or folder in a user's Dropbox
+type Entry struct {
+	Tag         string `json:".tag"`
+	Name        string `json:"name"`
+	PathLower   string `json:"path_lower"`
+	PathDisplay string `json:"path_display"`
+	Size        int64  `json:"size"`
+}
+
+// IsFolder ...
+func (e Entry) IsFolder() bool {
+	return e.Tag == "folder"
+}
+
+// IsImage reports whether the file looks like an image from
+// its extension, the image service checks the contents later
+func (e Entry) IsImage() bool {
+	switch strings.ToLower(path.Ext(e.Name)) {
+	case ".jpg", ".jpeg", ".png", ".gif", ".webp":
+		return e.Tag == "file"
+	}
+
+	return false
+}
+
+// ClientConfig ...
+type ClientConfig func(*Client)
+
+// WithAPIURL points the client at a different API server, which
+// is mostly useful for testing against a fake one
+func WithAPIURL(url string) ClientConfig {
+	return func(c *Client) {
+		c.apiURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+// WithContentURL is WithAPIURL for file downloads
+func WithContentURL(url string) ClientConfig {
+	return func(c *Client) {
+		c.contentURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+// NewClient returns a client that makes requests with
+// httpClient, which should add the user's OAuth token
+func NewClient(httpClient *http.Client, cfgs ...ClientConfig) *Client {
+	c := Client{
+		http:       httpClient,
+		apiURL:     DefaultAPIURL,
+		contentURL: DefaultContentURL,
+	}
+	for _, cfg := range cfgs {
+		cfg(&c)
+	}
+
+	return &c
+}
+
+// Client talks to the parts of the Dropbox API we use
+type Client struct {
+	http       *http.Client
+	apiURL     string
+	contentURL string
+}
+
+// Error is returned when Dropbox responds with an error
+type Error struct {
+	StatusCode int
+	Summary    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dropbox: %d %s", e.StatusCode, e.Summary)
+}
+
+// List returns everything in the folder at path, folders first
+// then files, each sorted by name. The root folder is "".
+func (c *Client) List(folder string) ([]Entry, error) {
+	if folder == "/" {
+		folder = ""
+	}
+
+	var entries []Entry
+	var res struct {
+		Entries []Entry `json:"entries"`
+		Cursor  string  `json:"cursor"`
+		HasMore bool    `json:"has_more"`
+	}
+	err := c.rpc("/2/files/list_folder", map[string]interface{}{"path": folder}, &res)
+	for {
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, res.Entries...)
+		if !res.HasMore {
+			break
+		}
+		cursor := res.Cursor
+		res.Entries = nil
+		err = c.rpc("/2/files/list_folder/continue", map[string]interface{}{"cursor": cursor}, &res)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsFolder() != entries[j].IsFolder() {
+			return entries[i].IsFolder()
+		}
+		return strings.ToLower(entries[i].Name) < strings.ToLower(entries[j].Name)
+	})
+
+	return entries, nil
+}
+
+// Download returns the contents of the file at path, it is up
+// to the caller to close it
+func (c *Client) Download(file string) (io.ReadCloser, error) {
+	arg, err := json.Marshal(map[string]string{"path": file})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.contentURL+"/2/files/download", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Dropbox-API-Arg", string(arg))
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, readError(res)
+	}
+
+	return res.Body, nil
+}
+
+// rpc calls one of the API's JSON endpoints
+func (c *Client) rpc(endpoint string, arg, dst interface{}) error {
+	body, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.apiURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return readError(res)
+	}
+
+	return json.NewDecoder(res.Body).Decode(dst)
+}
+
+func readError(res *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 4096))
+	var body struct {
+		Summary string `json:"error_summary"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil || body.Summary == "" {
+		body.Summary = strings.TrimSpace(string(b))
+	}
+
+	return &Error{StatusCode: res.StatusCode, Summary: body.Summary}
+}
@@ -0,0 +1,105 @@
+package dropbox
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/arnoldokoth/lenslocked.com/dropbox/dropboxtest"
+	"golang.org/x/oauth2"
+)
+
+func newTestClient(srv *dropboxtest.Server, accessToken string) *Client {
+	httpClient := oauth2.NewClient(context.Background(), oauth2.StaticTokenSource(&oauth2.Token{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+	}))
+
+	return NewClient(httpClient, WithAPIURL(srv.URL+"/"), WithContentURL(srv.URL))
+}
+
+func TestListFollowsCursor(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+	srv.PageSize = 2
+	for _, p := range []string{"/b.jpg", "/A.png", "/notes.txt", "/Trips/x.jpg", "/Album/y.jpg", "/Album/Deeper/z.jpg"} {
+		srv.AddFile(p, []byte(p))
+	}
+
+	entries, err := newTestClient(srv, srv.AccessToken).List("/")
+	if err != nil {
+		t.Fatalf("List() err = %v", err)
+	}
+
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Tag+":"+e.Name)
+	}
+	want := []string{"folder:Album", "folder:Trips", "file:A.png", "file:b.jpg", "file:notes.txt"}
+	if len(got) != len(want) {
+		t.Fatalf("List() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("List() = %v, want %v", got, want)
+		}
+	}
+	if _, calls := srv.Stats(); calls != 3 {
+		t.Errorf("List() made %d requests, want 3", calls)
+	}
+
+	if !entries[2].IsImage() || entries[4].IsImage() || entries[0].IsImage() {
+		t.Errorf("IsImage() is wrong for %v", entries)
+	}
+}
+
+func TestListSubfolder(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+	srv.AddFile("/Album/y.jpg", []byte("y"))
+	srv.AddFile("/Album/Deeper/z.jpg", []byte("z"))
+	srv.AddFile("/other.jpg", []byte("o"))
+
+	entries, err := newTestClient(srv, srv.AccessToken).List("/Album")
+	if err != nil {
+		t.Fatalf("List() err = %v", err)
+	}
+	if len(entries) != 2 || entries[0].PathDisplay != "/Album/Deeper" || entries[1].PathDisplay != "/Album/y.jpg" {
+		t.Errorf("List() = %+v, want /Album/Deeper and /Album/y.jpg", entries)
+	}
+}
+
+func TestDownload(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+	srv.AddFile("/Album/y.jpg", []byte("jpeg bytes"))
+	c := newTestClient(srv, srv.AccessToken)
+
+	rc, err := c.Download("/Album/y.jpg")
+	if err != nil {
+		t.Fatalf("Download() err = %v", err)
+	}
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(data) != "jpeg bytes" {
+		t.Errorf("Download() = %q, want %q", data, "jpeg bytes")
+	}
+
+	_, err = c.Download("/Album/missing.jpg")
+	dErr, ok := err.(*Error)
+	if !ok || dErr.StatusCode != http.StatusConflict || dErr.Summary != "path/not_found/" {
+		t.Errorf("Download() of a missing file err = %v, want a 409 path/not_found/", err)
+	}
+}
+
+func TestBadToken(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	_, err := newTestClient(srv, "stolen").List("")
+	dErr, ok := err.(*Error)
+	if !ok || dErr.StatusCode != http.StatusUnauthorized || dErr.Summary != "expired_access_token/" {
+		t.Errorf("List() err = %v, want a 401 expired_access_token/", err)
+	}
+}
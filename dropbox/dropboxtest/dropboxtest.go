@@ -0,0 +1,227 @@
+// Package dropboxtest provides a fake Dropbox for tests. It
+// implements the token endpoint and the parts of the v2 API the
+// dropbox package uses, keeping files in memory.
+package dropboxtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NewServer starts a fake Dropbox, it is up to the caller to
+// close it. Point the client at it with dropbox.WithAPIURL and
+// dropbox.WithContentURL, and the OAuth config's token URL at
+// TokenURL.
+func NewServer() *Server {
+	s := &Server{
+		AccessToken:  "access-0",
+		RefreshToken: "refresh",
+		PageSize:     100,
+		files:        make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+
+	return s
+}
+
+// Server is a fake Dropbox
+type Server struct {
+	*httptest.Server
+
+	// the fields are only safe to set before the first request,
+	// use Stats to read the counts afterwards
+	mu sync.Mutex
+	// AccessToken is the only token API requests are accepted
+	// with, it changes every time the token is refreshed
+	AccessToken string
+	// RefreshToken is what the token endpoint accepts
+	RefreshToken string
+	// Refreshes counts how many times the token was refreshed
+	Refreshes int
+	// PageSize is how many entries list_folder returns before
+	// the client has to continue with the cursor
+	PageSize int
+	// ListCalls counts list_folder and list_folder/continue
+	// requests
+	ListCalls int
+
+	files map[string][]byte
+}
+
+// TokenURL is the OAuth token endpoint
+func (s *Server) TokenURL() string {
+	return s.URL + "/oauth2/token"
+}
+
+// AddFile stores data at the path, which should start with a
+// slash. Its folders exist as long as they have a file in them.
+func (s *Server) AddFile(p string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[p] = data
+}
+
+// Stats returns how many times the token was refreshed and the
+// folder listed, without racing the handlers
+func (s *Server) Stats() (refreshes, listCalls int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Refreshes, s.ListCalls
+}
+
+type entry struct {
+	Tag         string `json:".tag"`
+	Name        string `json:"name"`
+	PathLower   string `json:"path_lower"`
+	PathDisplay string `json:"path_display"`
+	Size        int64  `json:"size,omitempty"`
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed/")
+		return
+	}
+
+	if r.URL.Path == "/oauth2/token" {
+		s.token(w, r)
+		return
+	}
+
+	if r.Header.Get("Authorization") != "Bearer "+s.AccessToken {
+		writeError(w, http.StatusUnauthorized, "expired_access_token/")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/2/files/list_folder":
+		var arg struct {
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&arg); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request/")
+			return
+		}
+		s.list(w, arg.Path, 0)
+	case "/2/files/list_folder/continue":
+		var arg struct {
+			Cursor string `json:"cursor"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&arg); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request/")
+			return
+		}
+		parts := strings.SplitN(arg.Cursor, ":", 2)
+		offset, err := strconv.Atoi(parts[0])
+		if err != nil || len(parts) != 2 {
+			writeError(w, http.StatusConflict, "reset/")
+			return
+		}
+		s.list(w, parts[1], offset)
+	case "/2/files/download":
+		var arg struct {
+			Path string `json:"path"`
+		}
+		if err := json.Unmarshal([]byte(r.Header.Get("Dropbox-API-Arg")), &arg); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request/")
+			return
+		}
+		data, ok := s.files[arg.Path]
+		if !ok {
+			writeError(w, http.StatusConflict, "path/not_found/")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	default:
+		writeError(w, http.StatusNotFound, "not_found/")
+	}
+}
+
+// token swaps the refresh token for a new access token
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") != "refresh_token" || r.FormValue("refresh_token") != s.RefreshToken {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	s.Refreshes++
+	s.AccessToken = fmt.Sprintf("access-%d", s.Refreshes)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": s.AccessToken,
+		"token_type":   "bearer",
+		"expires_in":   14400,
+	})
+}
+
+// list writes a page of the folder's entries starting at
+// offset. The cursor is just the next offset and the folder.
+func (s *Server) list(w http.ResponseWriter, folder string, offset int) {
+	s.ListCalls++
+
+	folders := make(map[string]bool)
+	var entries []entry
+	for p, data := range s.files {
+		dir := path.Dir(p)
+		if dir == "/" {
+			dir = ""
+		}
+		switch {
+		case dir == folder:
+			entries = append(entries, entry{
+				Tag:         "file",
+				Name:        path.Base(p),
+				PathLower:   strings.ToLower(p),
+				PathDisplay: p,
+				Size:        int64(len(data)),
+			})
+		case strings.HasPrefix(dir, folder+"/"):
+			child := folder + "/" + strings.SplitN(strings.TrimPrefix(dir, folder+"/"), "/", 2)[0]
+			if !folders[child] {
+				folders[child] = true
+				entries = append(entries, entry{
+					Tag:         "folder",
+					Name:        path.Base(child),
+					PathLower:   strings.ToLower(child),
+					PathDisplay: child,
+				})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].PathDisplay < entries[j].PathDisplay })
+
+	if offset > len(entries) {
+		offset = len(entries)
+	}
+	end := offset + s.PageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries":  entries[offset:end],
+		"cursor":   fmt.Sprintf("%d:%s", end, folder),
+		"has_more": end < len(entries),
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, summary string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error_summary": summary})
+}
@@ -3,7 +3,10 @@ package email
 import (
 	"context"
 	"fmt"
+	"html"
 	"log"
+	"net/url"
+	"time"
 
 	mailgun "github.com/mailgun/mailgun-go/v4"
 )
@@ -28,6 +31,196 @@ const (
 
 	Best, <br />
 	Arnold`
+
+	verifySubject = "Please verify your email address"
+
+	verifyTextTmpl = `Hi there!
+
+Please confirm that this is your email address by following the link below:
+
+%s
+
+Until your address is verified you won't be able to create galleries.
+
+Best,
+LensLocked Support
+`
+
+	verifyHTMLTmpl = `Hi there!<br/>
+<br/>
+Please confirm that this is your email address by following the link below:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+Until your address is verified you won't be able to create galleries.<br/>
+<br/>
+Best,<br/>
+LensLocked Support<br/>
+`
+
+	resetSubject = "Instructions for resetting your password"
+
+	resetTextTmpl = `Hi there!
+
+It appears that you have requested a password reset. If this was you, please follow the link below to update your password:
+
+%s
+
+If you are asked for a token, please use the following value:
+
+%s
+
+If you didn't request a password reset you can safely ignore this email and your account will not be changed.
+
+Best,
+LensLocked Support
+`
+
+	resetHTMLTmpl = `Hi there!<br/>
+<br/>
+It appears that you have requested a password reset. If this was you, please follow the link below to update your password:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+If you are asked for a token, please use the following value:<br/>
+<br/>
+%s<br/>
+<br/>
+If you didn't request a password reset you can safely ignore this email and your account will not be changed.<br/>
+<br/>
+Best,<br/>
+LensLocked Support<br/>
+`
+
+	lockoutSubject = "Your account has been temporarily locked"
+
+	lockoutTextTmpl = `Hi there!
+
+Someone tried to log in to your account with the wrong password too many times, so we have stopped anyone logging in until %s.
+
+If this was you, you can wait and try again or reset your password by following the link below:
+
+%s
+
+If it wasn't you, your password has not been changed but we recommend choosing a new one and turning on two-factor authentication.
+
+Best,
+LensLocked Support
+`
+
+	lockoutHTMLTmpl = `Hi there!<br/>
+<br/>
+Someone tried to log in to your account with the wrong password too many times, so we have stopped anyone logging in until %s.<br/>
+<br/>
+If this was you, you can wait and try again or reset your password by following the link below:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+If it wasn't you, your password has not been changed but we recommend choosing a new one and turning on two-factor authentication.<br/>
+<br/>
+Best,<br/>
+LensLocked Support<br/>
+`
+
+	emailChangeRequestedSubject = "Your email address is being changed"
+
+	emailChangeRequestedTextTmpl = `Hi there!
+
+Someone signed in to your LensLocked.com account asked to change its email address to %s. It will change once the link we sent there has been followed, after that we won't send any more emails here.
+
+If you didn't ask for this please change your password and contact us straight away by replying to this email.
+
+Best,
+LensLocked Support
+`
+
+	emailChangeRequestedHTMLTmpl = `Hi there!<br/>
+<br/>
+Someone signed in to your LensLocked.com account asked to change its email address to %s. It will change once the link we sent there has been followed, after that we won't send any more emails here.<br/>
+<br/>
+If you didn't ask for this please change your password and contact us straight away by replying to this email.<br/>
+<br/>
+Best,<br/>
+LensLocked Support<br/>
+`
+
+	deletionScheduledSubject = "Your account is scheduled for deletion"
+
+	deletionScheduledTextTmpl = `Hi there!
+
+As you asked, your LensLocked.com account will be deleted on %s along with all of your galleries and photos.
+
+If you change your mind, log in before then and cancel the deletion from your account settings:
+
+%s
+
+Best,
+LensLocked Support
+`
+
+	deletionScheduledHTMLTmpl = `Hi there!<br/>
+<br/>
+As you asked, your LensLocked.com account will be deleted on %s along with all of your galleries and photos.<br/>
+<br/>
+If you change your mind, log in before then and cancel the deletion from your account settings:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+Best,<br/>
+LensLocked Support<br/>
+`
+
+	accountDeletedSubject = "Your account has been deleted"
+
+	accountDeletedText = `Hi there!
+
+This is to confirm that your LensLocked.com account has been deleted. Your galleries, photos and every other piece of information we held about you have been permanently removed.
+
+This is the last email we will send you.
+
+Best,
+LensLocked Support
+`
+
+	accountDeletedHTML = `Hi there!<br/>
+<br/>
+This is to confirm that your LensLocked.com account has been deleted. Your galleries, photos and every other piece of information we held about you have been permanently removed.<br/>
+<br/>
+This is the last email we will send you.<br/>
+<br/>
+Best,<br/>
+LensLocked Support<br/>
+`
+
+	exportReadySubject = "Your data export is ready"
+
+	exportReadyTextTmpl = `Hi there!
+
+The copy of your LensLocked.com data you asked for is ready. Download it by following the link below:
+
+%s
+
+The link works until %s, after that the export is deleted and you'll need to request a new one.
+
+If you didn't ask for an export please contact us straight away by replying to this email.
+
+Best,
+LensLocked Support
+`
+
+	exportReadyHTMLTmpl = `Hi there!<br/>
+<br/>
+The copy of your LensLocked.com data you asked for is ready. Download it by following the link below:<br/>
+<br/>
+<a href="%s">%s</a><br/>
+<br/>
+The link works until %s, after that the export is deleted and you'll need to request a new one.<br/>
+<br/>
+If you didn't ask for an export please contact us straight away by replying to this email.<br/>
+<br/>
+Best,<br/>
+LensLocked Support<br/>
+`
 )
 
 // WithMailgun ...
@@ -45,6 +238,14 @@ func WithSender(name, email string) ClientConfig {
 	}
 }
 
+// WithBaseURL sets the URL that links in outgoing emails
+// are built from e.g. https://www.lenslocked.com
+func WithBaseURL(baseURL string) ClientConfig {
+	return func(c *Client) {
+		c.baseURL = baseURL
+	}
+}
+
 // ClientConfig ...
 type ClientConfig func(*Client)
 
@@ -59,8 +260,9 @@ func NewClient(opts ...ClientConfig) *Client {
 
 // Client ...
 type Client struct {
-	from string
-	mg   mailgun.Mailgun
+	from    string
+	baseURL string
+	mg      mailgun.Mailgun
 }
 
 // Welcome ...
@@ -76,6 +278,123 @@ func (c *Client) Welcome(toName, toEmail string) error {
 	return nil
 }
 
+// Verify emails the user a link to confirm their email address
+func (c *Client) Verify(toName, toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	verifyURL := c.baseURL + "/verify?" + v.Encode()
+	verifyText := fmt.Sprintf(verifyTextTmpl, verifyURL)
+	message := c.mg.NewMessage(c.from, verifySubject, verifyText, buildEmail(toName, toEmail))
+	message.SetHtml(fmt.Sprintf(verifyHTMLTmpl, verifyURL, verifyURL))
+	_, _, err := c.mg.Send(context.TODO(), message)
+	if err != nil {
+		log.Println("email.Verify() ERROR: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// ResetPw emails the user a link to reset their password
+func (c *Client) ResetPw(toEmail, token string) error {
+	v := url.Values{}
+	v.Set("token", token)
+	resetURL := c.baseURL + "/reset?" + v.Encode()
+	resetText := fmt.Sprintf(resetTextTmpl, resetURL, token)
+	message := c.mg.NewMessage(c.from, resetSubject, resetText, toEmail)
+	resetHTML := fmt.Sprintf(resetHTMLTmpl, resetURL, resetURL, token)
+	message.SetHtml(resetHTML)
+	_, _, err := c.mg.Send(context.TODO(), message)
+	if err != nil {
+		log.Println("email.ResetPw() ERROR: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// Lockout tells the user their account was locked after too
+// many failed logins
+func (c *Client) Lockout(toName, toEmail string, until time.Time) error {
+	forgotURL := c.baseURL + "/forgot"
+	untilText := until.UTC().Format("Jan 2, 2006 15:04 MST")
+	lockoutText := fmt.Sprintf(lockoutTextTmpl, untilText, forgotURL)
+	message := c.mg.NewMessage(c.from, lockoutSubject, lockoutText, buildEmail(toName, toEmail))
+	message.SetHtml(fmt.Sprintf(lockoutHTMLTmpl, untilText, forgotURL, forgotURL))
+	_, _, err := c.mg.Send(context.TODO(), message)
+	if err != nil {
+		log.Println("email.Lockout() ERROR: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// EmailChangeRequested tells the user's current address that
+// someone asked to change it to newEmail
+func (c *Client) EmailChangeRequested(toName, oldEmail, newEmail string) error {
+	text := fmt.Sprintf(emailChangeRequestedTextTmpl, newEmail)
+	message := c.mg.NewMessage(c.from, emailChangeRequestedSubject, text, buildEmail(toName, oldEmail))
+	message.SetHtml(fmt.Sprintf(emailChangeRequestedHTMLTmpl, html.EscapeString(newEmail)))
+	_, _, err := c.mg.Send(context.TODO(), message)
+	if err != nil {
+		log.Println("email.EmailChangeRequested() ERROR: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// DeletionScheduled tells the user when their account will be
+// deleted and how to cancel it
+func (c *Client) DeletionScheduled(toName, toEmail string, deleteAfter time.Time) error {
+	accountURL := c.baseURL + "/account"
+	dateText := deleteAfter.UTC().Format("Jan 2, 2006 15:04 MST")
+	text := fmt.Sprintf(deletionScheduledTextTmpl, dateText, accountURL)
+	message := c.mg.NewMessage(c.from, deletionScheduledSubject, text, buildEmail(toName, toEmail))
+	message.SetHtml(fmt.Sprintf(deletionScheduledHTMLTmpl, dateText, accountURL, accountURL))
+	_, _, err := c.mg.Send(context.TODO(), message)
+	if err != nil {
+		log.Println("email.DeletionScheduled() ERROR: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// AccountDeleted confirms to the user that their account and
+// everything in it has been permanently deleted
+func (c *Client) AccountDeleted(toName, toEmail string) error {
+	message := c.mg.NewMessage(c.from, accountDeletedSubject, accountDeletedText, buildEmail(toName, toEmail))
+	message.SetHtml(accountDeletedHTML)
+	_, _, err := c.mg.Send(context.TODO(), message)
+	if err != nil {
+		log.Println("email.AccountDeleted() ERROR: ", err)
+		return err
+	}
+
+	return nil
+}
+
+// ExportReady emails the user a link to download their data
+// export
+func (c *Client) ExportReady(toName, toEmail, token string, expiresAt time.Time) error {
+	v := url.Values{}
+	v.Set("token", token)
+	downloadURL := c.baseURL + "/account/export/download?" + v.Encode()
+	expiresText := expiresAt.UTC().Format("Jan 2, 2006 15:04 MST")
+	text := fmt.Sprintf(exportReadyTextTmpl, downloadURL, expiresText)
+	message := c.mg.NewMessage(c.from, exportReadySubject, text, buildEmail(toName, toEmail))
+	message.SetHtml(fmt.Sprintf(exportReadyHTMLTmpl, downloadURL, downloadURL, expiresText))
+	_, _, err := c.mg.Send(context.TODO(), message)
+	if err != nil {
+		log.Println("email.ExportReady() ERROR: ", err)
+		return err
+	}
+
+	return nil
+}
+
 func buildEmail(name, email string) string {
 	if name == "" {
 		return email
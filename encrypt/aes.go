@@ -0,0 +1,71 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"github.com/arnoldokoth/lenslocked.com/rand"
+)
+
+// ErrCiphertext is returned when a value can't be decrypted,
+// either because it's corrupt or the key has changed
+var ErrCiphertext = errors.New("encrypt: ciphertext is not valid")
+
+// NewAES ...
+func NewAES(key string) AES {
+	// AES-256 needs exactly 32 bytes whatever the configured
+	// key looks like
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		// only happens for key sizes other than 16, 24 or 32
+		panic(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+
+	return AES{
+		gcm: gcm,
+	}
+}
+
+// AES encrypts values with AES-GCM so they can be stored
+// without being readable from a copy of the database
+type AES struct {
+	gcm cipher.AEAD
+}
+
+// Encrypt ...
+func (a AES) Encrypt(plaintext string) (string, error) {
+	nonce, err := rand.Bytes(a.gcm.NonceSize())
+	if err != nil {
+		return "", err
+	}
+
+	sealed := a.gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt ...
+func (a AES) Decrypt(ciphertext string) (string, error) {
+	b, err := base64.URLEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", ErrCiphertext
+	}
+	if len(b) < a.gcm.NonceSize() {
+		return "", ErrCiphertext
+	}
+
+	nonce, sealed := b[:a.gcm.NonceSize()], b[a.gcm.NonceSize():]
+	plaintext, err := a.gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", ErrCiphertext
+	}
+
+	return string(plaintext), nil
+}
@@ -0,0 +1,430 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoExif is returned when the image doesn't contain any
+	// EXIF metadata, which is the case for most non JPEG files
+	ErrNoExif = errors.New("exif: no exif data found")
+
+	errMalformed = errors.New("exif: malformed exif data")
+)
+
+// tags we read, see the EXIF 2.3 specification
+const (
+	tagMake             = 0x010F
+	tagModel            = 0x0110
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagExposureTime     = 0x829A
+	tagFNumber          = 0x829D
+	tagISO              = 0x8827
+	tagDateTimeOriginal = 0x9003
+	tagFocalLength      = 0x920A
+	tagLensModel        = 0xA434
+)
+
+// XMP packets are stored in APP1 segments starting with one of
+// these, see part 3 of the XMP specification
+var (
+	xmpHeader         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtendedHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// xmpLocationNames appear in the names of the XMP properties that
+// hold where a photo was taken e.g. exif:GPSLatitude,
+// Iptc4xmpCore:Location and photoshop:City
+var xmpLocationNames = [][]byte{[]byte("GPS"), []byte("Location"), []byte("City")}
+
+// Data is the subset of EXIF metadata we care about
+type Data struct {
+	Make         string
+	Model        string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+	HasGPS       bool
+}
+
+// Parse reads the EXIF metadata from a JPEG
+func Parse(jpeg []byte) (*Data, error) {
+	t, err := findTIFF(jpeg)
+	if err != nil {
+		return nil, err
+	}
+
+	ifd0, err := t.readIFD(t.firstIFD)
+	if err != nil {
+		return nil, err
+	}
+
+	var d Data
+	d.Make = t.ascii(ifd0[tagMake])
+	d.Model = t.ascii(ifd0[tagModel])
+	// StripGPS leaves an empty GPS IFD behind, so it only
+	// counts when it has something in it
+	if gps, ok := ifd0[tagGPSIFD]; ok {
+		entries, err := t.readIFD(t.uint32At(gps.valueOffset()))
+		d.HasGPS = err != nil || len(entries) > 0
+	}
+
+	if e, ok := ifd0[tagExifIFD]; ok {
+		exifIFD, err := t.readIFD(t.uint32At(e.valueOffset()))
+		if err != nil {
+			return nil, err
+		}
+
+		d.LensModel = t.ascii(exifIFD[tagLensModel])
+		if num, den, ok := t.rational(exifIFD[tagExposureTime]); ok {
+			d.ExposureTime = formatExposure(num, den)
+		}
+		if num, den, ok := t.rational(exifIFD[tagFNumber]); ok && den != 0 {
+			d.FNumber = float64(num) / float64(den)
+		}
+		if num, den, ok := t.rational(exifIFD[tagFocalLength]); ok && den != 0 {
+			d.FocalLength = float64(num) / float64(den)
+		}
+		if iso, ok := t.short(exifIFD[tagISO]); ok {
+			d.ISO = int(iso)
+		}
+		if taken, err := time.Parse("2006:01:02 15:04:05", t.ascii(exifIFD[tagDateTimeOriginal])); err == nil {
+			d.TakenAt = &taken
+		}
+	}
+
+	return &d, nil
+}
+
+// StripGPS returns a copy of the JPEG with every GPS tag and
+// any XMP packet holding a location removed. Everything else,
+// including the rest of the EXIF data, is left exactly as it
+// was.
+func StripGPS(jpeg []byte) ([]byte, error) {
+	out, err := stripGPSIFD(jpeg)
+	if err != nil {
+		return nil, err
+	}
+
+	return removeSegments(out, func(marker byte, payload []byte) bool {
+		return marker == 0xE1 && xmpLocation(payload)
+	})
+}
+
+// stripGPSIFD returns a copy of the JPEG with the EXIF GPS IFD
+// zeroed
+func stripGPSIFD(jpeg []byte) ([]byte, error) {
+	out := make([]byte, len(jpeg))
+	copy(out, jpeg)
+
+	t, err := findTIFF(out)
+	if err == ErrNoExif {
+		return out, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ifd0, err := t.readIFD(t.firstIFD)
+	if err != nil {
+		return nil, err
+	}
+
+	gps, ok := ifd0[tagGPSIFD]
+	if !ok {
+		return out, nil
+	}
+
+	offset := t.uint32At(gps.valueOffset())
+	entries, err := t.readIFD(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	// wipe any values stored outside of the IFD itself...
+	for _, e := range entries {
+		if size := e.size(); size > 4 {
+			start := int(t.uint32At(e.valueOffset()))
+			if start+size <= len(t.b) {
+				zero(t.b[start : start+size])
+			}
+		}
+	}
+
+	// ...then the IFD, leaving an empty one behind so the
+	// pointer to it stays valid
+	end := int(offset) + 2 + 12*len(entries) + 4
+	if end > len(t.b) {
+		end = len(t.b)
+	}
+	zero(t.b[offset:end])
+
+	return out, nil
+}
+
+// xmpLocation reports whether an APP1 payload is an XMP packet
+// that could give away where the photo was taken. Extended XMP
+// is split across several segments so a property can straddle
+// two of them, those are always treated as holding a location.
+func xmpLocation(payload []byte) bool {
+	if bytes.HasPrefix(payload, xmpExtendedHeader) {
+		return true
+	}
+	if !bytes.HasPrefix(payload, xmpHeader) {
+		return false
+	}
+
+	for _, name := range xmpLocationNames {
+		if bytes.Contains(payload, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Strip returns a copy of the JPEG with every APP1 segment
+// removed, which is where EXIF and XMP metadata live. Unlike
+// StripGPS it doesn't need the EXIF data to make sense, only
+// the segments around it.
+func Strip(jpeg []byte) ([]byte, error) {
+	return removeSegments(jpeg, func(marker byte, payload []byte) bool {
+		return marker == 0xE1
+	})
+}
+
+// removeSegments returns a copy of the JPEG without the metadata
+// segments drop picks out. The image data after the start of
+// scan is copied over untouched.
+func removeSegments(jpeg []byte, drop func(marker byte, payload []byte) bool) ([]byte, error) {
+	if len(jpeg) < 4 || jpeg[0] != 0xFF || jpeg[1] != 0xD8 {
+		return nil, errMalformed
+	}
+
+	out := make([]byte, 0, len(jpeg))
+	out = append(out, jpeg[:2]...)
+	i := 2
+	for i+4 <= len(jpeg) {
+		if jpeg[i] != 0xFF {
+			return nil, errMalformed
+		}
+		marker := jpeg[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(jpeg[i+2 : i+4]))
+		if length < 2 || i+2+length > len(jpeg) {
+			return nil, errMalformed
+		}
+
+		if !drop(marker, jpeg[i+4:i+2+length]) {
+			out = append(out, jpeg[i:i+2+length]...)
+		}
+		i += 2 + length
+	}
+
+	return append(out, jpeg[i:]...), nil
+}
+
+// tiff is the TIFF structure EXIF data is stored in
+type tiff struct {
+	b        []byte
+	order    binary.ByteOrder
+	firstIFD uint32
+}
+
+type entry struct {
+	tag    uint16
+	typ    uint16
+	count  uint32
+	offset int // where the entry's value field sits in b
+}
+
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 7: 1, 9: 4, 10: 8}
+
+func (e entry) size() int {
+	return typeSizes[e.typ] * int(e.count)
+}
+
+func (e entry) valueOffset() int {
+	return e.offset
+}
+
+// findTIFF walks the JPEG's segments looking for the APP1
+// segment holding the EXIF data
+func findTIFF(b []byte) (*tiff, error) {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil, ErrNoExif
+	}
+
+	i := 2
+	for i+4 <= len(b) {
+		if b[i] != 0xFF {
+			return nil, errMalformed
+		}
+		marker := b[i+1]
+		// start of scan, the image data follows so no more
+		// metadata segments
+		if marker == 0xDA || marker == 0xD9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		if length < 2 || i+2+length > len(b) {
+			return nil, errMalformed
+		}
+
+		segment := b[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return newTIFF(segment[6:])
+		}
+		i += 2 + length
+	}
+
+	return nil, ErrNoExif
+}
+
+func newTIFF(b []byte) (*tiff, error) {
+	if len(b) < 8 {
+		return nil, errMalformed
+	}
+
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errMalformed
+	}
+
+	if order.Uint16(b[2:4]) != 42 {
+		return nil, errMalformed
+	}
+
+	return &tiff{
+		b:        b,
+		order:    order,
+		firstIFD: order.Uint32(b[4:8]),
+	}, nil
+}
+
+func (t *tiff) readIFD(offset uint32) (map[uint16]entry, error) {
+	start := int(offset)
+	if start <= 0 || start+2 > len(t.b) {
+		return nil, errMalformed
+	}
+
+	n := int(t.order.Uint16(t.b[start : start+2]))
+	if start+2+12*n > len(t.b) {
+		return nil, errMalformed
+	}
+
+	entries := make(map[uint16]entry, n)
+	for i := 0; i < n; i++ {
+		p := start + 2 + 12*i
+		e := entry{
+			tag:    t.order.Uint16(t.b[p : p+2]),
+			typ:    t.order.Uint16(t.b[p+2 : p+4]),
+			count:  t.order.Uint32(t.b[p+4 : p+8]),
+			offset: p + 8,
+		}
+		entries[e.tag] = e
+	}
+
+	return entries, nil
+}
+
+// value returns the bytes holding e's value, which are either
+// inline in the entry or elsewhere in the TIFF
+func (t *tiff) value(e entry) ([]byte, bool) {
+	size := e.size()
+	if size <= 0 {
+		return nil, false
+	}
+	if size <= 4 {
+		return t.b[e.offset : e.offset+size], true
+	}
+
+	start := int(t.uint32At(e.offset))
+	if start < 0 || start+size > len(t.b) {
+		return nil, false
+	}
+
+	return t.b[start : start+size], true
+}
+
+func (t *tiff) uint32At(offset int) uint32 {
+	if offset+4 > len(t.b) {
+		return 0
+	}
+
+	return t.order.Uint32(t.b[offset : offset+4])
+}
+
+func (t *tiff) ascii(e entry) string {
+	if e.typ != 2 {
+		return ""
+	}
+
+	v, ok := t.value(e)
+	if !ok {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimRight(string(v), "\x00"))
+}
+
+func (t *tiff) short(e entry) (uint16, bool) {
+	if e.typ != 3 {
+		return 0, false
+	}
+
+	v, ok := t.value(e)
+	if !ok {
+		return 0, false
+	}
+
+	return t.order.Uint16(v[:2]), true
+}
+
+func (t *tiff) rational(e entry) (uint32, uint32, bool) {
+	if e.typ != 5 {
+		return 0, 0, false
+	}
+
+	v, ok := t.value(e)
+	if !ok {
+		return 0, 0, false
+	}
+
+	return t.order.Uint32(v[:4]), t.order.Uint32(v[4:8]), true
+}
+
+// formatExposure turns a shutter speed into the way it's
+// usually written e.g. 1/250 or 2s
+func formatExposure(num, den uint32) string {
+	if num == 0 || den == 0 {
+		return ""
+	}
+	if num >= den {
+		return strings.TrimSuffix(fmt.Sprintf("%.1f", float64(num)/float64(den)), ".0") + "s"
+	}
+
+	return fmt.Sprintf("1/%d", (den+num/2)/num)
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
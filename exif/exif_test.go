@@ -0,0 +1,247 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+// the fixtures in testdata were taken at 51°30'26.34"N
+// 0°7'40.38"W, with the location in both the EXIF GPS IFD and
+// an XMP packet
+var (
+	fixtureLatitude = rationals(51, 1, 30, 1, 2634, 100)
+	fixtureXMPTag   = []byte("exif:GPSLatitude")
+)
+
+func rationals(v ...uint32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, n := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], n)
+	}
+	return b
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// checkLocationRemoved makes sure got has none of the fixture's
+// location left in it and is still an image
+func checkLocationRemoved(t *testing.T, original, got []byte) {
+	t.Helper()
+	if !bytes.Contains(original, fixtureLatitude) || !bytes.Contains(original, fixtureXMPTag) {
+		t.Fatal("the fixture doesn't hold a location")
+	}
+	if bytes.Contains(got, fixtureLatitude) {
+		t.Error("the EXIF latitude is still there")
+	}
+	if bytes.Contains(got, fixtureXMPTag) {
+		t.Error("the XMP latitude is still there")
+	}
+
+	origCfg, _, err := image.DecodeConfig(bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(got)); err != nil {
+		t.Fatalf("the stripped image doesn't decode: %v", err)
+	}
+	cfg, _, _ := image.DecodeConfig(bytes.NewReader(got))
+	if cfg.Width != origCfg.Width || cfg.Height != origCfg.Height {
+		t.Errorf("stripped image is %dx%d, want %dx%d", cfg.Width, cfg.Height, origCfg.Width, origCfg.Height)
+	}
+}
+
+func TestParse(t *testing.T) {
+	d, err := Parse(readFixture(t, "gps.jpg"))
+	if err != nil {
+		t.Fatalf("Parse() err = %v", err)
+	}
+
+	taken := time.Date(2019, 6, 1, 10, 30, 0, 0, time.UTC)
+	want := Data{
+		Make:         "Canon",
+		Model:        "Canon EOS 5D Mark III",
+		LensModel:    "EF50mm f/1.8 STM",
+		ExposureTime: "1/250",
+		FNumber:      2.8,
+		ISO:          200,
+		FocalLength:  50,
+		TakenAt:      &taken,
+		HasGPS:       true,
+	}
+	if d.TakenAt == nil || !d.TakenAt.Equal(taken) {
+		t.Errorf("TakenAt = %v, want %v", d.TakenAt, taken)
+	}
+	d.TakenAt = want.TakenAt
+	if *d != want {
+		t.Errorf("Parse() = %+v, want %+v", *d, want)
+	}
+}
+
+func TestParseNoExif(t *testing.T) {
+	png := readFixture(t, "gps.png")
+	if _, err := Parse(png); err != ErrNoExif {
+		t.Errorf("Parse() err = %v, want %v", err, ErrNoExif)
+	}
+}
+
+func TestStripGPS(t *testing.T) {
+	jpeg := readFixture(t, "gps.jpg")
+	got, err := StripGPS(jpeg)
+	if err != nil {
+		t.Fatalf("StripGPS() err = %v", err)
+	}
+	checkLocationRemoved(t, jpeg, got)
+
+	// the rest of the EXIF data is kept
+	d, err := Parse(got)
+	if err != nil {
+		t.Fatalf("Parse() err = %v", err)
+	}
+	if d.HasGPS {
+		t.Error("HasGPS = true after stripping")
+	}
+	if d.Model != "Canon EOS 5D Mark III" || d.ISO != 200 || d.TakenAt == nil {
+		t.Errorf("Parse() = %+v, want the camera details kept", *d)
+	}
+}
+
+func TestStripGPSKeepsXMPWithoutLocation(t *testing.T) {
+	rating := "http://ns.adobe.com/xap/1.0/\x00<rdf:Description xmp:Rating=\"5\"/>"
+	located := "http://ns.adobe.com/xap/1.0/\x00<rdf:Description photoshop:City=\"London\"/>"
+	extended := "http://ns.adobe.com/xmp/extension/\x00" + "0123456789ABCDEF0123456789ABCDEF" + "\x00\x00\x00\x10\x00\x00\x00\x00<rdf:RDF"
+
+	var jpeg []byte
+	jpeg = append(jpeg, 0xFF, 0xD8)
+	jpeg = append(jpeg, segment(0xE1, rating)...)
+	jpeg = append(jpeg, segment(0xE1, located)...)
+	jpeg = append(jpeg, segment(0xE1, extended)...)
+	jpeg = append(jpeg, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF, 0xD9)
+
+	got, err := StripGPS(jpeg)
+	if err != nil {
+		t.Fatalf("StripGPS() err = %v", err)
+	}
+
+	var want []byte
+	want = append(want, 0xFF, 0xD8)
+	want = append(want, segment(0xE1, rating)...)
+	want = append(want, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF, 0xD9)
+	if !bytes.Equal(got, want) {
+		t.Errorf("StripGPS() = %q, want %q", got, want)
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	png := readFixture(t, "gps.png")
+	got, err := StripPNG(png)
+	if err != nil {
+		t.Fatalf("StripPNG() err = %v", err)
+	}
+	checkLocationRemoved(t, png, got)
+
+	for _, typ := range []string{"tEXt", "iTXt", "eXIf"} {
+		if bytes.Contains(got, []byte(typ)) {
+			t.Errorf("the %s chunk is still there", typ)
+		}
+	}
+}
+
+func TestStripWebP(t *testing.T) {
+	webp := readFixture(t, "gps.webp")
+	got, err := StripWebP(webp)
+	if err != nil {
+		t.Fatalf("StripWebP() err = %v", err)
+	}
+	checkLocationRemoved(t, webp, got)
+
+	if size := binary.LittleEndian.Uint32(got[4:8]); int(size) != len(got)-8 {
+		t.Errorf("RIFF size = %d, want %d", size, len(got)-8)
+	}
+	// the VP8X chunk comes first and must no longer announce
+	// the chunks that were removed
+	if string(got[12:16]) != "VP8X" || got[20]&(webpFlagEXIF|webpFlagXMP) != 0 {
+		t.Errorf("VP8X flags = %#x, want EXIF and XMP cleared", got[20])
+	}
+}
+
+func TestStripContainersMalformed(t *testing.T) {
+	png := readFixture(t, "gps.png")
+	webp := readFixture(t, "gps.webp")
+
+	if _, err := StripPNG(png[:40]); err == nil {
+		t.Error("StripPNG() of a truncated PNG err = nil, want an error")
+	}
+	if _, err := StripPNG(webp); err == nil {
+		t.Error("StripPNG() of a WebP err = nil, want an error")
+	}
+	if _, err := StripWebP(webp[:40]); err == nil {
+		t.Error("StripWebP() of a truncated WebP err = nil, want an error")
+	}
+	if _, err := StripWebP(png); err == nil {
+		t.Error("StripWebP() of a PNG err = nil, want an error")
+	}
+}
+
+// segment builds a JPEG marker segment holding payload
+func segment(marker byte, payload string) []byte {
+	length := len(payload) + 2
+	return append([]byte{0xFF, marker, byte(length >> 8), byte(length)}, payload...)
+}
+
+func TestStripRemovesAPP1(t *testing.T) {
+	var jpeg []byte
+	jpeg = append(jpeg, 0xFF, 0xD8)
+	jpeg = append(jpeg, segment(0xE0, "JFIF\x00")...)
+	// EXIF whose TIFF header is garbage, so Parse can't read it
+	jpeg = append(jpeg, segment(0xE1, "Exif\x00\x00XX\x00\x2aGPS garbage")...)
+	jpeg = append(jpeg, segment(0xE1, "http://ns.adobe.com/xap/1.0/\x00<xmp/>")...)
+	jpeg = append(jpeg, segment(0xDB, "quant")...)
+	jpeg = append(jpeg, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF, 0xD9)
+
+	if _, err := Parse(jpeg); err == nil {
+		t.Fatal("Parse() err = nil, want the EXIF data to be unreadable")
+	}
+
+	got, err := Strip(jpeg)
+	if err != nil {
+		t.Fatalf("Strip() err = %v", err)
+	}
+
+	var want []byte
+	want = append(want, 0xFF, 0xD8)
+	want = append(want, segment(0xE0, "JFIF\x00")...)
+	want = append(want, segment(0xDB, "quant")...)
+	want = append(want, 0xFF, 0xDA, 0x00, 0x02, 0x01, 0x02, 0xFF, 0xD9)
+	if !bytes.Equal(got, want) {
+		t.Errorf("Strip() = % x, want % x", got, want)
+	}
+}
+
+func TestStripMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"not a jpeg":        []byte("GIF89a"),
+		"truncated segment": append([]byte{0xFF, 0xD8}, 0xFF, 0xE1, 0x10, 0x00, 'E'),
+		"missing marker":    append([]byte{0xFF, 0xD8}, 0x00, 0xE1, 0x00, 0x02),
+	}
+
+	for name, jpeg := range tests {
+		if _, err := Strip(jpeg); err == nil {
+			t.Errorf("%s: Strip() err = nil, want an error", name)
+		}
+	}
+}
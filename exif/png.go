@@ -0,0 +1,55 @@
+package exif
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// pngMetadataChunks hold text and EXIF data, XMP is stored in an
+// iTXt chunk. None of them change how the image looks.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"iTXt": true,
+	"zTXt": true,
+}
+
+// StripPNG returns a copy of the PNG without any of its text or
+// EXIF chunks. PNGs have no standard place for a location so
+// rather than picking through them all of it goes.
+func StripPNG(png []byte) ([]byte, error) {
+	if !bytes.HasPrefix(png, pngSignature) {
+		return nil, errMalformed
+	}
+
+	out := make([]byte, 0, len(png))
+	out = append(out, pngSignature...)
+	i := len(pngSignature)
+	for i < len(png) {
+		// length, type and CRC are 4 bytes each
+		if i+12 > len(png) {
+			return nil, errMalformed
+		}
+		length := int(binary.BigEndian.Uint32(png[i : i+4]))
+		end := i + 12 + length
+		if length < 0 || end > len(png) {
+			return nil, errMalformed
+		}
+
+		typ := string(png[i+4 : i+8])
+		if !pngMetadataChunks[typ] {
+			out = append(out, png[i:end]...)
+		}
+		i = end
+
+		// anything after the end is ignored by decoders, so it
+		// isn't kept either
+		if typ == "IEND" {
+			break
+		}
+	}
+
+	return out, nil
+}
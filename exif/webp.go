@@ -0,0 +1,53 @@
+package exif
+
+import "encoding/binary"
+
+// flags in the VP8X chunk announcing the optional chunks that
+// follow, see the WebP container specification
+const (
+	webpFlagXMP  = 0x04
+	webpFlagEXIF = 0x08
+)
+
+// StripWebP returns a copy of the WebP without its EXIF and XMP
+// chunks
+func StripWebP(webp []byte) ([]byte, error) {
+	if len(webp) < 12 || string(webp[:4]) != "RIFF" || string(webp[8:12]) != "WEBP" {
+		return nil, errMalformed
+	}
+
+	out := make([]byte, 12, len(webp))
+	copy(out, webp[:12])
+	i := 12
+	for i+8 <= len(webp) {
+		fourCC := string(webp[i : i+4])
+		size := int(binary.LittleEndian.Uint32(webp[i+4 : i+8]))
+		// chunks are padded to an even size
+		end := i + 8 + size + size&1
+		if size < 0 || end > len(webp) {
+			// plenty of encoders leave the padding off the
+			// last chunk
+			if i+8+size != len(webp) {
+				return nil, errMalformed
+			}
+			end = len(webp)
+		}
+
+		switch fourCC {
+		case "EXIF", "XMP ":
+		case "VP8X":
+			if size < 1 {
+				return nil, errMalformed
+			}
+			flags := len(out) + 8
+			out = append(out, webp[i:end]...)
+			out[flags] &^= webpFlagEXIF | webpFlagXMP
+		default:
+			out = append(out, webp[i:end]...)
+		}
+		i = end
+	}
+
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, nil
+}
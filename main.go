@@ -1,31 +1,63 @@
 package main
 
 import (
-	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/arnoldokoth/lenslocked.com/config"
 	"github.com/arnoldokoth/lenslocked.com/controllers"
+	"github.com/arnoldokoth/lenslocked.com/dropbox"
 	"github.com/arnoldokoth/lenslocked.com/email"
 	"github.com/arnoldokoth/lenslocked.com/middleware"
 	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/oidc"
 	"github.com/arnoldokoth/lenslocked.com/rand"
+	"github.com/arnoldokoth/lenslocked.com/storage"
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
-	"golang.org/x/oauth2"
 )
 
 func main() {
-	cfg := LoadConfig()
+	cfg := config.LoadConfig()
+	store, err := cfg.Storage.NewStorage(cfg.HMACKey)
+	must(err)
+
+	mgCfg := cfg.Mailgun
+	emailer := email.NewClient(
+		email.WithMailgun(mgCfg.Domain, mgCfg.APIKey, mgCfg.PublicAPIKey),
+		email.WithSender("Lenslocked.com Support", fmt.Sprintf("support@%s", mgCfg.Domain)),
+		email.WithBaseURL(cfg.BaseURL),
+	)
+
+	userCfgs := []models.UserServiceConfig{
+		models.WithResetTTL(cfg.PwResetTTL()),
+		models.WithLockoutNotifier(func(user *models.User, until time.Time) {
+			emailer.Lockout(user.Name, user.EmailAddress, until)
+		}),
+	}
+	if cfg.LoginStore == "database" {
+		userCfgs = append(userCfgs, models.WithDBLoginAttempts())
+	}
+
 	dbConfig := cfg.Database
 	services, err := models.NewServices(
 		models.WithGorm(dbConfig.Dialect(), dbConfig.ConnString()),
 		models.WithLogMode(!cfg.IsProd()),
-		models.WithUser(cfg.HMACKey, cfg.Pepper),
+		models.WithUser(cfg.HMACKey, cfg.Pepper, userCfgs...),
+		models.WithSession(cfg.HMACKey),
+		models.WithImage(store, cfg.Uploads.Limits()),
 		models.WithGallery(),
-		models.WithImage(),
+		models.WithShareLink(cfg.HMACKey, cfg.Pepper),
+		models.WithAPIToken(cfg.HMACKey),
+		models.WithOAuth(cfg.EncryptionKey),
+		models.WithIdentity(),
+		models.WithTwoFactor(cfg.HMACKey, cfg.EncryptionKey),
+		models.WithExport(store, cfg.HMACKey),
+		models.WithAudit(),
+		models.WithAccountDeletion(cfg.AccountDeletionGrace()),
 	)
 	must(err)
 
@@ -33,75 +65,53 @@ func main() {
 
 	must(services.AutoMigrate())
 
-	mgCfg := cfg.Mailgun
-	emailer := email.NewClient(
-		email.WithMailgun(mgCfg.Domain, mgCfg.APIKey, mgCfg.PublicAPIKey),
-		email.WithSender("Lenslocked.com Support", fmt.Sprintf("support@%s", mgCfg.Domain)),
-	)
+	imported, err := services.Image.Reconcile()
+	if err != nil {
+		log.Println("Image Reconcile ERROR:", err)
+	} else if imported > 0 {
+		log.Printf("Imported %d Image(s) From Storage", imported)
+	}
+
+	go every(time.Hour, func() {
+		purgeDeletedAccounts(services.AccountDeletion, emailer)
+		deleteExpiredExports(services.Export)
+	})
 
 	router := mux.NewRouter()
 
-	dbxOAuth := &oauth2.Config{
-		ClientID:     cfg.Dropbox.ID,
-		ClientSecret: cfg.Dropbox.Secret,
-		Endpoint: oauth2.Endpoint{
-			AuthURL:  cfg.Dropbox.AuthURL,
-			TokenURL: cfg.Dropbox.TokenURL,
-		},
-		RedirectURL: "http://localhost:3000/oauth/dropbox/callback",
-	}
+	oauthConfigs := cfg.OAuthConfigs()
 
-	userMw := middleware.User{UserService: services.User}
+	userMw := middleware.User{
+		UserService:    services.User,
+		SessionService: services.Session,
+	}
 	requireUserMw := middleware.RequireUser{User: userMw}
+	apiTokenMw := middleware.APIToken{
+		UserService:     services.User,
+		APITokenService: services.APIToken,
+	}
+	requireVerifiedMw := middleware.RequireVerifiedUser{RequireUser: requireUserMw}
+	requireAPIUserMw := middleware.RequireAPIUser{User: userMw}
+	requireAdminMw := middleware.RequireAdmin{RequireUser: requireUserMw}
+	requireOwnerMw := middleware.RequireAccountOwner{RequireUser: requireUserMw}
 
 	bytes, _ := rand.Bytes(32)
 	csrfMw := csrf.Protect(bytes, csrf.Secure(cfg.IsProd()))
 
 	staticController := controllers.NewStatic()
-	usersController := controllers.NewUsers(services.User, emailer)
-	galleriesController := controllers.NewGalleries(services.Gallery, services.Image, router)
-
-	dbxRedirect := func(w http.ResponseWriter, r *http.Request) {
-		state := csrf.Token(r)
-		cookie := http.Cookie{
-			Name:     "oauth_state",
-			Value:    state,
-			HttpOnly: true,
-		}
-		http.SetCookie(w, &cookie)
-
-		fmt.Println("State:", state)
-		url := dbxOAuth.AuthCodeURL(state)
-		http.Redirect(w, r, url, http.StatusFound)
-	}
-
-	dbxCallback := func(w http.ResponseWriter, r *http.Request) {
-		r.ParseForm()
-		state := r.FormValue("state")
-		cookie, err := r.Cookie("oauth_state")
-		if err != nil {
-			http.Error(w, "Invalid State", http.StatusBadRequest)
-			return
-		} else if cookie == nil || cookie.Value != state {
-			http.Error(w, "Invalid State Provided", http.StatusBadRequest)
-			return
-		}
-		cookie.Value = ""
-		cookie.Expires = time.Now()
-		http.SetCookie(w, cookie)
-
-		code := r.FormValue("code")
-		token, err := dbxOAuth.Exchange(context.TODO(), code)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-		fmt.Fprintf(w, "%+v", token)
-	}
-
-	router.HandleFunc("/oauth/dropbox/callback", dbxCallback)
-
-	router.HandleFunc("/oauth/dropbox/connect", requireUserMw.ApplyFn(dbxRedirect)).Methods("GET")
+	usersController := controllers.NewUsers(services.User, services.Session, services.APIToken, services.TwoFactor, emailer)
+	adminController := controllers.NewAdmin(services.User, services.Session, services.Gallery, services.Audit)
+	exportsController := controllers.NewExports(services.Export, emailer)
+	accountController := controllers.NewAccount(services.User, services.Session, services.APIToken,
+		services.AccountDeletion, services.Audit, emailer)
+	galleriesController := controllers.NewGalleries(services.Gallery, services.Image, services.ShareLink, router)
+	apiController := controllers.NewAPI(services.Gallery, services.Image)
+	apiTokensController := controllers.NewAPITokens(services.APIToken)
+	oauthsController := controllers.NewOAuths(services.OAuth, oauthConfigs)
+	dropboxController := controllers.NewDropbox(services.Gallery, services.Image, services.OAuth,
+		oauthConfigs[models.OAuthDropbox], dropboxClientConfigs(cfg.OAuthProviders()[models.OAuthDropbox])...)
+	oidcController := controllers.NewOIDC(usersController, services.Identity, oidcProviders(cfg))
+	usersController.LoginProviders = oidcController.LoginProviders()
 
 	// Static Routes
 	router.Handle("/", staticController.Home).Methods("GET")
@@ -114,27 +124,165 @@ func main() {
 	// User Routes
 	router.HandleFunc("/signup", usersController.New).Methods("GET")
 	router.HandleFunc("/signup", usersController.Create).Methods("POST")
-	router.Handle("/login", usersController.LoginView).Methods("GET")
+	router.HandleFunc("/login", usersController.LoginPage).Methods("GET")
 	router.HandleFunc("/login", usersController.Login).Methods("POST")
+	router.HandleFunc("/2fa", usersController.TwoFactorLogin).Methods("GET")
+	router.HandleFunc("/2fa", usersController.CompleteTwoFactorLogin).Methods("POST")
+	router.HandleFunc("/login/{provider}", oidcController.Login).Methods("GET")
+	router.HandleFunc("/login/{provider}/callback", oidcController.Callback).Methods("GET")
 	router.HandleFunc("/logout", requireUserMw.ApplyFn(usersController.Logout)).Methods("POST")
+	router.Handle("/forgot", usersController.ForgotPwView).Methods("GET")
+	router.HandleFunc("/forgot", usersController.InitiateReset).Methods("POST")
+	router.HandleFunc("/reset", usersController.ResetPw).Methods("GET")
+	router.HandleFunc("/reset", usersController.CompleteReset).Methods("POST")
+	router.HandleFunc("/verify", usersController.Verify).Methods("GET")
+	router.HandleFunc("/verify/resend", requireUserMw.ApplyFn(usersController.ResendVerification)).Methods("POST")
+	router.HandleFunc("/account", requireUserMw.ApplyFn(accountController.Settings)).Methods("GET")
+	router.HandleFunc("/account/name", requireUserMw.ApplyFn(accountController.UpdateName)).Methods("POST")
+	router.HandleFunc("/account/email", requireOwnerMw.ApplyFn(accountController.UpdateEmail)).Methods("POST")
+	router.HandleFunc("/account/password", requireOwnerMw.ApplyFn(accountController.UpdatePassword)).Methods("POST")
+	router.HandleFunc("/account/delete", requireOwnerMw.ApplyFn(accountController.Delete)).Methods("POST")
+	router.HandleFunc("/account/delete/cancel", requireUserMw.ApplyFn(accountController.CancelDelete)).Methods("POST")
+	router.HandleFunc("/account/activity", requireUserMw.ApplyFn(accountController.Activity)).Methods("GET")
+	router.HandleFunc("/account/export", requireUserMw.ApplyFn(exportsController.Index)).Methods("GET")
+	router.HandleFunc("/account/export", requireUserMw.ApplyFn(exportsController.Create)).Methods("POST")
+	router.HandleFunc("/account/export/download", requireUserMw.ApplyFn(exportsController.Download)).Methods("GET")
+	router.HandleFunc("/account/sessions", requireUserMw.ApplyFn(usersController.Sessions)).Methods("GET")
+	router.HandleFunc("/account/sessions/{id:[0-9]+}/revoke", requireUserMw.ApplyFn(usersController.RevokeSession)).Methods("POST")
+	router.HandleFunc("/account/privacy", requireUserMw.ApplyFn(usersController.Privacy)).Methods("GET")
+	router.HandleFunc("/account/privacy", requireUserMw.ApplyFn(usersController.UpdatePrivacy)).Methods("POST")
+	router.HandleFunc("/account/2fa", requireUserMw.ApplyFn(usersController.TwoFactor)).Methods("GET")
+	router.HandleFunc("/account/2fa/setup", requireOwnerMw.ApplyFn(usersController.EnrollTwoFactor)).Methods("POST")
+	router.HandleFunc("/account/2fa/enable", requireOwnerMw.ApplyFn(usersController.EnableTwoFactor)).Methods("POST")
+	router.HandleFunc("/account/2fa/recovery", requireOwnerMw.ApplyFn(usersController.RegenerateRecoveryCodes)).Methods("POST")
+	router.HandleFunc("/account/2fa/disable", requireOwnerMw.ApplyFn(usersController.DisableTwoFactor)).Methods("POST")
+	router.HandleFunc("/account/tokens", requireUserMw.ApplyFn(apiTokensController.Index)).Methods("GET")
+	router.HandleFunc("/account/tokens", requireOwnerMw.ApplyFn(apiTokensController.Create)).Methods("POST")
+	router.HandleFunc("/account/tokens/{id:[0-9]+}/revoke", requireUserMw.ApplyFn(apiTokensController.Revoke)).Methods("POST")
+
+	// Admin Routes
+	router.HandleFunc("/admin", requireAdminMw.ApplyFn(adminController.Dashboard)).Methods("GET")
+	router.HandleFunc("/admin/users", requireAdminMw.ApplyFn(adminController.Users)).Methods("GET")
+	router.HandleFunc("/admin/users/{id:[0-9]+}/disable", requireAdminMw.ApplyFn(adminController.DisableUser)).Methods("POST")
+	router.HandleFunc("/admin/users/{id:[0-9]+}/enable", requireAdminMw.ApplyFn(adminController.EnableUser)).Methods("POST")
+	router.HandleFunc("/admin/users/{id:[0-9]+}/impersonate", requireAdminMw.ApplyFn(adminController.Impersonate)).Methods("POST")
+	router.HandleFunc("/admin/impersonate/stop", requireUserMw.ApplyFn(adminController.StopImpersonating)).Methods("POST")
+	router.HandleFunc("/admin/audit", requireAdminMw.ApplyFn(adminController.Audit)).Methods("GET")
+	router.HandleFunc("/admin/galleries", requireAdminMw.ApplyFn(adminController.Galleries)).Methods("GET")
+	router.HandleFunc("/admin/galleries/{id:[0-9]+}/delete", requireAdminMw.ApplyFn(adminController.DeleteGallery)).Methods("POST")
+
+	// OAuth Routes
+	router.HandleFunc("/oauth/{service}/connect", requireUserMw.ApplyFn(oauthsController.Connect)).Methods("GET")
+	router.HandleFunc("/oauth/{service}/callback", requireUserMw.ApplyFn(oauthsController.Callback)).Methods("GET")
 
 	// Gallery Routes
 	router.HandleFunc("/galleries", requireUserMw.ApplyFn(galleriesController.Index)).Methods("GET")
-	router.Handle("/galleries/new", requireUserMw.Apply(galleriesController.CreateView)).Methods("GET")
-	router.HandleFunc("/galleries/new", requireUserMw.ApplyFn(galleriesController.Create)).Methods("POST")
-	router.HandleFunc("/galleries/{id:[0-9]+}", requireUserMw.ApplyFn(galleriesController.Show)).Methods("GET").Name("show_gallery")
+	router.Handle("/galleries/new", requireVerifiedMw.Apply(galleriesController.CreateView)).Methods("GET")
+	router.HandleFunc("/galleries/new", requireVerifiedMw.ApplyFn(galleriesController.Create)).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}", galleriesController.Show).Methods("GET").Name("show_gallery")
+	router.HandleFunc("/galleries/{id:[0-9]+}/download", galleriesController.Download).Methods("GET")
+	router.HandleFunc("/g/{slug}", galleriesController.ShowBySlug).Methods("GET")
+	router.HandleFunc("/g/{slug}/download", galleriesController.DownloadBySlug).Methods("GET")
 	router.HandleFunc("/galleries/{id:[0-9]+}/edit", requireUserMw.ApplyFn(galleriesController.Edit)).Methods("GET").Name("edit_gallery")
 	router.HandleFunc("/galleries/{id:[0-9]+}/update", requireUserMw.ApplyFn(galleriesController.Update)).Methods("POST")
 	router.HandleFunc("/galleries/{id:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesController.Delete)).Methods("POST")
 	router.HandleFunc("/galleries/{id:[0-9]+}/images", requireUserMw.ApplyFn(galleriesController.Upload)).Methods("POST")
-	router.HandleFunc("/galleries/{id:[0-9]+}/images/{filename}/delete", requireUserMw.ApplyFn(galleriesController.ImageDelete)).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/update", requireUserMw.ApplyFn(galleriesController.ImageUpdate)).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesController.ImageDelete)).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/images/dropbox", requireUserMw.ApplyFn(dropboxController.Picker)).Methods("GET")
+	router.HandleFunc("/galleries/{id:[0-9]+}/images/dropbox", requireUserMw.ApplyFn(dropboxController.Import)).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/share", requireUserMw.ApplyFn(galleriesController.ShareCreate)).Methods("POST")
+	router.HandleFunc("/galleries/{id:[0-9]+}/share/{linkID:[0-9]+}/delete", requireUserMw.ApplyFn(galleriesController.ShareDelete)).Methods("POST")
+	router.HandleFunc("/s/{token}", galleriesController.Shared).Methods("GET")
+	router.HandleFunc("/s/{token}", galleriesController.SharedUnlock).Methods("POST")
+	router.HandleFunc("/s/{token}/download", galleriesController.SharedDownload).Methods("GET")
+
+	// API Routes
+	api := router.PathPrefix("/api/v1").Subrouter()
+	api.HandleFunc("/galleries", requireAPIUserMw.ApplyFn(apiController.Galleries)).Methods("GET")
+	api.HandleFunc("/galleries", requireAPIUserMw.ApplyFn(apiController.GalleryCreate)).Methods("POST")
+	api.HandleFunc("/galleries/{id:[0-9]+}", requireAPIUserMw.ApplyFn(apiController.Gallery)).Methods("GET")
+	api.HandleFunc("/galleries/{id:[0-9]+}", requireAPIUserMw.ApplyFn(apiController.GalleryUpdate)).Methods("PATCH")
+	api.HandleFunc("/galleries/{id:[0-9]+}", requireAPIUserMw.ApplyFn(apiController.GalleryDelete)).Methods("DELETE")
+	api.HandleFunc("/galleries/{id:[0-9]+}/images", requireAPIUserMw.ApplyFn(apiController.Images)).Methods("GET")
+	api.HandleFunc("/galleries/{id:[0-9]+}/images", requireAPIUserMw.ApplyFn(apiController.ImageUpload)).Methods("POST")
+	api.HandleFunc("/galleries/{id:[0-9]+}/images/{imageID:[0-9]+}", requireAPIUserMw.ApplyFn(apiController.ImageDelete)).Methods("DELETE")
 
 	// Image Routes
-	imageHandler := http.FileServer(http.Dir("./images"))
-	router.PathPrefix("/images/").Handler(http.StripPrefix("/images/", imageHandler))
+	if localStore, ok := store.(*storage.Local); ok {
+		// images are only served through the signed URLs handed
+		// out on pages the viewer is allowed to see, exports are
+		// downloaded through the app by their owner
+		router.PathPrefix("/images/galleries/").Handler(http.StripPrefix("/images/", localStore))
+	}
 
 	log.Printf("Server Running On Port: %d", cfg.Port)
-	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), csrfMw(userMw.Apply(router)))
+	http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), apiTokenMw.Apply(csrfMw(userMw.Apply(router))))
+}
+
+func dropboxClientConfigs(cfg config.OAuthConfig) []dropbox.ClientConfig {
+	var cfgs []dropbox.ClientConfig
+	if cfg.APIURL != "" {
+		cfgs = append(cfgs, dropbox.WithAPIURL(cfg.APIURL))
+	}
+	if cfg.ContentURL != "" {
+		cfgs = append(cfgs, dropbox.WithContentURL(cfg.ContentURL))
+	}
+
+	return cfgs
+}
+
+func oidcProviders(cfg config.Config) map[string]*controllers.OIDCProvider {
+	providers := make(map[string]*controllers.OIDCProvider)
+	for name, provider := range cfg.OIDC {
+		displayName := provider.DisplayName
+		if displayName == "" {
+			displayName = strings.Title(name)
+		}
+		providers[name] = &controllers.OIDCProvider{
+			DisplayName: displayName,
+			Provider:    oidc.NewProvider(provider.Issuer, nil),
+			Config:      cfg.OIDCClientConfig(name, provider),
+			AllowSignup: provider.AllowSignup,
+		}
+	}
+
+	return providers
+}
+
+// every runs fn straight away and then every d, forever
+func every(d time.Duration, fn func()) {
+	for {
+		fn()
+		time.Sleep(d)
+	}
+}
+
+// purgeDeletedAccounts permanently deletes the accounts whose
+// grace period is over
+func purgeDeletedAccounts(ads models.AccountDeletionService, emailer *email.Client) {
+	users, err := ads.Due(time.Now())
+	if err != nil {
+		log.Println("Account Purge ERROR:", err)
+		return
+	}
+	for i := range users {
+		user := users[i]
+		if err := ads.Purge(&user); err != nil {
+			log.Println("Account Purge ERROR:", err)
+			continue
+		}
+		go emailer.AccountDeleted(user.Name, user.EmailAddress)
+	}
+}
+
+func deleteExpiredExports(es models.ExportService) {
+	deleted, err := es.DeleteExpired()
+	if err != nil {
+		log.Println("Export Cleanup ERROR:", err)
+	} else if deleted > 0 {
+		log.Printf("Deleted %d Expired Export(s)", deleted)
+	}
 }
 
 func must(err error) {
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/gorilla/csrf"
+)
+
+// tokenTouchInterval limits how often a token's last used
+// time is written back to the database
+const tokenTouchInterval = time.Minute
+
+// APIToken signs in API requests that carry an
+// Authorization: Bearer header. It has to run before
+// csrf.Protect because scripts have no CSRF token to send,
+// which is fine as browsers never add the header by themselves.
+type APIToken struct {
+	models.UserService
+	models.APITokenService
+}
+
+// Apply ...
+func (mw *APIToken) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn ...
+func (mw *APIToken) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(r.URL.Path, "/api/") || auth == "" {
+			next(w, r)
+			return
+		}
+
+		const prefix = "Bearer "
+		if !strings.HasPrefix(auth, prefix) {
+			writeJSONError(w, http.StatusUnauthorized, "Authorization Header Must Be A Bearer Token")
+			return
+		}
+
+		token, err := mw.APITokenService.ByToken(strings.TrimSpace(auth[len(prefix):]))
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, "Invalid API Token")
+			return
+		}
+
+		scope := models.ScopeWrite
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			scope = models.ScopeRead
+		}
+		if !token.HasScope(scope) {
+			writeJSONError(w, http.StatusForbidden, "This Token Is Missing The "+strings.Title(scope)+" Scope")
+			return
+		}
+
+		user, err := mw.UserService.ByID(token.UserID)
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, "Invalid API Token")
+			return
+		}
+		if user.IsDisabled() {
+			writeJSONError(w, http.StatusForbidden, "This Account Has Been Disabled")
+			return
+		}
+
+		if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > tokenTouchInterval {
+			now := time.Now()
+			token.LastUsedAt = &now
+			mw.APITokenService.Update(token)
+		}
+
+		ctx := r.Context()
+		ctx = context.WithUser(ctx, user)
+		ctx = context.WithAPIToken(ctx, token)
+		r = r.WithContext(ctx)
+
+		next(w, csrf.UnsafeSkipCheck(r))
+	})
+}
@@ -1,16 +1,24 @@
 package middleware
 
 import (
+	"encoding/json"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/arnoldokoth/lenslocked.com/context"
 	"github.com/arnoldokoth/lenslocked.com/models"
+	"github.com/arnoldokoth/lenslocked.com/views"
 )
 
+// sessionTouchInterval limits how often a session's
+// last seen time is written back to the database
+const sessionTouchInterval = time.Minute
+
 // User ...
 type User struct {
 	models.UserService
+	models.SessionService
 }
 
 // Apply ...
@@ -25,20 +33,43 @@ func (mw *User) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 			next(w, r)
 			return
 		}
-		cookie, err := r.Cookie("remember_token")
+		// already signed in e.g. with an API token
+		if context.User(r.Context()) != nil {
+			next(w, r)
+			return
+		}
+		cookie, err := r.Cookie("session_token")
 		if err != nil {
 			next(w, r)
 			return
 		}
 
-		user, err := mw.UserService.ByRemember(cookie.Value)
+		session, err := mw.SessionService.ByToken(cookie.Value)
 		if err != nil {
 			next(w, r)
 			return
 		}
 
+		user, err := mw.UserService.ByID(session.UserID)
+		if err != nil {
+			next(w, r)
+			return
+		}
+		// admins can still look into a disabled account while
+		// helping its owner
+		if user.IsDisabled() && !session.IsImpersonation() {
+			next(w, r)
+			return
+		}
+
+		if time.Since(session.LastSeenAt) > sessionTouchInterval {
+			session.LastSeenAt = time.Now()
+			mw.SessionService.Update(session)
+		}
+
 		ctx := r.Context()
 		ctx = context.WithUser(ctx, user)
+		ctx = context.WithSession(ctx, session)
 		r = r.WithContext(ctx)
 
 		next(w, r)
@@ -66,3 +97,121 @@ func (mw *RequireUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
 		next(w, r)
 	}))
 }
+
+// RequireAdmin only lets through signed in admins. Everyone
+// else gets a 404 so the admin area isn't advertised.
+type RequireAdmin struct {
+	RequireUser
+}
+
+// Apply ...
+func (mw *RequireAdmin) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn ...
+func (mw *RequireAdmin) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if !user.IsAdmin() {
+			http.NotFound(w, r)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// RequireVerifiedUser only lets through signed in users
+// who have verified their email address
+type RequireVerifiedUser struct {
+	RequireUser
+}
+
+// Apply ...
+func (mw *RequireVerifiedUser) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn ...
+func (mw *RequireVerifiedUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if !user.IsVerified() {
+			alert := views.Alert{
+				Level:   views.AlertLvlWarning,
+				Message: "Please Verify Your Email Address Before Creating Galleries.",
+			}
+			views.RedirectAlert(w, r, "/galleries", http.StatusFound, alert)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// RequireAccountOwner only lets through users signed in as
+// themselves. Admins impersonating a user can look around but
+// can't change how the account is signed in to, anything they
+// set up would outlive the impersonation.
+type RequireAccountOwner struct {
+	RequireUser
+}
+
+// Apply ...
+func (mw *RequireAccountOwner) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn ...
+func (mw *RequireAccountOwner) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.RequireUser.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+		session := context.Session(r.Context())
+		if session != nil && session.IsImpersonation() {
+			alert := views.Alert{
+				Level:   views.AlertLvlError,
+				Message: "Admins Can't Change A User's Sign In Details Or Delete Their Account.",
+			}
+			views.RedirectAlert(w, r, "/account", http.StatusFound, alert)
+			return
+		}
+		next(w, r)
+	})
+}
+
+// RequireAPIUser is RequireUser for the JSON API, visitors
+// who aren't signed in get a 401 instead of a redirect
+type RequireAPIUser struct {
+	User
+}
+
+// Apply ...
+func (mw *RequireAPIUser) Apply(next http.Handler) http.HandlerFunc {
+	return mw.ApplyFn(next.ServeHTTP)
+}
+
+// ApplyFn ...
+func (mw *RequireAPIUser) ApplyFn(next http.HandlerFunc) http.HandlerFunc {
+	return mw.User.Apply(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := context.User(r.Context())
+		if user == nil {
+			writeJSONError(w, http.StatusUnauthorized, "Authentication Required")
+			return
+		}
+		next(w, r)
+	}))
+}
+
+// writeJSONError responds in the same format as the API
+// controller's errors
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	var body struct {
+		Error struct {
+			Status  int    `json:"status"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body.Error.Status = status
+	body.Error.Message = message
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/arnoldokoth/lenslocked.com/context"
+	"github.com/arnoldokoth/lenslocked.com/models"
+)
+
+func TestRequireAccountOwner(t *testing.T) {
+	user := &models.User{}
+	user.ID = 1
+
+	tests := []struct {
+		name    string
+		session *models.Session
+		called  bool
+	}{
+		{"the user", &models.Session{UserID: 1}, true},
+		{"an impersonating admin", &models.Session{UserID: 1, ImpersonatorID: 9}, false},
+	}
+
+	var mw RequireAccountOwner
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := mw.ApplyFn(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/account/tokens", nil)
+			ctx := context.WithUser(r.Context(), user)
+			ctx = context.WithSession(ctx, tt.session)
+			w := httptest.NewRecorder()
+			handler(w, r.WithContext(ctx))
+
+			if called != tt.called {
+				t.Errorf("handler called = %v, want %v", called, tt.called)
+			}
+			if !tt.called && (w.Code != http.StatusFound || w.Header().Get("Location") != "/account") {
+				t.Errorf("response = %d to %q, want a redirect to /account", w.Code, w.Header().Get("Location"))
+			}
+		})
+	}
+}
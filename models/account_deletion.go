@@ -0,0 +1,161 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// AccountDeletionService deletes the accounts of users who ask
+// for it. Nothing is removed straight away, the account is
+// scheduled for deletion and only purged once the grace period
+// is over so the user can change their mind.
+type AccountDeletionService interface {
+	// Schedule marks the user's account for deletion once the
+	// grace period is over
+	Schedule(user *User) error
+	// Cancel stops a scheduled deletion
+	Cancel(user *User) error
+	// Grace returns how long users have to cancel
+	Grace() time.Duration
+
+	// Due returns the users whose grace period is over
+	Due(now time.Time) ([]User, error)
+	// Purge permanently deletes the user along with their
+	// galleries, image files, sessions and tokens
+	Purge(user *User) error
+}
+
+// NewAccountDeletionService ...
+func NewAccountDeletionService(db *gorm.DB, is ImageService, es ExportService, grace time.Duration) AccountDeletionService {
+	return &accountDeletionService{
+		db:    db,
+		is:    is,
+		es:    es,
+		grace: grace,
+	}
+}
+
+type accountDeletionService struct {
+	db    *gorm.DB
+	is    ImageService
+	es    ExportService
+	grace time.Duration
+}
+
+func (ads *accountDeletionService) Schedule(user *User) error {
+	if user.IsDeletionScheduled() {
+		return ErrDeletionScheduled
+	}
+
+	deleteAfter := time.Now().Add(ads.grace)
+	err := ads.db.Model(user).UpdateColumn("delete_after", deleteAfter).Error
+	if err != nil {
+		return err
+	}
+	user.DeleteAfter = &deleteAfter
+
+	return nil
+}
+
+func (ads *accountDeletionService) Cancel(user *User) error {
+	if !user.IsDeletionScheduled() {
+		return ErrDeletionNotScheduled
+	}
+
+	err := ads.db.Model(user).UpdateColumn("delete_after", gorm.Expr("NULL")).Error
+	if err != nil {
+		return err
+	}
+	user.DeleteAfter = nil
+
+	return nil
+}
+
+func (ads *accountDeletionService) Grace() time.Duration {
+	return ads.grace
+}
+
+func (ads *accountDeletionService) Due(now time.Time) ([]User, error) {
+	var users []User
+	err := ads.db.Where("delete_after IS NOT NULL AND delete_after <= ?", now).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// Purge removes the image files and exports first so a storage failure
+// leaves the account in place to be tried again, rather than
+// files nothing points at any more. Everything is deleted
+// unscoped, including galleries that were already deleted,
+// so nothing of the user is left behind.
+func (ads *accountDeletionService) Purge(user *User) error {
+	if user.ID <= 0 {
+		return ErrInvalidID
+	}
+
+	var galleries []Gallery
+	err := ads.db.Unscoped().Where("user_id = ?", user.ID).Find(&galleries).Error
+	if err != nil {
+		return err
+	}
+
+	galleryIDs := make([]uint, 0, len(galleries))
+	for _, gallery := range galleries {
+		if err := ads.is.DeleteByGalleryID(gallery.ID); err != nil {
+			return fmt.Errorf("models: deleting images of gallery %d: %v", gallery.ID, err)
+		}
+		galleryIDs = append(galleryIDs, gallery.ID)
+	}
+	if err := ads.es.DeleteByUserID(user.ID); err != nil {
+		return fmt.Errorf("models: deleting exports: %v", err)
+	}
+
+	tx := ads.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	type purge struct {
+		where string
+		arg   interface{}
+		value interface{}
+	}
+	var purges []purge
+	if len(galleryIDs) > 0 {
+		purges = append(purges, purge{"gallery_id IN (?)", galleryIDs, &ShareLink{}})
+	}
+	purges = append(purges, []purge{
+		{"user_id = ?", user.ID, &Image{}},
+		{"user_id = ?", user.ID, &Gallery{}},
+		{"user_id = ?", user.ID, &Session{}},
+		{"user_id = ?", user.ID, &APIToken{}},
+		{"user_id = ?", user.ID, &OAuth{}},
+		{"user_id = ?", user.ID, &Identity{}},
+		{"user_id = ?", user.ID, &RecoveryCode{}},
+		{"user_id = ?", user.ID, &twoFactorChallenge{}},
+		{"user_id = ?", user.ID, &pwReset{}},
+		{"key = ?", emailLoginKey(user.EmailAddress), &LoginAttempt{}},
+		{"key = ?", twoFactorLoginKey(user.ID), &LoginAttempt{}},
+		{"key = ?", passwordCheckKey(user.ID), &LoginAttempt{}},
+		{"id = ?", user.ID, &User{}},
+	}...)
+	for _, p := range purges {
+		if err := tx.Unscoped().Where(p.where, p.arg).Delete(p.value).Error; err != nil {
+			tx.Rollback()
+			return fmt.Errorf("models: purging user %d: %v", user.ID, err)
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	log.Printf("account deletion: purged user %d and %d galleries", user.ID, len(galleries))
+
+	return nil
+}
@@ -0,0 +1,275 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/hash"
+	"github.com/arnoldokoth/lenslocked.com/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// Scopes an API token can be granted
+const (
+	// ScopeRead lets a token look at the user's galleries and
+	// images
+	ScopeRead = "read"
+	// ScopeWrite lets a token create, change and delete them
+	ScopeWrite = "write"
+)
+
+// APIToken is a personal token scripts use to call the API on
+// a user's behalf. Like sessions only the HMAC of the token is
+// stored, the user sees the raw token once when it's created.
+type APIToken struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Name       string `gorm:"not null"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	Scopes     string `gorm:"not null"`
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+// HasScope reports whether the token was granted scope. Write
+// access implies read access.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range strings.Fields(t.Scopes) {
+		if s == scope || (s == ScopeWrite && scope == ScopeRead) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsRevoked ...
+func (t *APIToken) IsRevoked() bool {
+	return t.RevokedAt != nil
+}
+
+// APITokenDB ...
+type APITokenDB interface {
+	// ByToken only returns tokens that haven't been revoked
+	ByToken(token string) (*APIToken, error)
+	ByUserID(userID uint) ([]APIToken, error)
+
+	Create(token *APIToken) error
+	Update(token *APIToken) error
+	// Revoke stops the token from working but keeps it around
+	// so the user can still see it was used
+	Revoke(id uint) error
+	// RevokeByUserID revokes every token the user has
+	RevokeByUserID(userID uint) error
+}
+
+// APITokenService ...
+type APITokenService interface {
+	APITokenDB
+}
+
+// NewAPITokenService ...
+func NewAPITokenService(db *gorm.DB, hmacKey string) APITokenService {
+	return &apiTokenService{
+		APITokenDB: &apiTokenValidator{
+			hmac:       hash.NewHMAC(hmacKey),
+			APITokenDB: &apiTokenGorm{db},
+		},
+	}
+}
+
+type apiTokenService struct {
+	APITokenDB
+}
+
+type apiTokenValFunc func(*APIToken) error
+
+func runAPITokenValFuncs(token *APIToken, fns ...apiTokenValFunc) error {
+	for _, fn := range fns {
+		if err := fn(token); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type apiTokenValidator struct {
+	APITokenDB
+	hmac hash.HMAC
+}
+
+var _ APITokenDB = &apiTokenValidator{}
+
+func (tv *apiTokenValidator) requireUserID(token *APIToken) error {
+	if token.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (tv *apiTokenValidator) requireName(token *APIToken) error {
+	token.Name = strings.TrimSpace(token.Name)
+	if token.Name == "" {
+		return ErrTokenNameRequired
+	}
+
+	return nil
+}
+
+// normalizeScopes drops duplicate scopes and rejects any we
+// don't know about
+func (tv *apiTokenValidator) normalizeScopes(token *APIToken) error {
+	var scopes []string
+	seen := make(map[string]bool)
+	for _, s := range strings.Fields(strings.Replace(token.Scopes, ",", " ", -1)) {
+		s = strings.ToLower(s)
+		switch s {
+		case ScopeRead, ScopeWrite:
+		default:
+			return ErrScopeInvalid
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+
+	if len(scopes) == 0 {
+		return ErrScopeInvalid
+	}
+	token.Scopes = strings.Join(scopes, " ")
+
+	return nil
+}
+
+func (tv *apiTokenValidator) setTokenIfUnset(token *APIToken) error {
+	if token.Token != "" {
+		return nil
+	}
+
+	raw, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	token.Token = raw
+	return nil
+}
+
+func (tv *apiTokenValidator) hmacToken(token *APIToken) error {
+	if token.Token == "" {
+		return nil
+	}
+
+	token.TokenHash = tv.hmac.Hash(token.Token)
+	return nil
+}
+
+func (tv *apiTokenValidator) idGreaterThanZero(token *APIToken) error {
+	if token.ID <= 0 {
+		return ErrInvalidID
+	}
+
+	return nil
+}
+
+func (tv *apiTokenValidator) ByToken(raw string) (*APIToken, error) {
+	token := APIToken{Token: raw}
+	err := runAPITokenValFuncs(&token, tv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return tv.APITokenDB.ByToken(token.TokenHash)
+}
+
+func (tv *apiTokenValidator) ByUserID(userID uint) ([]APIToken, error) {
+	if userID <= 0 {
+		return nil, ErrUserIDRequired
+	}
+
+	return tv.APITokenDB.ByUserID(userID)
+}
+
+func (tv *apiTokenValidator) Create(token *APIToken) error {
+	err := runAPITokenValFuncs(token, tv.requireUserID, tv.requireName,
+		tv.normalizeScopes, tv.setTokenIfUnset, tv.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return tv.APITokenDB.Create(token)
+}
+
+func (tv *apiTokenValidator) Update(token *APIToken) error {
+	err := runAPITokenValFuncs(token, tv.idGreaterThanZero, tv.requireUserID,
+		tv.requireName, tv.normalizeScopes)
+	if err != nil {
+		return err
+	}
+
+	return tv.APITokenDB.Update(token)
+}
+
+func (tv *apiTokenValidator) Revoke(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+
+	return tv.APITokenDB.Revoke(id)
+}
+
+func (tv *apiTokenValidator) RevokeByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return tv.APITokenDB.RevokeByUserID(userID)
+}
+
+var _ APITokenDB = &apiTokenGorm{}
+
+type apiTokenGorm struct {
+	db *gorm.DB
+}
+
+func (tg *apiTokenGorm) ByToken(tokenHash string) (*APIToken, error) {
+	var token APIToken
+	db := tg.db.Where("token_hash = ? AND revoked_at IS NULL", tokenHash)
+	err := first(db, &token)
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (tg *apiTokenGorm) ByUserID(userID uint) ([]APIToken, error) {
+	var tokens []APIToken
+	err := tg.db.Where("user_id = ?", userID).Order("id desc").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (tg *apiTokenGorm) Create(token *APIToken) error {
+	return tg.db.Create(token).Error
+}
+
+func (tg *apiTokenGorm) Update(token *APIToken) error {
+	return tg.db.Save(token).Error
+}
+
+func (tg *apiTokenGorm) Revoke(id uint) error {
+	return tg.db.Model(&APIToken{}).Where("id = ? AND revoked_at IS NULL", id).
+		UpdateColumn("revoked_at", time.Now()).Error
+}
+
+func (tg *apiTokenGorm) RevokeByUserID(userID uint) error {
+	return tg.db.Model(&APIToken{}).Where("user_id = ? AND revoked_at IS NULL", userID).
+		UpdateColumn("revoked_at", time.Now()).Error
+}
@@ -0,0 +1,275 @@
+package models
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Audit actions recorded by the services
+const (
+	AuditLogin          = "user.login"
+	AuditLoginFailed    = "user.login_failed"
+	AuditPasswordChange = "user.password_change"
+	AuditLogout         = "user.logout"
+
+	AuditGalleryCreate = "gallery.create"
+	AuditGalleryUpdate = "gallery.update"
+	AuditGalleryDelete = "gallery.delete"
+
+	AuditImageUpload = "image.upload"
+	AuditImageUpdate = "image.update"
+	AuditImageDelete = "image.delete"
+)
+
+// Audit actions taken by admins
+const (
+	AuditAdminDisableUser       = "admin.user.disable"
+	AuditAdminEnableUser        = "admin.user.enable"
+	AuditAdminResetPassword     = "admin.user.reset_password"
+	AuditAdminImpersonate       = "admin.user.impersonate"
+	AuditAdminStopImpersonating = "admin.user.impersonate_stop"
+	AuditAdminDeleteGallery     = "admin.gallery.delete"
+)
+
+// Audit target types
+const (
+	AuditTargetUser    = "user"
+	AuditTargetGallery = "gallery"
+	AuditTargetImage   = "image"
+)
+
+// Actor is who is making a change and from where. The services
+// returned by As record it against the audit events they write,
+// the zero Actor is the application itself.
+type Actor struct {
+	UserID uint
+	// OnBehalfOfID is the user an admin is signed in as while
+	// impersonating them, UserID is then the admin
+	OnBehalfOfID uint
+	IPAddress    string
+	UserAgent    string
+}
+
+// AuditEvent records who did what to what. Events are only ever
+// added, there is no way to change or remove one, so it has no
+// UpdatedAt or DeletedAt.
+type AuditEvent struct {
+	ID        uint      `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"not null;index"`
+	// ActorID is the user who did it, or 0 if nobody was
+	// signed in
+	ActorID uint `gorm:"not null;default:0;index"`
+	// OnBehalfOfID is the user whose account the actor was
+	// signed in as, so it still shows up in their activity
+	OnBehalfOfID uint   `gorm:"not null;default:0;index"`
+	Action       string `gorm:"not null;index"`
+	TargetType   string
+	TargetID     uint `gorm:"not null;default:0"`
+	IPAddress    string
+	UserAgent    string
+	// Detail is anything else worth knowing e.g. the title of a
+	// deleted gallery
+	Detail string
+}
+
+// auditDescriptions are how actions are shown to the user they
+// were done by or to
+var auditDescriptions = map[string]string{
+	AuditLogin:          "Signed in",
+	AuditLoginFailed:    "Failed sign in attempt",
+	AuditPasswordChange: "Changed password",
+	AuditLogout:         "Signed out",
+	AuditGalleryCreate:  "Created a gallery",
+	AuditGalleryUpdate:  "Updated a gallery",
+	AuditGalleryDelete:  "Deleted a gallery",
+	AuditImageUpload:    "Uploaded an image",
+	AuditImageUpdate:    "Updated an image",
+	AuditImageDelete:    "Deleted an image",
+
+	AuditAdminDisableUser:       "Account disabled by an admin",
+	AuditAdminEnableUser:        "Account enabled by an admin",
+	AuditAdminResetPassword:     "Password reset by an admin",
+	AuditAdminImpersonate:       "An admin signed in as you",
+	AuditAdminStopImpersonating: "An admin stopped signing in as you",
+	AuditAdminDeleteGallery:     "Gallery deleted by an admin",
+}
+
+// Description is the action in words, falling back to the
+// action itself for ones without a description
+func (e *AuditEvent) Description() string {
+	if description, ok := auditDescriptions[e.Action]; ok {
+		return description
+	}
+
+	return e.Action
+}
+
+// AuditQuery narrows down the events Search returns, fields
+// left empty match everything
+type AuditQuery struct {
+	ActorID uint
+	// UserID matches events the user did, that an admin did
+	// signed in as them, or that were done to them, such as
+	// failed logins to their account
+	UserID uint
+	// Action matches events whose action starts with it, so
+	// "admin." finds everything admins did
+	Action     string
+	TargetType string
+	TargetID   uint
+	Limit      int
+}
+
+// AuditDB ...
+type AuditDB interface {
+	Create(event *AuditEvent) error
+	// Search returns the events matching query, newest first
+	Search(query AuditQuery) ([]AuditEvent, error)
+}
+
+// AuditService ...
+type AuditService interface {
+	AuditDB
+}
+
+// NewAuditService ...
+func NewAuditService(db *gorm.DB) AuditService {
+	return &auditService{
+		AuditDB: &auditValidator{
+			AuditDB: &auditGorm{db},
+		},
+	}
+}
+
+type auditService struct {
+	AuditDB
+}
+
+// auditor writes a service's audit events on behalf of actor
+type auditor struct {
+	db    AuditDB
+	actor Actor
+}
+
+func newAuditor(db *gorm.DB) auditor {
+	return auditor{
+		db: &auditValidator{
+			AuditDB: &auditGorm{db},
+		},
+	}
+}
+
+// record fills in where the event came from and writes it. A
+// failure is only logged, what's being audited has already
+// happened by then.
+func (a auditor) record(event AuditEvent) {
+	// while impersonating, what looks like the user acting was
+	// really the admin
+	if event.ActorID == 0 || (a.actor.OnBehalfOfID != 0 && event.ActorID == a.actor.OnBehalfOfID) {
+		event.ActorID = a.actor.UserID
+	}
+	if event.OnBehalfOfID == 0 {
+		event.OnBehalfOfID = a.actor.OnBehalfOfID
+	}
+	event.IPAddress = a.actor.IPAddress
+	event.UserAgent = a.actor.UserAgent
+	if err := a.db.Create(&event); err != nil {
+		log.Printf("audit: recording %s ERROR: %v", event.Action, err)
+	}
+}
+
+// auditSearchLimit is the most events Search ever returns
+const auditSearchLimit = 500
+
+type auditValFunc func(*AuditEvent) error
+
+func runAuditValFuncs(event *AuditEvent, fns ...auditValFunc) error {
+	for _, fn := range fns {
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type auditValidator struct {
+	AuditDB
+}
+
+var _ AuditDB = &auditValidator{}
+
+func (av *auditValidator) requireAction(event *AuditEvent) error {
+	event.Action = strings.TrimSpace(event.Action)
+	if event.Action == "" {
+		return ErrAuditActionRequired
+	}
+
+	return nil
+}
+
+// newEvent stops the ID and time being set by the caller, the
+// log is only trustworthy if events can't be backdated
+func (av *auditValidator) newEvent(event *AuditEvent) error {
+	event.ID = 0
+	event.CreatedAt = time.Now()
+
+	return nil
+}
+
+func (av *auditValidator) Create(event *AuditEvent) error {
+	err := runAuditValFuncs(event, av.requireAction, av.newEvent)
+	if err != nil {
+		return err
+	}
+
+	return av.AuditDB.Create(event)
+}
+
+func (av *auditValidator) Search(query AuditQuery) ([]AuditEvent, error) {
+	if query.Limit <= 0 || query.Limit > auditSearchLimit {
+		query.Limit = auditSearchLimit
+	}
+
+	return av.AuditDB.Search(query)
+}
+
+var _ AuditDB = &auditGorm{}
+
+type auditGorm struct {
+	db *gorm.DB
+}
+
+func (ag *auditGorm) Create(event *AuditEvent) error {
+	return ag.db.Create(event).Error
+}
+
+func (ag *auditGorm) Search(query AuditQuery) ([]AuditEvent, error) {
+	db := ag.db.Order("created_at desc, id desc").Limit(query.Limit)
+	if query.ActorID > 0 {
+		db = db.Where("actor_id = ?", query.ActorID)
+	}
+	if query.UserID > 0 {
+		db = db.Where("actor_id = ? OR on_behalf_of_id = ? OR (target_type = ? AND target_id = ?)",
+			query.UserID, query.UserID, AuditTargetUser, query.UserID)
+	}
+	if query.Action != "" {
+		db = db.Where("action LIKE ?", escapeLike(query.Action)+"%")
+	}
+	if query.TargetType != "" {
+		db = db.Where("target_type = ?", query.TargetType)
+	}
+	if query.TargetID > 0 {
+		db = db.Where("target_id = ?", query.TargetID)
+	}
+
+	var events []AuditEvent
+	if err := db.Find(&events).Error; err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
@@ -0,0 +1,25 @@
+package models
+
+import "testing"
+
+func TestAuditorRecordsImpersonatingAdmin(t *testing.T) {
+	db := &memAuditDB{}
+	a := auditor{db: db, actor: Actor{UserID: 9, OnBehalfOfID: 1, IPAddress: "10.0.0.1"}}
+
+	a.record(AuditEvent{Action: AuditGalleryCreate, TargetType: AuditTargetGallery, TargetID: 3})
+	// services that know who the user is still name them
+	a.record(AuditEvent{ActorID: 1, Action: AuditLogout, TargetType: AuditTargetUser, TargetID: 1})
+
+	for _, event := range db.events {
+		if event.ActorID != 9 || event.OnBehalfOfID != 1 || event.IPAddress != "10.0.0.1" {
+			t.Errorf("recorded %+v, want admin 9 acting as user 1", event)
+		}
+	}
+
+	db.events = nil
+	a = auditor{db: db, actor: Actor{UserID: 1}}
+	a.record(AuditEvent{Action: AuditGalleryCreate})
+	if event := db.events[0]; event.ActorID != 1 || event.OnBehalfOfID != 0 {
+		t.Errorf("recorded %+v, want user 1 acting as themselves", event)
+	}
+}
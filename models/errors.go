@@ -18,15 +18,87 @@ const (
 
 	ErrEmailTaken modelError = "models: email address is already taken"
 
+	// ErrEmailUnchanged is returned when a user asks to change
+	// their email address to the one they already have
+	ErrEmailUnchanged modelError = "models: that is already your email address"
+
 	ErrPasswordRequired modelError = "models: password is required"
+	ErrNameTooLong      modelError = "models: name must be 50 characters or less"
 	ErrTitleRequired    modelError = "models: gallery title is required"
 
+	ErrVisibilityInvalid modelError = "models: gallery visibility must be private, unlisted or public"
+
+	// ErrTokenInvalid is returned when a password reset token
+	// does not exist or has expired
+	ErrTokenInvalid modelError = "models: token provided is not valid"
+
+	// ErrImageType is returned when an upload isn't one of
+	// the image formats we support
+	ErrImageType modelError = "models: only JPEG, PNG, GIF and WebP images can be uploaded"
+
+	// ErrExpiryInPast is returned when a share link would
+	// already have expired when it's created
+	ErrExpiryInPast modelError = "models: expiry date must be in the future"
+
+	ErrTokenNameRequired modelError = "models: token name is required"
+	ErrScopeInvalid      modelError = "models: token scopes must be read or write"
+
+	// ErrExternalEmailUnverified is returned when an identity
+	// provider can't vouch for the user's email address
+	ErrExternalEmailUnverified modelError = "models: your identity provider has not verified your email address"
+	// ErrExternalSignupDisabled is returned when someone signs
+	// in through a provider that can't create new accounts
+	ErrExternalSignupDisabled modelError = "models: there is no account for your email address"
+	// ErrExternalAccountUnverified is returned when the account
+	// an identity would be linked to hasn't verified its email
+	ErrExternalAccountUnverified modelError = "models: the account for your email address hasn't been verified, please reset its password and verify it first"
+
+	// ErrTwoFactorCodeInvalid is returned for wrong, expired or
+	// already used authenticator and recovery codes
+	ErrTwoFactorCodeInvalid modelError = "models: that code is not valid, please try again"
+	ErrTwoFactorEnabled     modelError = "models: two-factor authentication is already on"
+	ErrTwoFactorNotStarted  modelError = "models: two-factor authentication has not been set up"
+	// ErrTwoFactorTooManyCodes is returned when a challenge is
+	// dropped after too many wrong codes
+	ErrTwoFactorTooManyCodes modelError = "models: too many wrong codes, please log in again"
+
+	// ErrLoginThrottled is returned when a login is attempted too
+	// soon after the last failure
+	ErrLoginThrottled modelError = "models: too many failed attempts, please wait a few seconds and try again"
+	// ErrLoginLocked is returned while an email or IP address is
+	// locked out after failing too many times
+	ErrLoginLocked modelError = "models: too many failed attempts, logging in is locked for a while"
+
+	// ErrAccountDisabled is returned when a disabled user tries
+	// to sign in
+	ErrAccountDisabled modelError = "models: your account has been disabled, please contact support"
+
+	ErrDeletionScheduled    modelError = "models: your account is already scheduled for deletion"
+	ErrDeletionNotScheduled modelError = "models: your account is not scheduled for deletion"
+
+	// ErrExportInProgress is returned when an export is asked for
+	// while the last one is still being built
+	ErrExportInProgress modelError = "models: your export is still being prepared, we'll email you when it's ready"
+	ErrExportExpired    modelError = "models: that download link has expired, please request a new export"
+
 	ErrRememberTooShort privateError = "models: remember token must be at least 32 bytes"
 	// ErrInvalidID is returned when an invalid ID is provided
 	// to the delete method
 	ErrInvalidID privateError = "models: ID provided as invalid"
 
 	ErrUserIDRequired privateError = "models: user ID is required"
+
+	ErrGalleryIDRequired privateError = "models: gallery ID is required"
+	ErrFilenameRequired  privateError = "models: image filename is required"
+	ErrFilenameInvalid   privateError = "models: image filename is not valid"
+
+	ErrServiceRequired       privateError = "models: oauth service is required"
+	ErrAccessTokenRequired   privateError = "models: oauth access token is required"
+	ErrSubjectRequired       privateError = "models: identity provider and subject are required"
+	ErrAuditActionRequired   privateError = "models: audit event action is required"
+	ErrUserServiceRequired   privateError = "models: the user service must be set up first"
+	ErrImageServiceRequired  privateError = "models: the image service must be set up first"
+	ErrExportServiceRequired privateError = "models: the export service must be set up first"
 )
 
 type modelError string
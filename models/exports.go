@@ -0,0 +1,571 @@
+package models
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/hash"
+	"github.com/arnoldokoth/lenslocked.com/rand"
+	"github.com/arnoldokoth/lenslocked.com/storage"
+	"github.com/jinzhu/gorm"
+)
+
+// Statuses an export goes through
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+const (
+	// exportTTL is how long the download link of a finished
+	// export works for
+	exportTTL = 7 * 24 * time.Hour
+	// exportTimeout is how long an export can be pending before
+	// it's assumed the server building it went away
+	exportTimeout = time.Hour
+)
+
+// Export is an archive of everything held about a user. Like
+// API tokens only the HMAC of the download token is stored,
+// the raw token is only ever in the email sent to the user.
+type Export struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Status    string `gorm:"not null;default:'pending'"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	// Key is where the archive is kept in storage. It is
+	// random as local storage is served to anyone who asks.
+	Key       string
+	Size      int64 `gorm:"not null;default:0"`
+	ExpiresAt *time.Time
+}
+
+// IsReady reports whether the archive can be downloaded
+func (e *Export) IsReady() bool {
+	return e.Status == ExportReady && !e.IsExpired()
+}
+
+// IsPending reports whether the archive is still being built
+func (e *Export) IsPending() bool {
+	return e.Status == ExportPending && time.Since(e.CreatedAt) < exportTimeout
+}
+
+// IsExpired ...
+func (e *Export) IsExpired() bool {
+	return e.ExpiresAt != nil && time.Now().After(*e.ExpiresAt)
+}
+
+// ExportDB ...
+type ExportDB interface {
+	ByToken(token string) (*Export, error)
+	// ByUserID returns the user's exports, newest first
+	ByUserID(userID uint) ([]Export, error)
+	// Expired returns the exports whose links have expired, and
+	// ones that never finished from as long ago
+	Expired(now time.Time) ([]Export, error)
+
+	Create(export *Export) error
+	Update(export *Export) error
+	Delete(id uint) error
+}
+
+// ExportService builds archives of a user's data for them to
+// download. The archive holds manifest.json describing their
+// profile, galleries and images alongside the original files.
+type ExportService interface {
+	ExportDB
+
+	// Start records a pending export for the user, it returns
+	// ErrExportInProgress if one is already being built
+	Start(user *User) (*Export, error)
+	// Build writes the archive to storage and marks the export
+	// ready, or failed if anything goes wrong
+	Build(export *Export) error
+	// Open returns the archive of a ready export, it is up to
+	// the caller to close it
+	Open(export *Export) (io.ReadCloser, error)
+
+	// DeleteExpired removes the archives and records of exports
+	// whose links have expired, returning how many there were
+	DeleteExpired() (int, error)
+	// DeleteByUserID removes all of the user's exports
+	DeleteByUserID(userID uint) error
+}
+
+// NewExportService ...
+func NewExportService(db *gorm.DB, store storage.Storage, hmacKey string) ExportService {
+	return &exportService{
+		ExportDB: &exportValidator{
+			ExportDB: &exportGorm{db},
+			hmac:     hash.NewHMAC(hmacKey),
+		},
+		userDB:    &userGorm{db},
+		galleryDB: &galleryGorm{db},
+		imageDB:   &imageGorm{db},
+		store:     store,
+	}
+}
+
+type exportService struct {
+	ExportDB
+	userDB    UserDB
+	galleryDB GalleryDB
+	imageDB   ImageDB
+	store     storage.Storage
+}
+
+func (es *exportService) Start(user *User) (*Export, error) {
+	exports, err := es.ByUserID(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(exports) > 0 && exports[0].IsPending() {
+		return nil, ErrExportInProgress
+	}
+
+	export := Export{
+		UserID: user.ID,
+		Status: ExportPending,
+	}
+	if err := es.Create(&export); err != nil {
+		return nil, err
+	}
+
+	return &export, nil
+}
+
+func (es *exportService) Build(export *Export) error {
+	err := es.build(export)
+	if err != nil {
+		log.Printf("export: building export %d ERROR: %v", export.ID, err)
+		export.Status = ExportFailed
+		if err := es.Update(export); err != nil {
+			log.Printf("export: marking export %d failed ERROR: %v", export.ID, err)
+		}
+		return err
+	}
+
+	expiresAt := time.Now().Add(exportTTL)
+	export.Status = ExportReady
+	export.ExpiresAt = &expiresAt
+	return es.Update(export)
+}
+
+// build zips the archive up in a temporary file first as
+// storage needs to be handed the whole thing in one go
+func (es *exportService) build(export *Export) error {
+	user, err := es.userDB.ByID(export.UserID)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile("", "lenslocked-export-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := es.writeArchive(tmp, user); err != nil {
+		return err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	random, err := rand.String(24)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("exports/%d/%s.zip", user.ID, random)
+	if err := es.store.Put(key, tmp); err != nil {
+		return err
+	}
+	export.Key = key
+	export.Size = size
+
+	return nil
+}
+
+func (es *exportService) writeArchive(w io.Writer, user *User) error {
+	galleries, err := es.galleryDB.ByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	zw := zip.NewWriter(w)
+	manifest := exportManifest{
+		ExportedAt: time.Now().UTC(),
+		User:       newExportUser(user),
+		Galleries:  []exportGallery{},
+	}
+	for _, gallery := range galleries {
+		images, err := es.imageDB.ByGalleryID(gallery.ID)
+		if err != nil {
+			return err
+		}
+
+		eg := newExportGallery(&gallery)
+		for _, image := range images {
+			file := image.Key()
+			// photos are already compressed so they're stored as is
+			header := &zip.FileHeader{
+				Name:     file,
+				Method:   zip.Store,
+				Modified: image.CreatedAt,
+			}
+			if err := copyToZip(zw, header, es.store, file); err != nil {
+				// the rest of the export is still worth having,
+				// the manifest notes which files are missing
+				log.Printf("export: copying %s ERROR: %v", file, err)
+				file = ""
+			}
+			eg.Images = append(eg.Images, newExportImage(&image, file))
+		}
+		manifest.Galleries = append(manifest.Galleries, eg)
+	}
+
+	mw, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(manifest); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+func copyToZip(zw *zip.Writer, header *zip.FileHeader, store storage.Storage, key string) error {
+	rc, err := store.Get(key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	fw, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, rc)
+	return err
+}
+
+func (es *exportService) Open(export *Export) (io.ReadCloser, error) {
+	if !export.IsReady() {
+		return nil, ErrExportExpired
+	}
+
+	return es.store.Get(export.Key)
+}
+
+func (es *exportService) DeleteExpired() (int, error) {
+	exports, err := es.Expired(time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	for _, export := range exports {
+		if err := es.delete(&export); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(exports), nil
+}
+
+func (es *exportService) DeleteByUserID(userID uint) error {
+	exports, err := es.ByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if err := es.delete(&export); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (es *exportService) delete(export *Export) error {
+	if export.Key != "" {
+		err := es.store.Delete(export.Key)
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+	}
+
+	return es.Delete(export.ID)
+}
+
+// exportManifest is written to manifest.json in the archive.
+// Its fields are spelled out rather than encoding the models
+// directly so secrets like the password hash never end up in
+// it and the format doesn't change by accident.
+type exportManifest struct {
+	ExportedAt time.Time       `json:"exported_at"`
+	User       exportUser      `json:"user"`
+	Galleries  []exportGallery `json:"galleries"`
+}
+
+type exportUser struct {
+	ID                uint       `json:"id"`
+	Name              string     `json:"name"`
+	EmailAddress      string     `json:"email_address"`
+	EmailVerifiedAt   *time.Time `json:"email_verified_at"`
+	PendingEmail      string     `json:"pending_email,omitempty"`
+	KeepPhotoLocation bool       `json:"keep_photo_location"`
+	TwoFactorEnabled  bool       `json:"two_factor_enabled"`
+	DeleteAfter       *time.Time `json:"delete_after"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+func newExportUser(user *User) exportUser {
+	return exportUser{
+		ID:                user.ID,
+		Name:              user.Name,
+		EmailAddress:      user.EmailAddress,
+		EmailVerifiedAt:   user.EmailVerifiedAt,
+		PendingEmail:      user.PendingEmail,
+		KeepPhotoLocation: user.KeepPhotoLocation,
+		TwoFactorEnabled:  user.HasTwoFactor(),
+		DeleteAfter:       user.DeleteAfter,
+		CreatedAt:         user.CreatedAt,
+		UpdatedAt:         user.UpdatedAt,
+	}
+}
+
+type exportGallery struct {
+	ID         uint          `json:"id"`
+	Title      string        `json:"title"`
+	Visibility string        `json:"visibility"`
+	Slug       string        `json:"slug"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	Images     []exportImage `json:"images"`
+}
+
+func newExportGallery(gallery *Gallery) exportGallery {
+	return exportGallery{
+		ID:         gallery.ID,
+		Title:      gallery.Title,
+		Visibility: gallery.Visibility,
+		Slug:       gallery.Slug,
+		CreatedAt:  gallery.CreatedAt,
+		UpdatedAt:  gallery.UpdatedAt,
+		Images:     []exportImage{},
+	}
+}
+
+type exportImage struct {
+	ID           uint       `json:"id"`
+	File         string     `json:"file"`
+	OriginalName string     `json:"original_name"`
+	Caption      string     `json:"caption"`
+	Position     int        `json:"position"`
+	Size         int64      `json:"size"`
+	Width        int        `json:"width"`
+	Height       int        `json:"height"`
+	Camera       string     `json:"camera,omitempty"`
+	LensModel    string     `json:"lens_model,omitempty"`
+	ExposureTime string     `json:"exposure_time,omitempty"`
+	FNumber      float64    `json:"f_number,omitempty"`
+	ISO          int        `json:"iso,omitempty"`
+	FocalLength  float64    `json:"focal_length,omitempty"`
+	TakenAt      *time.Time `json:"taken_at,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// newExportImage describes image, file is where its original
+// is in the archive or empty if it couldn't be copied
+func newExportImage(image *Image, file string) exportImage {
+	return exportImage{
+		ID:           image.ID,
+		File:         file,
+		OriginalName: image.OriginalName,
+		Caption:      image.Caption,
+		Position:     image.Position,
+		Size:         image.Size,
+		Width:        image.Width,
+		Height:       image.Height,
+		Camera:       image.Exif.Camera(),
+		LensModel:    image.Exif.LensModel,
+		ExposureTime: image.Exif.ExposureTime,
+		FNumber:      image.Exif.FNumber,
+		ISO:          image.Exif.ISO,
+		FocalLength:  image.Exif.FocalLength,
+		TakenAt:      image.Exif.TakenAt,
+		CreatedAt:    image.CreatedAt,
+	}
+}
+
+type exportValFunc func(*Export) error
+
+func runExportValFuncs(export *Export, fns ...exportValFunc) error {
+	for _, fn := range fns {
+		if err := fn(export); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type exportValidator struct {
+	ExportDB
+	hmac hash.HMAC
+}
+
+var _ ExportDB = &exportValidator{}
+
+func (ev *exportValidator) requireUserID(export *Export) error {
+	if export.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (ev *exportValidator) setTokenIfUnset(export *Export) error {
+	if export.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	export.Token = token
+	return nil
+}
+
+func (ev *exportValidator) hmacToken(export *Export) error {
+	if export.Token == "" {
+		return nil
+	}
+
+	export.TokenHash = ev.hmac.Hash(export.Token)
+	return nil
+}
+
+func (ev *exportValidator) idGreaterThanZero(export *Export) error {
+	if export.ID <= 0 {
+		return ErrInvalidID
+	}
+
+	return nil
+}
+
+func (ev *exportValidator) ByToken(token string) (*Export, error) {
+	export := Export{Token: token}
+	err := runExportValFuncs(&export, ev.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return ev.ExportDB.ByToken(export.TokenHash)
+}
+
+func (ev *exportValidator) ByUserID(userID uint) ([]Export, error) {
+	if userID <= 0 {
+		return nil, ErrUserIDRequired
+	}
+
+	return ev.ExportDB.ByUserID(userID)
+}
+
+func (ev *exportValidator) Create(export *Export) error {
+	err := runExportValFuncs(export, ev.requireUserID, ev.setTokenIfUnset, ev.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return ev.ExportDB.Create(export)
+}
+
+func (ev *exportValidator) Update(export *Export) error {
+	err := runExportValFuncs(export, ev.idGreaterThanZero, ev.requireUserID)
+	if err != nil {
+		return err
+	}
+
+	return ev.ExportDB.Update(export)
+}
+
+func (ev *exportValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+
+	return ev.ExportDB.Delete(id)
+}
+
+var _ ExportDB = &exportGorm{}
+
+type exportGorm struct {
+	db *gorm.DB
+}
+
+func (eg *exportGorm) ByToken(tokenHash string) (*Export, error) {
+	var export Export
+	db := eg.db.Where("token_hash = ?", tokenHash)
+	err := first(db, &export)
+	if err != nil {
+		return nil, err
+	}
+
+	return &export, nil
+}
+
+func (eg *exportGorm) ByUserID(userID uint) ([]Export, error) {
+	var exports []Export
+	err := eg.db.Where("user_id = ?", userID).Order("created_at desc").Find(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return exports, nil
+}
+
+func (eg *exportGorm) Expired(now time.Time) ([]Export, error) {
+	var exports []Export
+	err := eg.db.Where("expires_at <= ? OR (status <> ? AND created_at <= ?)",
+		now, ExportReady, now.Add(-exportTTL)).Find(&exports).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return exports, nil
+}
+
+func (eg *exportGorm) Create(export *Export) error {
+	return eg.db.Create(export).Error
+}
+
+func (eg *exportGorm) Update(export *Export) error {
+	return eg.db.Save(export).Error
+}
+
+// Delete removes the row permanently, once the archive is gone
+// there is nothing left worth keeping
+func (eg *exportGorm) Delete(id uint) error {
+	return eg.db.Unscoped().Where("id = ?", id).Delete(&Export{}).Error
+}
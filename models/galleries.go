@@ -3,15 +3,52 @@ package models
 import (
 	"strings"
 
+	"github.com/arnoldokoth/lenslocked.com/rand"
 	"github.com/jinzhu/gorm"
 )
 
+// Who can see a gallery
+const (
+	// VisibilityPrivate galleries can only be seen by their owner
+	VisibilityPrivate = "private"
+	// VisibilityUnlisted galleries can be seen by anyone who has
+	// the link containing their slug
+	VisibilityUnlisted = "unlisted"
+	// VisibilityPublic galleries can be seen by everyone
+	VisibilityPublic = "public"
+)
+
+// slugBytes is how much randomness goes into a gallery's slug
+const slugBytes = 12
+
 // Gallery ...
 type Gallery struct {
 	gorm.Model
-	UserID uint    `gorm:"not_null;index"`
-	Title  string  `gorm:"not_null"`
-	Images []Image `gorm:"-"`
+	UserID     uint        `gorm:"not_null;index"`
+	Title      string      `gorm:"not_null"`
+	Visibility string      `gorm:"not null;default:'private'"`
+	Slug       string      `gorm:"index"`
+	Images     []Image     `gorm:"-"`
+	ShareLinks []ShareLink `gorm:"-"`
+}
+
+// IsOwnedBy reports whether user owns the gallery, user
+// may be nil for visitors who aren't signed in
+func (g *Gallery) IsOwnedBy(user *User) bool {
+	return user != nil && user.ID == g.UserID
+}
+
+// CanView reports whether user may see the gallery when it is
+// looked up by ID. Unlisted galleries are only reachable
+// through their slug.
+func (g *Gallery) CanView(user *User) bool {
+	return g.Visibility == VisibilityPublic || g.IsOwnedBy(user)
+}
+
+// CanViewBySlug reports whether user may see the gallery when
+// it is looked up by its slug
+func (g *Gallery) CanViewBySlug(user *User) bool {
+	return g.Visibility == VisibilityUnlisted || g.CanView(user)
 }
 
 // ImagesSplitN ...
@@ -37,24 +74,90 @@ type GalleryDB interface {
 
 	ByID(id uint) (*Gallery, error)
 	ByUserID(id uint) ([]Gallery, error)
+	BySlug(slug string) (*Gallery, error)
+	// Search returns up to limit galleries whose title contains
+	// query, newest first
+	Search(query string, limit int) ([]Gallery, error)
 }
 
 // GalleryService ...
 type GalleryService interface {
 	GalleryDB
+	// As returns a GalleryService that records actor against
+	// the audit events it writes for changes to galleries
+	As(actor Actor) GalleryService
 }
 
 // NewGalleryService ...
-func NewGalleryService(db *gorm.DB) GalleryService {
+func NewGalleryService(db *gorm.DB, is ImageService) GalleryService {
 	return &galleryService{
 		GalleryDB: &galleryValidator{
 			&galleryGorm{db},
 		},
+		images: is,
+		audit:  newAuditor(db),
 	}
 }
 
 type galleryService struct {
 	GalleryDB
+	images ImageService
+	audit  auditor
+}
+
+func (gs *galleryService) Create(gallery *Gallery) error {
+	if err := gs.GalleryDB.Create(gallery); err != nil {
+		return err
+	}
+
+	gs.audit.record(AuditEvent{
+		Action:     AuditGalleryCreate,
+		TargetType: AuditTargetGallery,
+		TargetID:   gallery.ID,
+		Detail:     gallery.Title,
+	})
+
+	return nil
+}
+
+func (gs *galleryService) Update(gallery *Gallery) error {
+	if err := gs.GalleryDB.Update(gallery); err != nil {
+		return err
+	}
+
+	gs.audit.record(AuditEvent{
+		Action:     AuditGalleryUpdate,
+		TargetType: AuditTargetGallery,
+		TargetID:   gallery.ID,
+		Detail:     gallery.Title,
+	})
+
+	return nil
+}
+
+// Delete removes the gallery's images first so their files are
+// gone and they stop counting towards the owner's quota
+func (gs *galleryService) Delete(id uint) error {
+	if err := gs.images.DeleteByGalleryID(id); err != nil {
+		return err
+	}
+	if err := gs.GalleryDB.Delete(id); err != nil {
+		return err
+	}
+
+	gs.audit.record(AuditEvent{
+		Action:     AuditGalleryDelete,
+		TargetType: AuditTargetGallery,
+		TargetID:   id,
+	})
+
+	return nil
+}
+
+func (gs *galleryService) As(actor Actor) GalleryService {
+	copied := *gs
+	copied.audit.actor = actor
+	return &copied
 }
 
 type galleryValFunc func(*Gallery) error
@@ -90,8 +193,39 @@ func (gv *galleryValidator) requireUserID(gallery *Gallery) error {
 	return nil
 }
 
+func (gv *galleryValidator) defaultVisibility(gallery *Gallery) error {
+	if gallery.Visibility == "" {
+		gallery.Visibility = VisibilityPrivate
+	}
+
+	return nil
+}
+
+func (gv *galleryValidator) visibilityValid(gallery *Gallery) error {
+	switch gallery.Visibility {
+	case VisibilityPrivate, VisibilityUnlisted, VisibilityPublic:
+		return nil
+	}
+
+	return ErrVisibilityInvalid
+}
+
+func (gv *galleryValidator) setSlugIfUnset(gallery *Gallery) error {
+	if gallery.Slug != "" {
+		return nil
+	}
+
+	slug, err := rand.String(slugBytes)
+	if err != nil {
+		return err
+	}
+	gallery.Slug = slug
+	return nil
+}
+
 func (gv *galleryValidator) Create(gallery *Gallery) error {
-	err := runGalleryValFuncs(gallery, gv.requireTitle, gv.requireUserID)
+	err := runGalleryValFuncs(gallery, gv.requireTitle, gv.requireUserID,
+		gv.defaultVisibility, gv.visibilityValid, gv.setSlugIfUnset)
 	if err != nil {
 		return err
 	}
@@ -100,7 +234,8 @@ func (gv *galleryValidator) Create(gallery *Gallery) error {
 }
 
 func (gv *galleryValidator) Update(gallery *Gallery) error {
-	err := runGalleryValFuncs(gallery, gv.requireTitle, gv.requireUserID)
+	err := runGalleryValFuncs(gallery, gv.requireTitle, gv.requireUserID,
+		gv.defaultVisibility, gv.visibilityValid, gv.setSlugIfUnset)
 	if err != nil {
 		return err
 	}
@@ -130,6 +265,19 @@ func (gg *galleryGorm) Update(gallery *Gallery) error {
 	return gg.db.Save(gallery).Error
 }
 
+func (gg *galleryGorm) Search(query string, limit int) ([]Gallery, error) {
+	var galleries []Gallery
+	db := gg.db.Order("created_at desc").Limit(limit)
+	if query != "" {
+		db = db.Where("title ILIKE ?", "%"+escapeLike(query)+"%")
+	}
+	if err := db.Find(&galleries).Error; err != nil {
+		return nil, err
+	}
+
+	return galleries, nil
+}
+
 func (gg *galleryGorm) Delete(id uint) error {
 	gallery := Gallery{Model: gorm.Model{ID: id}}
 	return gg.db.Delete(&gallery).Error
@@ -142,6 +290,17 @@ func (gg *galleryGorm) ByID(id uint) (*Gallery, error) {
 	return &gallery, err
 }
 
+func (gg *galleryGorm) BySlug(slug string) (*Gallery, error) {
+	var gallery Gallery
+	db := gg.db.Where("slug = ?", slug)
+	err := first(db, &gallery)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gallery, nil
+}
+
 func (gg *galleryGorm) ByUserID(id uint) ([]Gallery, error) {
 	var galleries []Gallery
 	err := gg.db.Where("user_id = ?", id).Find(&galleries).Error
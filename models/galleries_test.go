@@ -0,0 +1,74 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+// memGalleryDB finds galleries by ID and records which were
+// deleted
+type memGalleryDB struct {
+	GalleryDB
+	galleries []*Gallery
+	deleted   []uint
+}
+
+func (db *memGalleryDB) ByID(id uint) (*Gallery, error) {
+	for _, gallery := range db.galleries {
+		if gallery.ID == id {
+			return gallery, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *memGalleryDB) Delete(id uint) error {
+	db.deleted = append(db.deleted, id)
+	return nil
+}
+
+// memImageService records which galleries had their images
+// deleted, failing with err when it's set
+type memImageService struct {
+	ImageService
+	deletedGalleries []uint
+	err              error
+}
+
+func (is *memImageService) DeleteByGalleryID(galleryID uint) error {
+	if is.err != nil {
+		return is.err
+	}
+	is.deletedGalleries = append(is.deletedGalleries, galleryID)
+	return nil
+}
+
+func TestGalleryDeleteRemovesImages(t *testing.T) {
+	db := &memGalleryDB{}
+	images := &memImageService{}
+	audit := &memAuditDB{}
+	gs := &galleryService{GalleryDB: db, images: images, audit: auditor{db: audit}}
+
+	if err := gs.Delete(7); err != nil {
+		t.Fatalf("Delete() err = %v", err)
+	}
+	if len(images.deletedGalleries) != 1 || images.deletedGalleries[0] != 7 {
+		t.Errorf("images deleted for %v, want gallery 7", images.deletedGalleries)
+	}
+	if len(db.deleted) != 1 || db.deleted[0] != 7 {
+		t.Errorf("galleries deleted = %v, want 7", db.deleted)
+	}
+	if len(audit.events) != 1 || audit.events[0].Action != AuditGalleryDelete {
+		t.Errorf("recorded %v, want a gallery delete", audit.events)
+	}
+
+	// the gallery stays if its images can't be removed, so
+	// deleting it can be tried again
+	images.err = errors.New("storage unavailable")
+	if err := gs.Delete(8); err != images.err {
+		t.Fatalf("Delete() err = %v, want %v", err, images.err)
+	}
+	if len(db.deleted) != 1 {
+		t.Errorf("galleries deleted = %v, want gallery 8 kept", db.deleted)
+	}
+}
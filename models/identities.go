@@ -0,0 +1,295 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// Identity links an account at an external identity provider
+// to one of our users so they can sign in through it
+type Identity struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	Provider string `gorm:"not null;unique_index:provider_subject"`
+	Subject  string `gorm:"not null;unique_index:provider_subject"`
+	Email    string
+}
+
+// ExternalIdentity is who an identity provider says the user
+// signing in is
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// IdentityDB ...
+type IdentityDB interface {
+	ByProviderSubject(provider, subject string) (*Identity, error)
+	ByUserID(userID uint) ([]Identity, error)
+
+	Create(identity *Identity) error
+	Delete(id uint) error
+}
+
+// IdentityService ...
+type IdentityService interface {
+	IdentityDB
+
+	// SignIn returns the user linked to ext. The first time an
+	// identity is seen it is linked to the user with the same
+	// email address, as long as both we and the provider have
+	// verified it, or when allowSignup is set a new user is
+	// created for it. Sign ins and refused attempts are audited
+	// like signing in with a password.
+	SignIn(ext ExternalIdentity, allowSignup bool) (*User, error)
+
+	// As returns a copy of the service that records actor
+	// against the sign ins it audits
+	As(actor Actor) IdentityService
+}
+
+// NewIdentityService ...
+func NewIdentityService(db *gorm.DB, us UserService) IdentityService {
+	return &identityService{
+		IdentityDB: &identityValidator{
+			IdentityDB: &identityGorm{db},
+		},
+		us:    us,
+		audit: newAuditor(db),
+	}
+}
+
+type identityService struct {
+	IdentityDB
+	us    UserService
+	audit auditor
+}
+
+func (is *identityService) As(actor Actor) IdentityService {
+	copied := *is
+	copied.audit.actor = actor
+	return &copied
+}
+
+func (is *identityService) SignIn(ext ExternalIdentity, allowSignup bool) (*User, error) {
+	identity, err := is.ByProviderSubject(ext.Provider, ext.Subject)
+	switch err {
+	case nil:
+		user, err := is.us.ByID(identity.UserID)
+		if err != nil {
+			return nil, err
+		}
+		return is.signedIn(user, ext)
+	case ErrNotFound:
+	default:
+		return nil, err
+	}
+
+	// linking by an unverified address would let anyone who can
+	// sign up at the provider take over the matching account
+	if !ext.EmailVerified || ext.Email == "" {
+		is.signInFailed(ext, nil)
+		return nil, ErrExternalEmailUnverified
+	}
+
+	user, err := is.us.ByEmail(ext.Email)
+	switch err {
+	case nil:
+		// whoever signed up with an unverified address may not
+		// own it, linking would hand the provider's user an
+		// account someone else still has the password and
+		// sessions for
+		if !user.IsVerified() {
+			is.signInFailed(ext, user)
+			return nil, ErrExternalAccountUnverified
+		}
+	case ErrNotFound:
+		if !allowSignup {
+			is.signInFailed(ext, nil)
+			return nil, ErrExternalSignupDisabled
+		}
+		user, err = is.createUser(ext)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	identity = &Identity{
+		UserID:   user.ID,
+		Provider: ext.Provider,
+		Subject:  ext.Subject,
+		Email:    ext.Email,
+	}
+	if err := is.Create(identity); err != nil {
+		return nil, err
+	}
+
+	return is.signedIn(user, ext)
+}
+
+// signedIn records user signing in through ext's provider. Like
+// signing in with a password, disabled accounts are turned away
+// without it counting as a sign in.
+func (is *identityService) signedIn(user *User, ext ExternalIdentity) (*User, error) {
+	if user.IsDisabled() {
+		return nil, ErrAccountDisabled
+	}
+
+	is.audit.record(AuditEvent{
+		ActorID:    user.ID,
+		Action:     AuditLogin,
+		TargetType: AuditTargetUser,
+		TargetID:   user.ID,
+		Detail:     ext.Provider,
+	})
+	return user, nil
+}
+
+// signInFailed records ext being turned away, against the
+// account it was trying to sign in to when there is one
+func (is *identityService) signInFailed(ext ExternalIdentity, user *User) {
+	event := AuditEvent{
+		Action: AuditLoginFailed,
+		Detail: strings.TrimSpace(ext.Provider + " " + ext.Email),
+	}
+	if user != nil {
+		event.TargetType = AuditTargetUser
+		event.TargetID = user.ID
+	}
+	is.audit.record(event)
+}
+
+// createUser signs up a user for ext. They get a random
+// password they can replace through the forgotten password
+// flow if they ever want to sign in without the provider.
+func (is *identityService) createUser(ext ExternalIdentity) (*User, error) {
+	password, err := rand.RememberToken()
+	if err != nil {
+		return nil, err
+	}
+
+	name := strings.TrimSpace(ext.Name)
+	if name == "" {
+		name = strings.SplitN(ext.Email, "@", 2)[0]
+	}
+	if len(name) > 50 {
+		name = strings.ToValidUTF8(name[:50], "")
+	}
+
+	now := time.Now()
+	user := User{
+		Name:            name,
+		EmailAddress:    ext.Email,
+		Password:        password,
+		EmailVerifiedAt: &now,
+	}
+	if err := is.us.Create(&user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+type identityValFunc func(*Identity) error
+
+func runIdentityValFuncs(identity *Identity, fns ...identityValFunc) error {
+	for _, fn := range fns {
+		if err := fn(identity); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type identityValidator struct {
+	IdentityDB
+}
+
+func (iv *identityValidator) requireUserID(identity *Identity) error {
+	if identity.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (iv *identityValidator) requireProviderSubject(identity *Identity) error {
+	if identity.Provider == "" || identity.Subject == "" {
+		return ErrSubjectRequired
+	}
+
+	return nil
+}
+
+func (iv *identityValidator) ByProviderSubject(provider, subject string) (*Identity, error) {
+	identity := Identity{Provider: provider, Subject: subject}
+	if err := runIdentityValFuncs(&identity, iv.requireProviderSubject); err != nil {
+		return nil, err
+	}
+
+	return iv.IdentityDB.ByProviderSubject(provider, subject)
+}
+
+func (iv *identityValidator) Create(identity *Identity) error {
+	err := runIdentityValFuncs(identity, iv.requireUserID, iv.requireProviderSubject)
+	if err != nil {
+		return err
+	}
+
+	return iv.IdentityDB.Create(identity)
+}
+
+func (iv *identityValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+
+	return iv.IdentityDB.Delete(id)
+}
+
+var _ IdentityDB = &identityGorm{}
+
+type identityGorm struct {
+	db *gorm.DB
+}
+
+func (ig *identityGorm) ByProviderSubject(provider, subject string) (*Identity, error) {
+	var identity Identity
+	db := ig.db.Where("provider = ? AND subject = ?", provider, subject)
+	err := first(db, &identity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+func (ig *identityGorm) ByUserID(userID uint) ([]Identity, error) {
+	var identities []Identity
+	err := ig.db.Where("user_id = ?", userID).Find(&identities).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+func (ig *identityGorm) Create(identity *Identity) error {
+	return ig.db.Create(identity).Error
+}
+
+// Delete removes the link permanently so the identity can be
+// linked again later
+func (ig *identityGorm) Delete(id uint) error {
+	identity := Identity{Model: gorm.Model{ID: id}}
+	return ig.db.Unscoped().Delete(&identity).Error
+}
@@ -0,0 +1,166 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+// memIdentityDB keeps identities in memory
+type memIdentityDB struct {
+	IdentityDB
+	identities []Identity
+}
+
+func (db *memIdentityDB) ByProviderSubject(provider, subject string) (*Identity, error) {
+	for _, identity := range db.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return &identity, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *memIdentityDB) Create(identity *Identity) error {
+	db.identities = append(db.identities, *identity)
+	return nil
+}
+
+// memUserService finds users by ID and email address
+type memUserService struct {
+	UserService
+	users []*User
+}
+
+func (us *memUserService) ByID(id uint) (*User, error) {
+	for _, user := range us.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (us *memUserService) ByEmail(email string) (*User, error) {
+	for _, user := range us.users {
+		if user.EmailAddress == email {
+			return user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (us *memUserService) Create(user *User) error {
+	user.ID = uint(len(us.users) + 1)
+	us.users = append(us.users, user)
+	return nil
+}
+
+func TestIdentitySignInLinksVerifiedEmailOnly(t *testing.T) {
+	now := time.Now()
+	jon := &User{EmailAddress: "jon@example.com", EmailVerifiedAt: &now}
+	jon.ID = 1
+	db := &memIdentityDB{}
+	audit := &memAuditDB{}
+	is := &identityService{IdentityDB: db, us: &memUserService{users: []*User{jon}}, audit: auditor{db: audit}}
+
+	unverified := ExternalIdentity{Provider: "google", Subject: "attacker", Email: "jon@example.com"}
+	if user, err := is.SignIn(unverified, true); err != ErrExternalEmailUnverified {
+		t.Fatalf("SignIn() with an unverified email = %v, %v, want ErrExternalEmailUnverified", user, err)
+	}
+	noEmail := ExternalIdentity{Provider: "google", Subject: "attacker", EmailVerified: true}
+	if user, err := is.SignIn(noEmail, true); err != ErrExternalEmailUnverified {
+		t.Fatalf("SignIn() without an email = %v, %v, want ErrExternalEmailUnverified", user, err)
+	}
+	if len(db.identities) != 0 {
+		t.Fatalf("identities = %v, want none linked", db.identities)
+	}
+	for _, event := range audit.events {
+		if event.Action != AuditLoginFailed || event.TargetID != 0 {
+			t.Errorf("recorded %+v, want a failed sign in to no account", event)
+		}
+	}
+	audit.events = nil
+
+	verified := ExternalIdentity{Provider: "google", Subject: "jon", Email: "jon@example.com", EmailVerified: true}
+	user, err := is.SignIn(verified, false)
+	if err != nil || user != jon {
+		t.Fatalf("SignIn() = %v, %v, want jon", user, err)
+	}
+	if len(db.identities) != 1 || db.identities[0].UserID != jon.ID {
+		t.Fatalf("identities = %v, want one linked to jon", db.identities)
+	}
+
+	// once linked the identity signs in even if the provider
+	// stops vouching for the address
+	verified.EmailVerified = false
+	if user, err := is.SignIn(verified, false); err != nil || user != jon {
+		t.Errorf("SignIn() of a linked identity = %v, %v, want jon", user, err)
+	}
+
+	if len(audit.events) != 2 {
+		t.Fatalf("recorded %d events, want a sign in for linking and one after", len(audit.events))
+	}
+	for _, event := range audit.events {
+		if event.Action != AuditLogin || event.ActorID != jon.ID || event.TargetID != jon.ID || event.Detail != "google" {
+			t.Errorf("recorded %+v, want jon signing in with google", event)
+		}
+	}
+}
+
+func TestIdentitySignInDisabled(t *testing.T) {
+	now := time.Now()
+	jon := &User{EmailAddress: "jon@example.com", EmailVerifiedAt: &now, DisabledAt: &now}
+	jon.ID = 1
+	db := &memIdentityDB{identities: []Identity{{UserID: jon.ID, Provider: "google", Subject: "jon"}}}
+	audit := &memAuditDB{}
+	is := &identityService{IdentityDB: db, us: &memUserService{users: []*User{jon}}, audit: auditor{db: audit}}
+
+	ext := ExternalIdentity{Provider: "google", Subject: "jon", Email: "jon@example.com", EmailVerified: true}
+	if user, err := is.SignIn(ext, false); err != ErrAccountDisabled {
+		t.Errorf("SignIn() = %v, %v, want ErrAccountDisabled", user, err)
+	}
+	if len(audit.events) != 0 {
+		t.Errorf("recorded %v, want nothing", audit.events)
+	}
+}
+
+func TestIdentitySignInRefusesUnverifiedAccount(t *testing.T) {
+	// someone else signed up with sam's address and never
+	// verified it, they still know the account's password
+	squatted := &User{EmailAddress: "sam@example.com", PasswordHash: "attackers-hash"}
+	squatted.ID = 1
+	db := &memIdentityDB{}
+	audit := &memAuditDB{}
+	is := &identityService{IdentityDB: db, us: &memUserService{users: []*User{squatted}}, audit: auditor{db: audit}}
+
+	ext := ExternalIdentity{Provider: "google", Subject: "sam", Email: "sam@example.com", EmailVerified: true}
+	if user, err := is.SignIn(ext, true); err != ErrExternalAccountUnverified {
+		t.Fatalf("SignIn() = %v, %v, want ErrExternalAccountUnverified", user, err)
+	}
+	if len(db.identities) != 0 {
+		t.Errorf("identities = %v, want none linked", db.identities)
+	}
+	if squatted.IsVerified() {
+		t.Error("the squatted account was verified, want it left unverified")
+	}
+	if len(audit.events) != 1 || audit.events[0].Action != AuditLoginFailed || audit.events[0].TargetID != squatted.ID {
+		t.Errorf("recorded %v, want a failed sign in to the squatted account", audit.events)
+	}
+}
+
+func TestIdentitySignInSignup(t *testing.T) {
+	is := &identityService{IdentityDB: &memIdentityDB{}, us: &memUserService{}, audit: auditor{db: &memAuditDB{}}}
+	ext := ExternalIdentity{Provider: "google", Subject: "sam", Email: "sam@example.com", EmailVerified: true, Name: "Sam"}
+
+	if _, err := is.SignIn(ext, false); err != ErrExternalSignupDisabled {
+		t.Fatalf("SignIn() err = %v, want ErrExternalSignupDisabled", err)
+	}
+
+	user, err := is.SignIn(ext, true)
+	if err != nil {
+		t.Fatalf("SignIn() err = %v", err)
+	}
+	if user.Name != "Sam" || user.EmailAddress != "sam@example.com" || !user.IsVerified() {
+		t.Errorf("SignIn() = %+v, want a verified user for sam", user)
+	}
+}
@@ -0,0 +1,189 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/exif"
+)
+
+// ImageExif is the camera information read from an image
+// when it was uploaded
+type ImageExif struct {
+	Make         string
+	Model        string
+	LensModel    string
+	ExposureTime string
+	FNumber      float64
+	ISO          int
+	FocalLength  float64
+	TakenAt      *time.Time
+}
+
+// HasData reports whether any metadata was found
+func (e ImageExif) HasData() bool {
+	return e.Camera() != "" || e.LensModel != "" || e.Settings() != "" || e.TakenAt != nil
+}
+
+// Camera returns the make and model of the camera, without
+// repeating the make when the model already includes it
+func (e ImageExif) Camera() string {
+	if e.Make == "" || strings.HasPrefix(strings.ToLower(e.Model), strings.ToLower(e.Make)) {
+		return e.Model
+	}
+
+	return strings.TrimSpace(e.Make + " " + e.Model)
+}
+
+// Settings summarises the exposure e.g. 1/250s f/2.8 ISO 200 50mm
+func (e ImageExif) Settings() string {
+	var parts []string
+	if e.ExposureTime != "" {
+		parts = append(parts, e.ExposureTime)
+	}
+	if e.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%s", trimFloat(e.FNumber)))
+	}
+	if e.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", e.ISO))
+	}
+	if e.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("%smm", trimFloat(e.FocalLength)))
+	}
+
+	return strings.Join(parts, " · ")
+}
+
+func trimFloat(f float64) string {
+	return strings.TrimSuffix(fmt.Sprintf("%.1f", f), ".0")
+}
+
+// readMetadata fills in the image's EXIF fields and, unless the
+// owner has chosen to keep it, strips anything that could give
+// away where the photo was taken from data
+func (is *imageService) readMetadata(image *Image, format string, data []byte) ([]byte, error) {
+	if format == "jpeg" {
+		meta, err := exif.Parse(data)
+		switch {
+		case err == nil:
+			image.Exif = ImageExif{
+				Make:         meta.Make,
+				Model:        meta.Model,
+				LensModel:    meta.LensModel,
+				ExposureTime: meta.ExposureTime,
+				FNumber:      meta.FNumber,
+				ISO:          meta.ISO,
+				FocalLength:  meta.FocalLength,
+				TakenAt:      meta.TakenAt,
+			}
+		case err != exif.ErrNoExif:
+			// plenty of images have broken EXIF data, that's no
+			// reason to turn the upload away. It can't be checked
+			// for a location though, so none of it is kept.
+			return stripExif(data)
+		}
+	}
+
+	// a location can also be in XMP or in metadata we don't
+	// parse, so there's no telling without looking at the owner
+	owner, err := is.userDB.ByID(image.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if owner.KeepPhotoLocation {
+		return data, nil
+	}
+
+	return stripLocation(format, data)
+}
+
+// stripLocation removes the location from an image in any of
+// the formats we accept. Only JPEGs have their other metadata
+// kept, for the rest we don't read it so all of it goes.
+func stripLocation(format string, data []byte) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		stripped, err := exif.StripGPS(data)
+		if err != nil {
+			return stripExif(data)
+		}
+		return stripped, nil
+	case "png":
+		stripped, err := exif.StripPNG(data)
+		if err != nil {
+			return reencodePNG(data)
+		}
+		return stripped, nil
+	case "webp":
+		// there's no WebP encoder to fall back on
+		stripped, err := exif.StripWebP(data)
+		if err != nil {
+			return nil, ErrImageType
+		}
+		return stripped, nil
+	case "gif":
+		return reencodeGIF(data)
+	}
+
+	return nil, ErrImageType
+}
+
+// stripExif removes all of the metadata from a JPEG whose EXIF
+// data can't be read. If even the JPEG's segments are broken
+// the image is re-encoded, which only keeps the pixels.
+func stripExif(data []byte) ([]byte, error) {
+	stripped, err := exif.Strip(data)
+	if err == nil {
+		return stripped, nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// reencodePNG is for PNGs whose chunks can't be walked, PNG is
+// lossless so only the metadata is lost
+func reencodePNG(data []byte) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageType
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// reencodeGIF drops the comments and application extensions XMP
+// is kept in. Every frame and its timing survive, along with how
+// many times the animation loops.
+func reencodeGIF(data []byte) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrImageType
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,229 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strings"
+
+	"golang.org/x/image/draw"
+
+	// register the webp decoder, there is no encoder so webp
+	// uploads are only ever served at their original size
+	_ "golang.org/x/image/webp"
+)
+
+// imageSize is a derived version of an uploaded image that is
+// scaled down so its longest edge is at most MaxEdge pixels
+type imageSize struct {
+	Name    string
+	MaxEdge int
+}
+
+// imageSizes are ordered largest first so each one can be
+// scaled from the previous, which is much quicker than always
+// starting from the original
+var imageSizes = []imageSize{
+	{Name: "large", MaxEdge: 1600},
+	{Name: "medium", MaxEdge: 800},
+	{Name: "thumb", MaxEdge: 300},
+}
+
+// ImageVariant is one of the derived sizes of an Image
+type ImageVariant struct {
+	Name   string
+	Width  int
+	Height int
+	URL    string
+}
+
+// ThumbPath is the URL of the smallest version of the image,
+// falling back to the original when no thumbnail was made
+func (i *Image) ThumbPath() string {
+	if v := i.variant("thumb"); v != nil {
+		return v.URL
+	}
+
+	return i.Path()
+}
+
+// SrcSet returns a srcset attribute value listing every size
+// of the image so browsers can pick the smallest that fits
+func (i *Image) SrcSet() string {
+	var parts []string
+	for j := len(i.Variants) - 1; j >= 0; j-- {
+		v := i.Variants[j]
+		parts = append(parts, fmt.Sprintf("%s %dw", v.URL, v.Width))
+	}
+	if i.Width > 0 {
+		parts = append(parts, fmt.Sprintf("%s %dw", i.Path(), i.Width))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+func (i *Image) variant(name string) *ImageVariant {
+	for j := range i.Variants {
+		if i.Variants[j].Name == name {
+			return &i.Variants[j]
+		}
+	}
+
+	return nil
+}
+
+// variantKey is where the named size of the image is stored
+func (i *Image) variantKey(name string) string {
+	return fmt.Sprintf("%v%v/%v", imagePrefix(i.GalleryID), name, i.Filename)
+}
+
+// fillVariants works out which sizes exist for the image from
+// its dimensions. A size is only generated when it is smaller
+// than the original.
+func (is *imageService) fillVariants(img *Image) {
+	img.URL = is.store.URL(img.Key())
+	img.Variants = nil
+	if img.Width <= 0 || img.Height <= 0 {
+		return
+	}
+
+	for _, size := range imageSizes {
+		w, h, ok := scaledSize(img.Width, img.Height, size.MaxEdge)
+		if !ok {
+			continue
+		}
+		key := img.variantKey(size.Name)
+		img.Variants = append(img.Variants, ImageVariant{
+			Name:   size.Name,
+			Width:  w,
+			Height: h,
+			URL:    is.store.URL(key),
+		})
+	}
+}
+
+// encodedVariant is a smaller size of an image that is ready
+// to be stored
+type encodedVariant struct {
+	name string
+	data []byte
+}
+
+// makeVariants decodes data and stores every size smaller than
+// the original, recording the original dimensions on img
+func (is *imageService) makeVariants(img *Image, data []byte) error {
+	variants, err := encodeVariants(img, data)
+	if err != nil {
+		return err
+	}
+
+	return is.storeVariants(img, variants)
+}
+
+// encodeVariants decodes data and encodes every size smaller
+// than the original, recording the original dimensions and the
+// bytes the sizes take up on img
+func encodeVariants(img *Image, data []byte) ([]encodedVariant, error) {
+	img.VariantsSize = 0
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := src.Bounds()
+	img.Width = bounds.Dx()
+	img.Height = bounds.Dy()
+	if !canEncode(format) {
+		img.Width, img.Height = 0, 0
+		return nil, nil
+	}
+
+	var variants []encodedVariant
+	var total int64
+	for _, size := range imageSizes {
+		w, h, ok := scaledSize(img.Width, img.Height, size.MaxEdge)
+		if !ok {
+			continue
+		}
+
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, dst, format); err != nil {
+			return nil, err
+		}
+		variants = append(variants, encodedVariant{name: size.Name, data: buf.Bytes()})
+		total += int64(buf.Len())
+
+		src = dst
+	}
+	img.VariantsSize = total
+
+	return variants, nil
+}
+
+func (is *imageService) storeVariants(img *Image, variants []encodedVariant) error {
+	for _, v := range variants {
+		if err := is.store.Put(img.variantKey(v.name), bytes.NewReader(v.data)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (is *imageService) deleteVariants(img *Image) {
+	for _, size := range imageSizes {
+		is.store.Delete(img.variantKey(size.Name))
+	}
+}
+
+// scaledSize returns the dimensions of a w x h image scaled to
+// fit within maxEdge, or false if it already fits
+func scaledSize(w, h, maxEdge int) (int, int, bool) {
+	if w <= maxEdge && h <= maxEdge {
+		return w, h, false
+	}
+
+	if w >= h {
+		return maxEdge, max1(h * maxEdge / w), true
+	}
+
+	return max1(w * maxEdge / h), maxEdge, true
+}
+
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+
+	return n
+}
+
+func canEncode(format string) bool {
+	switch format {
+	case "jpeg", "png", "gif":
+		return true
+	}
+
+	return false
+}
+
+// encodeImage writes img using the same format as the upload
+// so derived sizes keep the original's file extension
+func encodeImage(buf *bytes.Buffer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(buf, img, &jpeg.Options{Quality: 85})
+	case "png":
+		return png.Encode(buf, img)
+	case "gif":
+		return gif.Encode(buf, img, nil)
+	default:
+		return fmt.Errorf("models: cannot encode %s images", format)
+	}
+}
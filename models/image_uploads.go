@@ -0,0 +1,157 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/arnoldokoth/lenslocked.com/rand"
+)
+
+const maxOriginalNameLen = 255
+
+// UploadLimits restrict what users are allowed to upload
+type UploadLimits struct {
+	// MaxFileSize is the largest single image in bytes
+	MaxFileSize int64
+	// MaxPixels is the most pixels a decoded image may have,
+	// which keeps tiny files that decode to huge bitmaps out
+	MaxPixels int
+	// Quota is how many bytes of images each user can store
+	Quota int64
+}
+
+// DefaultUploadLimits ...
+func DefaultUploadLimits() UploadLimits {
+	return UploadLimits{
+		MaxFileSize: 20 << 20,
+		MaxPixels:   50 * 1000 * 1000,
+		Quota:       1 << 30,
+	}
+}
+
+// allowedImageTypes maps the sniffed content type of an upload
+// to the name image.Decode registers the format under
+var allowedImageTypes = map[string]string{
+	"image/jpeg": "jpeg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// imageExtensions are the extensions generated filenames get
+// for each format
+var imageExtensions = map[string]string{
+	"jpeg": ".jpg",
+	"png":  ".png",
+	"gif":  ".gif",
+	"webp": ".webp",
+}
+
+// readUpload reads at most MaxFileSize bytes of r and checks
+// the content really is an image we accept, returning the
+// format it was decoded as
+func (is *imageService) readUpload(r io.Reader) ([]byte, string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, is.limits.MaxFileSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if int64(len(data)) > is.limits.MaxFileSize {
+		return nil, "", modelError(fmt.Sprintf("models: images must be smaller than %s",
+			formatBytes(is.limits.MaxFileSize)))
+	}
+
+	contentType := http.DetectContentType(data)
+	format, ok := allowedImageTypes[contentType]
+	if !ok {
+		return nil, "", ErrImageType
+	}
+
+	// only the header is decoded here so a decompression bomb
+	// is rejected before any pixels are allocated
+	cfg, decodedFormat, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || decodedFormat != format {
+		return nil, "", ErrImageType
+	}
+
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > is.limits.MaxPixels {
+		return nil, "", modelError(fmt.Sprintf("models: images can be at most %d megapixels",
+			is.limits.MaxPixels/1000000))
+	}
+
+	return data, format, nil
+}
+
+// newImageFilename returns a random filename for an image so
+// uploads can't collide with or overwrite each other
+func newImageFilename(format string) (string, error) {
+	// 12 bytes encode to 16 base64 characters with no padding
+	name, err := rand.String(12)
+	if err != nil {
+		return "", err
+	}
+
+	return name + imageExtensions[format], nil
+}
+
+// cleanOriginalName reduces the name the browser sent to just
+// the file's base name so it's safe to display
+func cleanOriginalName(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = path.Base(name)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+
+	if len(name) > maxOriginalNameLen {
+		name = strings.ToValidUTF8(name[:maxOriginalNameLen], "")
+	}
+
+	return name
+}
+
+// checkQuota makes sure storing size more bytes for the user
+// would keep them within their quota
+func (is *imageService) checkQuota(userID uint, size int64) error {
+	used, err := is.ImageDB.UsageByUserID(userID)
+	if err != nil {
+		return err
+	}
+
+	if used+size > is.limits.Quota {
+		return modelError(fmt.Sprintf("models: this upload would exceed your %s storage limit, you are using %s",
+			formatBytes(is.limits.Quota), formatBytes(used)))
+	}
+
+	return nil
+}
+
+// formatBytes turns n into a short human readable size
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
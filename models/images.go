@@ -1,105 +1,599 @@
 package models
 
 import (
+	"bytes"
 	"fmt"
 	"io"
-	"net/url"
-	"os"
-	"path/filepath"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
 	"strings"
+
+	"github.com/arnoldokoth/lenslocked.com/storage"
+	"github.com/jinzhu/gorm"
 )
 
-// Image ...
+// Image is a single photo in a gallery. The file itself lives
+// in storage, the row keeps track of everything else.
+//
+// Filename is generated by the service when the image is
+// created and is what the file is stored as, the name the file
+// had on the uploader's computer is kept in OriginalName.
 type Image struct {
-	GalleryID uint
-	Filename  string
+	gorm.Model
+	GalleryID    uint   `gorm:"not null;index"`
+	UserID       uint   `gorm:"not null;index"`
+	Filename     string `gorm:"not null"`
+	OriginalName string
+	Caption      string
+	Position     int   `gorm:"not null;default:0"`
+	Size         int64 `gorm:"not null;default:0"`
+	// VariantsSize is how many bytes the smaller sizes of the
+	// image take up, they count towards the owner's quota too
+	VariantsSize int64 `gorm:"not null;default:0"`
+	Width        int
+	Height       int
+	Exif         ImageExif      `gorm:"embedded;embedded_prefix:exif_"`
+	URL          string         `gorm:"-"`
+	Variants     []ImageVariant `gorm:"-"`
 }
 
-// Path ...
+// Path is the URL the image is served from
 func (i *Image) Path() string {
-	temp := url.URL{
-		Path: "/" + i.RelativePath(),
+	return i.URL
+}
+
+// Name is what the image should be called when shown to users
+func (i *Image) Name() string {
+	if i.OriginalName != "" {
+		return i.OriginalName
 	}
 
-	return temp.String()
+	return i.Filename
 }
 
-// RelativePath ...
-func (i *Image) RelativePath() string {
-	return fmt.Sprintf("images/galleries/%v/%v", i.GalleryID, i.Filename)
+// Key is where the image lives in storage
+func (i *Image) Key() string {
+	return fmt.Sprintf("%v%v", imagePrefix(i.GalleryID), i.Filename)
+}
+
+// ImageDB ...
+type ImageDB interface {
+	ByID(id uint) (*Image, error)
+	ByGalleryID(galleryID uint) ([]Image, error)
+	// All returns every image record, oldest first
+	All() ([]Image, error)
+	// UsageByUserID is how many bytes of images the user has,
+	// counting every size of each image
+	UsageByUserID(userID uint) (int64, error)
+
+	Create(image *Image) error
+	Update(image *Image) error
+	Delete(id uint) error
+	// DeleteByGalleryID permanently removes every image record
+	// of the gallery
+	DeleteByGalleryID(galleryID uint) error
 }
 
 // ImageService ...
 type ImageService interface {
-	Create(galleryID uint, r io.ReadCloser, filename string) error
+	// Create validates the contents of r, saves it to
+	// storage under a newly generated filename and records
+	// the image in the database
+	Create(image *Image, r io.ReadCloser) error
+	Update(image *Image) error
+	// Delete removes both the stored file and the record
 	Delete(image *Image) error
+	// DeleteByGalleryID removes every file stored for the
+	// gallery, including ones without a record, and then all of
+	// its image records
+	DeleteByGalleryID(galleryID uint) error
+
+	ByID(id uint) (*Image, error)
 	ByGalleryID(galleryID uint) ([]Image, error)
+
+	// Open returns the original file of the image, it is up to
+	// the caller to close it
+	Open(image *Image) (io.ReadCloser, error)
+
+	// Reconcile imports files that are in storage but have
+	// no database record e.g. uploads from before images
+	// were stored in the database. It returns how many
+	// images were imported.
+	Reconcile() (int, error)
+
+	// Orphans returns the images whose original file is missing
+	// from storage, the opposite of what Reconcile imports
+	Orphans() ([]Image, error)
+
+	// Limits returns the restrictions uploads are checked against
+	Limits() UploadLimits
+
+	// As returns an ImageService that records actor against the
+	// audit events it writes for uploads and changes to images
+	As(actor Actor) ImageService
 }
 
 // NewImageService ...
-func NewImageService() ImageService {
-	return &imageService{}
+func NewImageService(db *gorm.DB, store storage.Storage, limits UploadLimits) ImageService {
+	return &imageService{
+		ImageDB: &imageValidator{
+			ImageDB: &imageGorm{db},
+		},
+		galleryDB: &galleryGorm{db},
+		userDB:    &userGorm{db},
+		store:     store,
+		limits:    limits,
+		audit:     newAuditor(db),
+	}
+}
+
+type imageService struct {
+	ImageDB
+	galleryDB GalleryDB
+	userDB    UserDB
+	store     storage.Storage
+	limits    UploadLimits
+	audit     auditor
 }
 
-type imageService struct{}
+var _ ImageService = &imageService{}
 
-func (is *imageService) Create(galleryID uint, r io.ReadCloser, filename string) error {
+func (is *imageService) Create(image *Image, r io.ReadCloser) error {
 	defer r.Close()
-	path, err := is.mkImagePath(galleryID)
+
+	existing, err := is.ImageDB.ByGalleryID(image.GalleryID)
 	if err != nil {
 		return err
 	}
+	image.Position = len(existing)
 
-	dst, err := os.Create(path + filename)
+	// the upload is needed twice, once to store the original
+	// and once to decode it for the smaller sizes
+	data, format, err := is.readUpload(r)
 	if err != nil {
 		return err
 	}
 
-	defer dst.Close()
+	// never trust the name the browser sent, it is only kept
+	// around for display
+	image.OriginalName = cleanOriginalName(image.OriginalName)
+	image.Filename, err = newImageFilename(format)
+	if err != nil {
+		return err
+	}
 
-	_, err = io.Copy(dst, r)
+	data, err = is.readMetadata(image, format, data)
 	if err != nil {
 		return err
 	}
 
+	// sizes are worked out from what is actually stored, which
+	// is the upload minus any metadata stripped above
+	image.Size = int64(len(data))
+	variants, err := encodeVariants(image, data)
+	if err != nil {
+		log.Printf("images.Create() could not resize %s: %v", image.Key(), err)
+	}
+	if err := is.checkQuota(image.UserID, image.Size+image.VariantsSize); err != nil {
+		return err
+	}
+
+	if err := is.store.Put(image.Key(), bytes.NewReader(data)); err != nil {
+		return err
+	}
+	if err := is.storeVariants(image, variants); err != nil {
+		log.Printf("images.Create() could not store the sizes of %s: %v", image.Key(), err)
+	}
+
+	if err := is.ImageDB.Create(image); err != nil {
+		is.deleteVariants(image)
+		is.store.Delete(image.Key())
+		return err
+	}
+	is.fillVariants(image)
+	is.audit.record(AuditEvent{
+		Action:     AuditImageUpload,
+		TargetType: AuditTargetImage,
+		TargetID:   image.ID,
+		Detail:     image.OriginalName,
+	})
+
+	return nil
+}
+
+func (is *imageService) Update(image *Image) error {
+	if err := is.ImageDB.Update(image); err != nil {
+		return err
+	}
+
+	is.audit.record(AuditEvent{
+		Action:     AuditImageUpdate,
+		TargetType: AuditTargetImage,
+		TargetID:   image.ID,
+	})
+
 	return nil
 }
 
+func (is *imageService) Limits() UploadLimits {
+	return is.limits
+}
+
 func (is *imageService) Delete(image *Image) error {
-	err := os.Remove(image.RelativePath())
-	return err
+	// only ever remove files from the image's own gallery
+	if _, _, ok := parseImageKey(image.Key()); !ok {
+		return ErrFilenameInvalid
+	}
+
+	err := is.store.Delete(image.Key())
+	if err != nil && err != storage.ErrNotExist {
+		return err
+	}
+	is.deleteVariants(image)
+
+	if err := is.ImageDB.Delete(image.ID); err != nil {
+		return err
+	}
+
+	is.audit.record(AuditEvent{
+		Action:     AuditImageDelete,
+		TargetType: AuditTargetImage,
+		TargetID:   image.ID,
+		Detail:     image.OriginalName,
+	})
+
+	return nil
+}
+
+func (is *imageService) As(actor Actor) ImageService {
+	copied := *is
+	copied.audit.actor = actor
+	return &copied
+}
+
+func (is *imageService) DeleteByGalleryID(galleryID uint) error {
+	if galleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+
+	keys, err := is.store.List(imagePrefix(galleryID))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err := is.store.Delete(key)
+		if err != nil && err != storage.ErrNotExist {
+			return err
+		}
+	}
+
+	return is.ImageDB.DeleteByGalleryID(galleryID)
+}
+
+func (is *imageService) ByID(id uint) (*Image, error) {
+	image, err := is.ImageDB.ByID(id)
+	if err != nil {
+		return nil, err
+	}
+	is.fillVariants(image)
+
+	return image, nil
 }
 
 func (is *imageService) ByGalleryID(galleryID uint) ([]Image, error) {
-	path := is.imagePath(galleryID)
-	imgStrings, err := filepath.Glob(path + "*")
+	images, err := is.ImageDB.ByGalleryID(galleryID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range images {
+		is.fillVariants(&images[i])
+	}
+
+	return images, nil
+}
+
+func (is *imageService) Open(image *Image) (io.ReadCloser, error) {
+	if _, _, ok := parseImageKey(image.Key()); !ok {
+		return nil, ErrFilenameInvalid
+	}
+
+	return is.store.Get(image.Key())
+}
+
+func (is *imageService) Reconcile() (int, error) {
+	keys, err := is.store.List("galleries/")
+	if err != nil {
+		return 0, err
+	}
+
+	imported := 0
+	known := make(map[uint]map[string]bool)
+	for _, key := range keys {
+		galleryID, filename, ok := parseImageKey(key)
+		if !ok {
+			continue
+		}
+
+		filenames, ok := known[galleryID]
+		if !ok {
+			images, err := is.ImageDB.ByGalleryID(galleryID)
+			if err != nil {
+				return imported, err
+			}
+			filenames = make(map[string]bool)
+			for _, img := range images {
+				filenames[img.Filename] = true
+			}
+			known[galleryID] = filenames
+		}
+		if filenames[filename] {
+			continue
+		}
+
+		gallery, err := is.galleryDB.ByID(galleryID)
+		if err == ErrNotFound {
+			log.Printf("images.Reconcile() skipping %s: gallery no longer exists", key)
+			continue
+		}
+		if err != nil {
+			return imported, err
+		}
+
+		image := Image{
+			GalleryID:    galleryID,
+			UserID:       gallery.UserID,
+			Filename:     filename,
+			OriginalName: filename,
+			Position:     len(filenames),
+		}
+		if err := is.importFile(&image); err != nil {
+			log.Printf("images.Reconcile() could not import %s: %v", key, err)
+		}
+		if err := is.ImageDB.Create(&image); err != nil {
+			return imported, err
+		}
+		filenames[filename] = true
+		imported++
+	}
+
+	return imported, nil
+}
+
+func (is *imageService) Orphans() ([]Image, error) {
+	// the records are read first, an upload that lands in
+	// between has its file stored before its record is created
+	// so it can't be mistaken for an orphan
+	images, err := is.ImageDB.All()
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := is.store.List("galleries/")
 	if err != nil {
 		return nil, err
 	}
+	stored := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		stored[key] = true
+	}
+
+	var orphans []Image
+	for _, image := range images {
+		if !stored[image.Key()] {
+			orphans = append(orphans, image)
+		}
+	}
+
+	return orphans, nil
+}
+
+// importFile reads an image that is already in storage so
+// its size is known and its smaller versions exist. It goes
+// through the same metadata handling as an upload, the file is
+// written back if anything was stripped.
+func (is *imageService) importFile(image *Image) error {
+	rc, err := is.store.Get(image.Key())
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	image.Size = int64(len(data))
 
-	ret := make([]Image, len(imgStrings))
-	for i := range imgStrings {
-		imgStrings[i] = strings.Replace(imgStrings[i], path, "", 1)
-		ret[i] = Image{
-			Filename:  imgStrings[i],
-			GalleryID: galleryID,
+	format, ok := allowedImageTypes[http.DetectContentType(data)]
+	if !ok {
+		return ErrImageType
+	}
+	stripped, err := is.readMetadata(image, format, data)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(stripped, data) {
+		if err := is.store.Put(image.Key(), bytes.NewReader(stripped)); err != nil {
+			return err
 		}
+		data = stripped
+		image.Size = int64(len(data))
+	}
+
+	return is.makeVariants(image, data)
+}
+
+type imageValFunc func(*Image) error
+
+func runImageValFuncs(image *Image, fns ...imageValFunc) error {
+	for _, fn := range fns {
+		if err := fn(image); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type imageValidator struct {
+	ImageDB
+}
+
+func (iv *imageValidator) requireGalleryID(image *Image) error {
+	if image.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+
+	return nil
+}
+
+func (iv *imageValidator) requireUserID(image *Image) error {
+	if image.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (iv *imageValidator) requireFilename(image *Image) error {
+	if strings.TrimSpace(image.Filename) == "" {
+		return ErrFilenameRequired
+	}
+
+	return nil
+}
+
+// filenameIsSafe stops filenames from reaching outside of the
+// gallery's directory in storage
+func (iv *imageValidator) filenameIsSafe(image *Image) error {
+	if _, _, ok := parseImageKey(image.Key()); !ok {
+		return ErrFilenameInvalid
+	}
+	if image.Filename == "." || image.Filename == ".." || strings.ContainsAny(image.Filename, `/\`) {
+		return ErrFilenameInvalid
+	}
+
+	return nil
+}
+
+func (iv *imageValidator) trimCaption(image *Image) error {
+	image.Caption = strings.TrimSpace(image.Caption)
+	return nil
+}
+
+func (iv *imageValidator) Create(image *Image) error {
+	err := runImageValFuncs(image, iv.requireGalleryID, iv.requireUserID,
+		iv.requireFilename, iv.filenameIsSafe, iv.trimCaption)
+	if err != nil {
+		return err
+	}
+
+	return iv.ImageDB.Create(image)
+}
+
+func (iv *imageValidator) Update(image *Image) error {
+	err := runImageValFuncs(image, iv.requireGalleryID, iv.requireUserID,
+		iv.requireFilename, iv.filenameIsSafe, iv.trimCaption)
+	if err != nil {
+		return err
+	}
+
+	return iv.ImageDB.Update(image)
+}
+
+func (iv *imageValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
 	}
 
-	return ret, nil
+	return iv.ImageDB.Delete(id)
 }
 
-func (is *imageService) imagePath(galleryID uint) string {
-	return fmt.Sprintf("images/galleries/%v/", galleryID)
+var _ ImageDB = &imageGorm{}
+
+type imageGorm struct {
+	db *gorm.DB
 }
 
-func (is *imageService) mkImagePath(galleryID uint) (string, error) {
-	// create images directory
-	galleryPath := is.imagePath(galleryID)
-	err := os.MkdirAll(galleryPath, 0755)
+func (ig *imageGorm) ByID(id uint) (*Image, error) {
+	var image Image
+	db := ig.db.Where("id = ?", id)
+	err := first(db, &image)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+func (ig *imageGorm) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	err := ig.db.Where("gallery_id = ?", galleryID).
+		Order("position asc, id asc").Find(&images).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (ig *imageGorm) All() ([]Image, error) {
+	var images []Image
+	if err := ig.db.Order("id asc").Find(&images).Error; err != nil {
+		return nil, err
+	}
+
+	return images, nil
+}
+
+func (ig *imageGorm) UsageByUserID(userID uint) (int64, error) {
+	var usage struct {
+		Total int64
+	}
+	err := ig.db.Model(&Image{}).Select("COALESCE(SUM(size + variants_size), 0) AS total").
+		Where("user_id = ?", userID).Scan(&usage).Error
+	if err != nil {
+		return 0, err
+	}
+
+	return usage.Total, nil
+}
+
+func (ig *imageGorm) Create(image *Image) error {
+	return ig.db.Create(image).Error
+}
+
+func (ig *imageGorm) Update(image *Image) error {
+	return ig.db.Save(image).Error
+}
+
+func (ig *imageGorm) Delete(id uint) error {
+	image := Image{Model: gorm.Model{ID: id}}
+	return ig.db.Delete(&image).Error
+}
+
+func (ig *imageGorm) DeleteByGalleryID(galleryID uint) error {
+	return ig.db.Unscoped().Where("gallery_id = ?", galleryID).Delete(&Image{}).Error
+}
+
+func imagePrefix(galleryID uint) string {
+	return fmt.Sprintf("galleries/%v/", galleryID)
+}
+
+// parseImageKey splits galleries/<id>/<filename> back into
+// its parts
+func parseImageKey(key string) (uint, string, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || parts[0] != "galleries" || parts[2] == "" {
+		return 0, "", false
+	}
+
+	id, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil || id == 0 {
+		return 0, "", false
 	}
 
-	return galleryPath, nil
+	return uint(id), parts[2], true
 }
@@ -0,0 +1,264 @@
+package models
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arnoldokoth/lenslocked.com/storage"
+	"github.com/jinzhu/gorm"
+)
+
+// memImageDB keeps images in memory
+type memImageDB struct {
+	ImageDB
+	images []Image
+}
+
+func (db *memImageDB) ByGalleryID(galleryID uint) ([]Image, error) {
+	var images []Image
+	for _, image := range db.images {
+		if image.GalleryID == galleryID {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+func (db *memImageDB) All() ([]Image, error) {
+	return db.images, nil
+}
+
+func (db *memImageDB) UsageByUserID(userID uint) (int64, error) {
+	var total int64
+	for _, image := range db.images {
+		if image.UserID == userID {
+			total += image.Size + image.VariantsSize
+		}
+	}
+	return total, nil
+}
+
+func (db *memImageDB) Create(image *Image) error {
+	image.ID = uint(len(db.images) + 1)
+	db.images = append(db.images, *image)
+	return nil
+}
+
+// testJPEG returns a w x h JPEG with a gradient so it doesn't
+// compress down to nothing
+func testJPEG(t *testing.T, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testImageService returns an image service storing files in a
+// temporary directory, which the caller must remove
+func testImageService(t *testing.T, quota int64) (*imageService, string) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := DefaultUploadLimits()
+	limits.Quota = quota
+	return &imageService{
+		ImageDB: &memImageDB{},
+		userDB:  &memUserDB{users: []*User{{Model: gorm.Model{ID: 1}}}},
+		store:   storage.NewLocal(dir, "/images"),
+		limits:  limits,
+		audit:   auditor{db: &memAuditDB{}},
+	}, dir
+}
+
+func fileSize(t *testing.T, dir, key string) int64 {
+	info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestImageCreateCountsStoredBytes(t *testing.T) {
+	is, dir := testImageService(t, 1<<30)
+	defer os.RemoveAll(dir)
+
+	// EXIF that can't be parsed is stripped before storing
+	data := testJPEG(t, 2000, 1000)
+	broken := []byte("Exif\x00\x00XX\x00\x2aunreadable")
+	upload := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, byte(len(broken) + 2)}, broken...)
+	upload = append(upload, data[2:]...)
+
+	image := Image{GalleryID: 1, UserID: 1, OriginalName: "beach.jpg"}
+	if err := is.Create(&image, ioutil.NopCloser(bytes.NewReader(upload))); err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+
+	if stored := fileSize(t, dir, image.Key()); image.Size != stored || stored >= int64(len(upload)) {
+		t.Errorf("Size = %d, want the %d stripped bytes stored rather than the %d uploaded", image.Size, stored, len(upload))
+	}
+	var variants int64
+	for _, size := range imageSizes {
+		variants += fileSize(t, dir, image.variantKey(size.Name))
+	}
+	if image.VariantsSize != variants || variants == 0 {
+		t.Errorf("VariantsSize = %d, want the %d bytes of the smaller sizes", image.VariantsSize, variants)
+	}
+}
+
+func TestImageCreateQuotaCountsVariants(t *testing.T) {
+	data := testJPEG(t, 2000, 1000)
+
+	is, dir := testImageService(t, 1<<30)
+	defer os.RemoveAll(dir)
+	first := Image{GalleryID: 1, UserID: 1}
+	if err := is.Create(&first, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	total := first.Size + first.VariantsSize
+
+	// room for the original but not its smaller sizes
+	is, dir = testImageService(t, total-1)
+	defer os.RemoveAll(dir)
+	image := Image{GalleryID: 1, UserID: 1}
+	if err := is.Create(&image, ioutil.NopCloser(bytes.NewReader(data))); err == nil {
+		t.Fatal("Create() err = nil, want the quota to be exceeded")
+	}
+	if keys, _ := is.store.List("galleries/"); len(keys) != 0 {
+		t.Errorf("stored %v, want nothing", keys)
+	}
+
+	is, dir = testImageService(t, total)
+	defer os.RemoveAll(dir)
+	if err := is.Create(&image, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Errorf("Create() err = %v, want it to just fit", err)
+	}
+	if used, _ := is.ImageDB.UsageByUserID(1); used != total {
+		t.Errorf("usage = %d, want %d", used, total)
+	}
+}
+
+// the exif package's fixtures all hold the same location
+var locatedFixtures = []string{"gps.jpg", "gps.png", "gps.webp"}
+
+func readLocatedFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("..", "exif", "testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// hasLocation looks for the XMP latitude or the first two
+// rationals of the EXIF one, 51° 30'
+func hasLocation(data []byte) bool {
+	return bytes.Contains(data, []byte("GPSLatitude")) || bytes.Contains(data, []byte("\x33\x00\x00\x00\x01\x00\x00\x00\x1e\x00\x00\x00"))
+}
+
+func storedFile(t *testing.T, dir, key string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(key)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestImageCreateStripsLocation(t *testing.T) {
+	for _, name := range locatedFixtures {
+		t.Run(name, func(t *testing.T) {
+			is, dir := testImageService(t, 1<<30)
+			defer os.RemoveAll(dir)
+
+			data := readLocatedFixture(t, name)
+			if !hasLocation(data) {
+				t.Fatal("the fixture doesn't hold a location")
+			}
+			image := Image{GalleryID: 1, UserID: 1}
+			if err := is.Create(&image, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+				t.Fatalf("Create() err = %v", err)
+			}
+			if hasLocation(storedFile(t, dir, image.Key())) {
+				t.Error("the stored image still has its location")
+			}
+
+			// unless the owner wants to keep it
+			is.userDB.(*memUserDB).users[0].KeepPhotoLocation = true
+			image = Image{GalleryID: 1, UserID: 1}
+			if err := is.Create(&image, ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+				t.Fatalf("Create() err = %v", err)
+			}
+			if !bytes.Equal(storedFile(t, dir, image.Key()), data) {
+				t.Error("the image was changed, want it stored as uploaded")
+			}
+		})
+	}
+}
+
+func TestImageReconcileStripsLocation(t *testing.T) {
+	is, dir := testImageService(t, 1<<30)
+	defer os.RemoveAll(dir)
+	is.galleryDB = &memGalleryDB{galleries: []*Gallery{{Model: gorm.Model{ID: 1}, UserID: 1}}}
+
+	var keys []string
+	for _, name := range locatedFixtures {
+		image := Image{GalleryID: 1, Filename: "copied-in-" + strings.Replace(name, "gps", "photo", 1)}
+		if err := is.store.Put(image.Key(), bytes.NewReader(readLocatedFixture(t, name))); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, image.Key())
+	}
+
+	if n, err := is.Reconcile(); err != nil || n != len(keys) {
+		t.Fatalf("Reconcile() = %d, %v, want %d imported", n, err, len(keys))
+	}
+	for i, image := range is.ImageDB.(*memImageDB).images {
+		data := storedFile(t, dir, image.Key())
+		if hasLocation(data) {
+			t.Errorf("%s still has its location", keys[i])
+		}
+		if image.Size != int64(len(data)) {
+			t.Errorf("%s Size = %d, want %d", keys[i], image.Size, len(data))
+		}
+	}
+}
+
+func TestImageOrphans(t *testing.T) {
+	is, dir := testImageService(t, 1<<30)
+	defer os.RemoveAll(dir)
+
+	kept := Image{GalleryID: 1, UserID: 1}
+	if err := is.Create(&kept, ioutil.NopCloser(bytes.NewReader(testJPEG(t, 20, 20)))); err != nil {
+		t.Fatal(err)
+	}
+	lost := Image{GalleryID: 1, UserID: 1}
+	if err := is.Create(&lost, ioutil.NopCloser(bytes.NewReader(testJPEG(t, 20, 20)))); err != nil {
+		t.Fatal(err)
+	}
+	if err := is.store.Delete(lost.Key()); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans, err := is.Orphans()
+	if err != nil {
+		t.Fatalf("Orphans() err = %v", err)
+	}
+	if len(orphans) != 1 || orphans[0].ID != lost.ID {
+		t.Errorf("Orphans() = %v, want only image %d", orphans, lost.ID)
+	}
+}
@@ -0,0 +1,450 @@
+package models
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// LoginPolicy decides how failed logins are slowed down and
+// when they lock an account or IP address out
+type LoginPolicy struct {
+	// Window is how long a failure counts for, after that
+	// without another one the count starts over
+	Window time.Duration
+	// FreeAttempts is how many failures are allowed before
+	// each attempt has to wait
+	FreeAttempts int
+	// BaseDelay is the wait after the first failure past the
+	// free attempts, it doubles with each failure up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// EmailLockout and IPLockout are how many failures lock
+	// out an email address or IP address for LockoutDuration.
+	// An IP address is allowed more as it may be shared.
+	EmailLockout    int
+	IPLockout       int
+	LockoutDuration time.Duration
+}
+
+// DefaultLoginPolicy ...
+func DefaultLoginPolicy() LoginPolicy {
+	return LoginPolicy{
+		Window:          15 * time.Minute,
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        30 * time.Second,
+		EmailLockout:    10,
+		IPLockout:       100,
+		LockoutDuration: 15 * time.Minute,
+	}
+}
+
+// delay is how long to wait after the last failure before
+// another attempt is allowed
+func (p LoginPolicy) delay(failures int) time.Duration {
+	if failures < p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	return delay
+}
+
+// LoginAttempt is the failed logins recorded against an email
+// address or IP address
+type LoginAttempt struct {
+	gorm.Model
+	Key          string `gorm:"not null;unique_index"`
+	Failures     int    `gorm:"not null;default:0"`
+	LastFailedAt time.Time
+	LockedUntil  *time.Time
+}
+
+// IsLocked ...
+func (la *LoginAttempt) IsLocked(now time.Time) bool {
+	return la.LockedUntil != nil && now.Before(*la.LockedUntil)
+}
+
+// LoginAttemptStore keeps track of failed logins. The memory
+// store is enough for a single server, when running several
+// use the database store so they all see the same failures.
+type LoginAttemptStore interface {
+	// Get returns the attempts recorded against key, or
+	// ErrNotFound when there are none
+	Get(key string) (*LoginAttempt, error)
+	// Fail records a failure against key, failures from before
+	// the window are forgotten first
+	Fail(key string, now time.Time, window time.Duration) (*LoginAttempt, error)
+	Lock(key string, until time.Time) error
+	Reset(key string) error
+}
+
+// LockoutNotifier is called when an account gets locked out
+// so its owner can be told
+type LockoutNotifier func(user *User, until time.Time)
+
+// WithLoginPolicy ...
+func WithLoginPolicy(policy LoginPolicy) UserServiceConfig {
+	return func(us *userService) {
+		us.loginPolicy = policy
+	}
+}
+
+// WithLoginAttemptStore sets where failed logins are recorded,
+// by default they are kept in memory
+func WithLoginAttemptStore(store LoginAttemptStore) UserServiceConfig {
+	return func(us *userService) {
+		us.loginAttempts = store
+	}
+}
+
+// WithDBLoginAttempts records failed logins in the database so
+// every server shares them
+func WithDBLoginAttempts() UserServiceConfig {
+	return func(us *userService) {
+		us.loginAttempts = &loginAttemptGorm{us.db}
+	}
+}
+
+// WithLockoutNotifier ...
+func WithLockoutNotifier(notify LockoutNotifier) UserServiceConfig {
+	return func(us *userService) {
+		us.onLockout = notify
+	}
+}
+
+func emailLoginKey(emailAddress string) string {
+	return "email:" + emailAddress
+}
+
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+func twoFactorLoginKey(userID uint) string {
+	return fmt.Sprintf("2fa:%d", userID)
+}
+
+func passwordCheckKey(userID uint) string {
+	return fmt.Sprintf("password:%d", userID)
+}
+
+func shareLinkKey(linkID uint) string {
+	return fmt.Sprintf("share:%d", linkID)
+}
+
+// checkLogin stops attempts for an email or IP address that is
+// locked out, or for an email address that hasn't waited long
+// enough since its last failure. IP addresses aren't delayed as
+// everyone behind a shared one would have to wait.
+func (us *userService) checkLogin(emailAddress, ip string) error {
+	return us.checkAttempts(emailLoginKey(emailAddress), ip)
+}
+
+// checkAttempts is checkLogin for any key that is throttled
+// like an email address
+func (us *userService) checkAttempts(throttleKey, ip string) error {
+	keys := []string{throttleKey}
+	if ip != "" {
+		keys = append(keys, ipLoginKey(ip))
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		la, err := us.loginAttempts.Get(key)
+		switch err {
+		case nil:
+		case ErrNotFound:
+			continue
+		default:
+			return err
+		}
+
+		if la.IsLocked(now) {
+			log.Printf("login: rejected attempt for locked %s", key)
+			return ErrLoginLocked
+		}
+		if key != throttleKey || now.Sub(la.LastFailedAt) > us.loginPolicy.Window {
+			continue
+		}
+		if now.Before(la.LastFailedAt.Add(us.loginPolicy.delay(la.Failures))) {
+			log.Printf("login: throttled attempt for %s after %d failures", key, la.Failures)
+			return ErrLoginThrottled
+		}
+	}
+
+	return nil
+}
+
+// loginFailed records a failed attempt and locks out the email
+// or IP address once it has failed too often. user is nil if
+// there is no account for the email address.
+func (us *userService) loginFailed(emailAddress, ip string, user *User) {
+	us.attemptFailed(emailLoginKey(emailAddress), ip, user)
+}
+
+// attemptFailed is loginFailed for any key that is locked out
+// like an email address
+func (us *userService) attemptFailed(key, ip string, user *User) {
+	now := time.Now()
+	policy := us.loginPolicy
+	until := now.Add(policy.LockoutDuration)
+
+	la, err := us.loginAttempts.Fail(key, now, policy.Window)
+	if err != nil {
+		log.Println("login: could not record failure ERROR:", err)
+		return
+	}
+	log.Printf("login: failed attempt %d for %s from %s", la.Failures, key, ip)
+	if la.Failures >= policy.EmailLockout && !la.IsLocked(now) {
+		us.lock(key, until)
+		if user != nil && us.onLockout != nil {
+			go us.onLockout(user, until)
+		}
+	}
+
+	if ip == "" {
+		return
+	}
+	key = ipLoginKey(ip)
+	la, err = us.loginAttempts.Fail(key, now, policy.Window)
+	if err != nil {
+		log.Println("login: could not record failure ERROR:", err)
+		return
+	}
+	if la.Failures >= policy.IPLockout && !la.IsLocked(now) {
+		us.lock(key, until)
+	}
+}
+
+func (us *userService) lock(key string, until time.Time) {
+	if err := us.loginAttempts.Lock(key, until); err != nil {
+		log.Printf("login: could not lock %s ERROR: %v", key, err)
+		return
+	}
+	log.Printf("login: locked %s until %s", key, until.Format(time.RFC3339))
+}
+
+// loginSucceeded forgets the failures for the email address.
+// The IP address keeps its count, otherwise someone guessing
+// passwords could reset it by logging into their own account.
+func (us *userService) loginSucceeded(emailAddress string) {
+	us.resetAttempts(emailLoginKey(emailAddress))
+}
+
+// resetAttempts forgets the failures recorded against key
+func (us *userService) resetAttempts(key string) {
+	if err := us.loginAttempts.Reset(key); err != nil {
+		log.Println("login: could not reset failures ERROR:", err)
+	}
+}
+
+// CheckTwoFactor ...
+func (us *userService) CheckTwoFactor(user *User, ip string) error {
+	return us.checkAttempts(twoFactorLoginKey(user.ID), ip)
+}
+
+// TwoFactorFailed ...
+func (us *userService) TwoFactorFailed(user *User, ip string) {
+	us.attemptFailed(twoFactorLoginKey(user.ID), ip, user)
+	us.audit.record(AuditEvent{
+		Action:     AuditLoginFailed,
+		TargetType: AuditTargetUser,
+		TargetID:   user.ID,
+		Detail:     "wrong two-factor code",
+	})
+}
+
+// TwoFactorSucceeded ...
+func (us *userService) TwoFactorSucceeded(user *User) {
+	us.resetAttempts(twoFactorLoginKey(user.ID))
+}
+
+// CheckShareLink ...
+func (us *userService) CheckShareLink(link *ShareLink, ip string) error {
+	return us.checkAttempts(shareLinkKey(link.ID), ip)
+}
+
+// ShareLinkFailed ...
+func (us *userService) ShareLinkFailed(link *ShareLink, ip string) {
+	us.attemptFailed(shareLinkKey(link.ID), ip, nil)
+}
+
+// ShareLinkSucceeded ...
+func (us *userService) ShareLinkSucceeded(link *ShareLink) {
+	us.resetAttempts(shareLinkKey(link.ID))
+}
+
+// NewMemoryLoginAttemptStore ...
+func NewMemoryLoginAttemptStore() LoginAttemptStore {
+	return &loginAttemptMemory{
+		attempts: make(map[string]*LoginAttempt),
+	}
+}
+
+// loginAttemptMemoryPrune is how many keys the memory store
+// holds before it throws away the ones that no longer matter
+const loginAttemptMemoryPrune = 10000
+
+type loginAttemptMemory struct {
+	mu       sync.Mutex
+	attempts map[string]*LoginAttempt
+}
+
+var _ LoginAttemptStore = &loginAttemptMemory{}
+
+func (lam *loginAttemptMemory) Get(key string) (*LoginAttempt, error) {
+	lam.mu.Lock()
+	defer lam.mu.Unlock()
+
+	la, ok := lam.attempts[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	copied := *la
+	return &copied, nil
+}
+
+func (lam *loginAttemptMemory) Fail(key string, now time.Time, window time.Duration) (*LoginAttempt, error) {
+	lam.mu.Lock()
+	defer lam.mu.Unlock()
+
+	if len(lam.attempts) >= loginAttemptMemoryPrune {
+		lam.prune(now, window)
+	}
+
+	la, ok := lam.attempts[key]
+	if !ok {
+		la = &LoginAttempt{Key: key}
+		lam.attempts[key] = la
+	}
+	if now.Sub(la.LastFailedAt) > window {
+		la.Failures = 0
+	}
+	la.Failures++
+	la.LastFailedAt = now
+
+	copied := *la
+	return &copied, nil
+}
+
+func (lam *loginAttemptMemory) Lock(key string, until time.Time) error {
+	lam.mu.Lock()
+	defer lam.mu.Unlock()
+
+	la, ok := lam.attempts[key]
+	if !ok {
+		la = &LoginAttempt{Key: key}
+		lam.attempts[key] = la
+	}
+	la.LockedUntil = &until
+
+	return nil
+}
+
+func (lam *loginAttemptMemory) Reset(key string) error {
+	lam.mu.Lock()
+	defer lam.mu.Unlock()
+
+	delete(lam.attempts, key)
+	return nil
+}
+
+// prune must be called with lam.mu held
+func (lam *loginAttemptMemory) prune(now time.Time, window time.Duration) {
+	for key, la := range lam.attempts {
+		if now.Sub(la.LastFailedAt) > window && !la.IsLocked(now) {
+			delete(lam.attempts, key)
+		}
+	}
+}
+
+type loginAttemptGorm struct {
+	db *gorm.DB
+}
+
+var _ LoginAttemptStore = &loginAttemptGorm{}
+
+func (lag *loginAttemptGorm) Get(key string) (*LoginAttempt, error) {
+	var la LoginAttempt
+	db := lag.db.Where("key = ?", key)
+	err := first(db, &la)
+	if err != nil {
+		return nil, err
+	}
+
+	return &la, nil
+}
+
+// Fail locks the row while counting so concurrent failures on
+// different servers are all counted
+func (lag *loginAttemptGorm) Fail(key string, now time.Time, window time.Duration) (*LoginAttempt, error) {
+	la, err := lag.fail(key, now, window)
+	// with no row to lock two servers can both go to create it,
+	// the one that loses counts its failure against the row the
+	// other created
+	if isUniqueViolation(err) {
+		la, err = lag.fail(key, now, window)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("models: recording failed login: %v", err)
+	}
+
+	return la, nil
+}
+
+func (lag *loginAttemptGorm) fail(key string, now time.Time, window time.Duration) (*LoginAttempt, error) {
+	tx := lag.db.Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	var la LoginAttempt
+	db := tx.Set("gorm:query_option", "FOR UPDATE").Where("key = ?", key)
+	err := first(db, &la)
+	switch err {
+	case nil:
+		if now.Sub(la.LastFailedAt) > window {
+			la.Failures = 0
+		}
+		la.Failures++
+		la.LastFailedAt = now
+		err = tx.Save(&la).Error
+	case ErrNotFound:
+		la = LoginAttempt{Key: key, Failures: 1, LastFailedAt: now}
+		err = tx.Create(&la).Error
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return nil, err
+	}
+
+	return &la, nil
+}
+
+func (lag *loginAttemptGorm) Lock(key string, until time.Time) error {
+	return lag.db.Model(&LoginAttempt{}).Where("key = ?", key).
+		UpdateColumn("locked_until", until).Error
+}
+
+// Reset removes the row permanently, there is nothing worth
+// keeping once the failures are forgiven
+func (lag *loginAttemptGorm) Reset(key string) error {
+	return lag.db.Unscoped().Where("key = ?", key).Delete(&LoginAttempt{}).Error
+}
@@ -0,0 +1,186 @@
+package models
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestLoginPolicyDelay(t *testing.T) {
+	policy := LoginPolicy{FreeAttempts: 3, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{7, 16 * time.Second},
+		{8, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := policy.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	policy.MaxDelay = 500 * time.Millisecond
+	if got := policy.delay(3); got != policy.MaxDelay {
+		t.Errorf("delay(3) = %v, want it capped at %v", got, policy.MaxDelay)
+	}
+}
+
+// seedAttempts records failures against key, all at the time at
+func seedAttempts(t *testing.T, store LoginAttemptStore, key string, failures int, at time.Time) {
+	for i := 0; i < failures; i++ {
+		if _, err := store.Fail(key, at, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckAttempts(t *testing.T) {
+	const key = "email:jon@example.com"
+	const ip = "10.0.0.1"
+	policy := DefaultLoginPolicy()
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, store LoginAttemptStore)
+		want  error
+	}{
+		{"no failures", func(t *testing.T, store LoginAttemptStore) {}, nil},
+		{"free attempts", func(t *testing.T, store LoginAttemptStore) {
+			seedAttempts(t, store, key, policy.FreeAttempts-1, now)
+		}, nil},
+		{"throttled", func(t *testing.T, store LoginAttemptStore) {
+			seedAttempts(t, store, key, policy.FreeAttempts, now)
+		}, ErrLoginThrottled},
+		{"waited long enough", func(t *testing.T, store LoginAttemptStore) {
+			seedAttempts(t, store, key, policy.FreeAttempts, now.Add(-policy.BaseDelay-time.Second))
+		}, nil},
+		{"expired window", func(t *testing.T, store LoginAttemptStore) {
+			seedAttempts(t, store, key, policy.EmailLockout-1, now.Add(-policy.Window-time.Minute))
+		}, nil},
+		{"locked", func(t *testing.T, store LoginAttemptStore) {
+			store.Lock(key, now.Add(time.Minute))
+		}, ErrLoginLocked},
+		{"lock expired", func(t *testing.T, store LoginAttemptStore) {
+			seedAttempts(t, store, key, policy.EmailLockout, now.Add(-policy.Window-time.Minute))
+			store.Lock(key, now.Add(-time.Minute))
+		}, nil},
+		{"locked IP address", func(t *testing.T, store LoginAttemptStore) {
+			store.Lock(ipLoginKey(ip), now.Add(time.Minute))
+		}, ErrLoginLocked},
+		{"IP addresses aren't delayed", func(t *testing.T, store LoginAttemptStore) {
+			seedAttempts(t, store, ipLoginKey(ip), policy.IPLockout-1, now)
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := &userService{loginPolicy: policy, loginAttempts: NewMemoryLoginAttemptStore()}
+			tt.setup(t, us.loginAttempts)
+
+			if err := us.checkAttempts(key, ip); err != tt.want {
+				t.Errorf("checkAttempts() err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttemptFailed(t *testing.T) {
+	const key = "email:jon@example.com"
+	user := &User{EmailAddress: "jon@example.com"}
+	user.ID = 1
+
+	policy := DefaultLoginPolicy()
+	policy.EmailLockout = 3
+	policy.IPLockout = 5
+
+	tests := []struct {
+		name string
+		// earlier failures against the key, the IP address and
+		// how long ago they were
+		failures, ipFailures int
+		ago                  time.Duration
+		user                 *User
+		wantFailures         int
+		wantLocked           bool
+		wantIPLocked         bool
+		wantNotified         bool
+	}{
+		{"counts", 0, 0, 0, user, 1, false, false, false},
+		{"locks out", policy.EmailLockout - 1, 0, 0, user, policy.EmailLockout, true, false, true},
+		{"locks out no account", policy.EmailLockout - 1, 0, 0, nil, policy.EmailLockout, true, false, false},
+		{"locks out the IP address", 0, policy.IPLockout - 1, 0, user, 1, false, true, false},
+		{"expired window", policy.EmailLockout - 1, policy.IPLockout - 1, policy.Window + time.Minute, user, 1, false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notified := make(chan *User, 1)
+			us := &userService{
+				loginPolicy:   policy,
+				loginAttempts: NewMemoryLoginAttemptStore(),
+				onLockout:     func(user *User, until time.Time) { notified <- user },
+			}
+			at := time.Now().Add(-tt.ago)
+			seedAttempts(t, us.loginAttempts, key, tt.failures, at)
+			seedAttempts(t, us.loginAttempts, ipLoginKey("10.0.0.1"), tt.ipFailures, at)
+
+			us.attemptFailed(key, "10.0.0.1", tt.user)
+
+			now := time.Now()
+			la, err := us.loginAttempts.Get(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if la.Failures != tt.wantFailures || la.IsLocked(now) != tt.wantLocked {
+				t.Errorf("attempts = %d failures locked %v, want %d locked %v", la.Failures, la.IsLocked(now), tt.wantFailures, tt.wantLocked)
+			}
+			ipLA, err := us.loginAttempts.Get(ipLoginKey("10.0.0.1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ipLA.IsLocked(now) != tt.wantIPLocked {
+				t.Errorf("IP address locked = %v, want %v", ipLA.IsLocked(now), tt.wantIPLocked)
+			}
+
+			select {
+			case got := <-notified:
+				if !tt.wantNotified || got != tt.user {
+					t.Errorf("lockout notified for %v, want notified %v", got, tt.wantNotified)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.wantNotified {
+					t.Error("the user wasn't told about the lockout")
+				}
+			}
+		})
+	}
+}
+
+func TestIsUniqueViolation(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&pq.Error{Code: "23505"}, true},
+		{&pq.Error{Code: "40001"}, false},
+		{errors.New("duplicate key"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if got := isUniqueViolation(tt.err); got != tt.want {
+			t.Errorf("isUniqueViolation(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/arnoldokoth/lenslocked.com/encrypt"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/oauth2"
+)
+
+// OAuthDropbox is the service name Dropbox tokens are stored under
+const OAuthDropbox = "dropbox"
+
+// OAuth is a token a user granted us for a third party
+// service. Each user has at most one token per service. The
+// access and refresh tokens are encrypted in the database.
+type OAuth struct {
+	gorm.Model
+	UserID  uint   `gorm:"not null;unique_index:user_id_service"`
+	Service string `gorm:"not null;unique_index:user_id_service"`
+	oauth2.Token
+}
+
+// OAuthDB ...
+type OAuthDB interface {
+	Find(userID uint, service string) (*OAuth, error)
+	ByUserID(userID uint) ([]OAuth, error)
+
+	Create(oauth *OAuth) error
+	Update(oauth *OAuth) error
+	Delete(id uint) error
+}
+
+// OAuthService ...
+type OAuthService interface {
+	OAuthDB
+
+	// Client returns an HTTP client that authenticates as the
+	// user with the stored token. Expired tokens are refreshed
+	// using config and the new token is saved. ErrNotFound is
+	// returned when there is no token that can be used.
+	Client(ctx context.Context, config *oauth2.Config, userID uint, service string) (*http.Client, error)
+}
+
+// NewOAuthService ...
+func NewOAuthService(db *gorm.DB, encryptionKey string) OAuthService {
+	return &oauthService{
+		OAuthDB: &oauthValidator{
+			OAuthDB: &oauthGorm{db},
+			cipher:  encrypt.NewAES(encryptionKey),
+		},
+	}
+}
+
+type oauthService struct {
+	OAuthDB
+}
+
+func (oas *oauthService) Client(ctx context.Context, config *oauth2.Config, userID uint, service string) (*http.Client, error) {
+	oauth, err := oas.Find(userID, service)
+	if err != nil {
+		return nil, err
+	}
+	// the token couldn't be decrypted, the user has to connect
+	// the service again
+	if oauth.AccessToken == "" {
+		return nil, ErrNotFound
+	}
+
+	token := oauth.Token
+	ts := &savingTokenSource{
+		base:  config.TokenSource(ctx, &token),
+		db:    oas.OAuthDB,
+		oauth: oauth,
+	}
+
+	return oauth2.NewClient(ctx, oauth2.ReuseTokenSource(&token, ts)), nil
+}
+
+// savingTokenSource writes refreshed tokens back to the
+// database so the next request doesn't have to refresh again
+type savingTokenSource struct {
+	base  oauth2.TokenSource
+	db    OAuthDB
+	oauth *OAuth
+}
+
+func (ts *savingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := ts.base.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if token.AccessToken != ts.oauth.AccessToken {
+		ts.oauth.Token = *token
+		if err := ts.db.Update(ts.oauth); err != nil {
+			return nil, err
+		}
+	}
+
+	return token, nil
+}
+
+type oauthValFunc func(*OAuth) error
+
+func runOAuthValFuncs(oauth *OAuth, fns ...oauthValFunc) error {
+	for _, fn := range fns {
+		if err := fn(oauth); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type oauthValidator struct {
+	OAuthDB
+	cipher encrypt.AES
+}
+
+func (ov *oauthValidator) requireUserID(oauth *OAuth) error {
+	if oauth.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (ov *oauthValidator) normalizeService(oauth *OAuth) error {
+	oauth.Service = strings.ToLower(strings.TrimSpace(oauth.Service))
+	if oauth.Service == "" {
+		return ErrServiceRequired
+	}
+
+	return nil
+}
+
+func (ov *oauthValidator) requireAccessToken(oauth *OAuth) error {
+	if oauth.AccessToken == "" {
+		return ErrAccessTokenRequired
+	}
+
+	return nil
+}
+
+// encryptTokens must run last, on a copy of the caller's OAuth
+// so they can keep using the tokens
+func (ov *oauthValidator) encryptTokens(oauth *OAuth) error {
+	access, err := ov.cipher.Encrypt(oauth.AccessToken)
+	if err != nil {
+		return err
+	}
+	oauth.AccessToken = access
+
+	// not every service hands out refresh tokens
+	if oauth.RefreshToken == "" {
+		return nil
+	}
+	refresh, err := ov.cipher.Encrypt(oauth.RefreshToken)
+	if err != nil {
+		return err
+	}
+	oauth.RefreshToken = refresh
+
+	return nil
+}
+
+// decryptTokens clears tokens that can't be decrypted, because
+// they were saved before tokens were encrypted or the key has
+// changed, rather than failing. The row can then still be found
+// and replaced when the user connects the service again.
+func (ov *oauthValidator) decryptTokens(oauth *OAuth) error {
+	access, err := ov.cipher.Decrypt(oauth.AccessToken)
+	refresh := ""
+	if err == nil && oauth.RefreshToken != "" {
+		refresh, err = ov.cipher.Decrypt(oauth.RefreshToken)
+	}
+	if err != nil {
+		access, refresh = "", ""
+	}
+	oauth.AccessToken = access
+	oauth.RefreshToken = refresh
+
+	return nil
+}
+
+func (ov *oauthValidator) Find(userID uint, service string) (*OAuth, error) {
+	oauth := OAuth{UserID: userID, Service: service}
+	err := runOAuthValFuncs(&oauth, ov.requireUserID, ov.normalizeService)
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := ov.OAuthDB.Find(oauth.UserID, oauth.Service)
+	if err != nil {
+		return nil, err
+	}
+	if err := runOAuthValFuncs(found, ov.decryptTokens); err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+func (ov *oauthValidator) ByUserID(userID uint) ([]OAuth, error) {
+	oauths, err := ov.OAuthDB.ByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range oauths {
+		if err := runOAuthValFuncs(&oauths[i], ov.decryptTokens); err != nil {
+			return nil, err
+		}
+	}
+
+	return oauths, nil
+}
+
+func (ov *oauthValidator) Create(oauth *OAuth) error {
+	err := runOAuthValFuncs(oauth, ov.requireUserID, ov.normalizeService,
+		ov.requireAccessToken)
+	if err != nil {
+		return err
+	}
+
+	stored := *oauth
+	if err := runOAuthValFuncs(&stored, ov.encryptTokens); err != nil {
+		return err
+	}
+	err = ov.OAuthDB.Create(&stored)
+	oauth.Model = stored.Model
+
+	return err
+}
+
+func (ov *oauthValidator) Update(oauth *OAuth) error {
+	err := runOAuthValFuncs(oauth, ov.requireUserID, ov.normalizeService,
+		ov.requireAccessToken)
+	if err != nil {
+		return err
+	}
+
+	stored := *oauth
+	if err := runOAuthValFuncs(&stored, ov.encryptTokens); err != nil {
+		return err
+	}
+	err = ov.OAuthDB.Update(&stored)
+	oauth.Model = stored.Model
+
+	return err
+}
+
+func (ov *oauthValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+
+	return ov.OAuthDB.Delete(id)
+}
+
+var _ OAuthDB = &oauthGorm{}
+
+type oauthGorm struct {
+	db *gorm.DB
+}
+
+func (og *oauthGorm) Find(userID uint, service string) (*OAuth, error) {
+	var oauth OAuth
+	db := og.db.Where("user_id = ? AND service = ?", userID, service)
+	err := first(db, &oauth)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth, nil
+}
+
+func (og *oauthGorm) ByUserID(userID uint) ([]OAuth, error) {
+	var oauths []OAuth
+	err := og.db.Where("user_id = ?", userID).Find(&oauths).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return oauths, nil
+}
+
+func (og *oauthGorm) Create(oauth *OAuth) error {
+	return og.db.Create(oauth).Error
+}
+
+func (og *oauthGorm) Update(oauth *OAuth) error {
+	return og.db.Save(oauth).Error
+}
+
+// Delete removes the token permanently so the user can
+// connect the service again without hitting the unique index
+func (og *oauthGorm) Delete(id uint) error {
+	oauth := OAuth{Model: gorm.Model{ID: id}}
+	return og.db.Unscoped().Delete(&oauth).Error
+}
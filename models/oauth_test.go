@@ -0,0 +1,177 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/dropbox"
+	"github.com/arnoldokoth/lenslocked.com/dropbox/dropboxtest"
+	"github.com/arnoldokoth/lenslocked.com/encrypt"
+	"golang.org/x/oauth2"
+)
+
+// memOAuthDB keeps a single token in memory and remembers what
+// was saved
+type memOAuthDB struct {
+	OAuthDB
+	oauth   OAuth
+	updates []string
+}
+
+func (db *memOAuthDB) Find(userID uint, service string) (*OAuth, error) {
+	if userID != db.oauth.UserID || service != db.oauth.Service {
+		return nil, ErrNotFound
+	}
+	oauth := db.oauth
+	return &oauth, nil
+}
+
+func (db *memOAuthDB) Create(oauth *OAuth) error {
+	db.oauth = *oauth
+	db.oauth.ID = 1
+	oauth.ID = 1
+	return nil
+}
+
+func (db *memOAuthDB) Update(oauth *OAuth) error {
+	db.oauth = *oauth
+	db.updates = append(db.updates, oauth.AccessToken)
+	return nil
+}
+
+func TestOAuthClientSavesRefreshedToken(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+	srv.AddFile("/a.jpg", []byte("a"))
+
+	db := &memOAuthDB{oauth: OAuth{
+		UserID:  1,
+		Service: OAuthDropbox,
+		Token: oauth2.Token{
+			AccessToken:  "stale",
+			RefreshToken: srv.RefreshToken,
+			TokenType:    "bearer",
+			Expiry:       time.Now().Add(-time.Minute),
+		},
+	}}
+	config := &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{TokenURL: srv.TokenURL()},
+	}
+	oas := &oauthService{OAuthDB: db}
+
+	list := func() {
+		client, err := oas.Client(context.Background(), config, 1, OAuthDropbox)
+		if err != nil {
+			t.Fatalf("Client() err = %v", err)
+		}
+		c := dropbox.NewClient(client, dropbox.WithAPIURL(srv.URL+"/"), dropbox.WithContentURL(srv.URL))
+		for i := 0; i < 2; i++ {
+			if _, err := c.List(""); err != nil {
+				t.Fatalf("List() err = %v", err)
+			}
+		}
+	}
+
+	list()
+	if refreshes, _ := srv.Stats(); refreshes != 1 {
+		t.Fatalf("refreshed %d times, want 1", refreshes)
+	}
+	if len(db.updates) != 1 || db.updates[0] != "access-1" {
+		t.Fatalf("saved tokens %v, want [access-1]", db.updates)
+	}
+	if db.oauth.RefreshToken != srv.RefreshToken || !db.oauth.Expiry.After(time.Now()) {
+		t.Errorf("saved token %+v, want the refresh token kept and a new expiry", db.oauth.Token)
+	}
+
+	// a new client starts from the saved token and doesn't refresh
+	list()
+	if refreshes, _ := srv.Stats(); refreshes != 1 {
+		t.Errorf("refreshed %d times after saving, want 1", refreshes)
+	}
+	if len(db.updates) != 1 {
+		t.Errorf("saved tokens %v, want only the first refresh", db.updates)
+	}
+}
+
+func TestOAuthClientRefreshFails(t *testing.T) {
+	srv := dropboxtest.NewServer()
+	defer srv.Close()
+
+	db := &memOAuthDB{oauth: OAuth{
+		UserID:  1,
+		Service: OAuthDropbox,
+		Token: oauth2.Token{
+			AccessToken:  "stale",
+			RefreshToken: "revoked",
+			Expiry:       time.Now().Add(-time.Minute),
+		},
+	}}
+	config := &oauth2.Config{Endpoint: oauth2.Endpoint{TokenURL: srv.TokenURL()}}
+
+	client, err := (&oauthService{OAuthDB: db}).Client(context.Background(), config, 1, OAuthDropbox)
+	if err != nil {
+		t.Fatalf("Client() err = %v", err)
+	}
+	c := dropbox.NewClient(client, dropbox.WithAPIURL(srv.URL+"/"), dropbox.WithContentURL(srv.URL))
+	if _, err := c.List(""); err == nil {
+		t.Error("List() err = nil, want the refresh to fail")
+	}
+	if len(db.updates) != 0 {
+		t.Errorf("saved tokens %v, want none", db.updates)
+	}
+}
+
+func TestOAuthTokensEncrypted(t *testing.T) {
+	db := &memOAuthDB{}
+	ov := &oauthValidator{OAuthDB: db, cipher: encrypt.NewAES("key")}
+
+	oauth := OAuth{
+		UserID:  1,
+		Service: OAuthDropbox,
+		Token:   oauth2.Token{AccessToken: "access", RefreshToken: "refresh"},
+	}
+	if err := ov.Create(&oauth); err != nil {
+		t.Fatalf("Create() err = %v", err)
+	}
+	if oauth.ID != 1 || oauth.AccessToken != "access" || oauth.RefreshToken != "refresh" {
+		t.Errorf("Create() left %+v, want the ID set and the tokens untouched", oauth)
+	}
+	if db.oauth.AccessToken == "access" || db.oauth.RefreshToken == "refresh" || db.oauth.AccessToken == "" {
+		t.Errorf("stored %+v, want the tokens encrypted", db.oauth.Token)
+	}
+
+	found, err := ov.Find(1, OAuthDropbox)
+	if err != nil {
+		t.Fatalf("Find() err = %v", err)
+	}
+	if found.AccessToken != "access" || found.RefreshToken != "refresh" {
+		t.Errorf("Find() = %+v, want the tokens decrypted", found.Token)
+	}
+
+	// a refreshed token is encrypted too
+	found.AccessToken = "access-2"
+	if err := ov.Update(found); err != nil {
+		t.Fatalf("Update() err = %v", err)
+	}
+	if db.oauth.AccessToken == "access-2" || found.AccessToken != "access-2" {
+		t.Errorf("stored %q, want access-2 encrypted", db.oauth.AccessToken)
+	}
+
+	// tokens stored before they were encrypted can't be used, so
+	// the user is asked to connect again
+	db.oauth.Token = oauth2.Token{AccessToken: "plaintext", RefreshToken: "plaintext"}
+	found, err = ov.Find(1, OAuthDropbox)
+	if err != nil {
+		t.Fatalf("Find() err = %v", err)
+	}
+	if found.ID != 1 || found.AccessToken != "" || found.RefreshToken != "" {
+		t.Errorf("Find() = %+v, want the row with its tokens cleared", found)
+	}
+	oas := &oauthService{OAuthDB: ov}
+	if _, err := oas.Client(context.Background(), &oauth2.Config{}, 1, OAuthDropbox); err != ErrNotFound {
+		t.Errorf("Client() err = %v, want ErrNotFound", err)
+	}
+}
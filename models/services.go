@@ -1,6 +1,11 @@
 package models
 
-import "github.com/jinzhu/gorm"
+import (
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/storage"
+	"github.com/jinzhu/gorm"
+)
 
 // ServicesConfig ...
 type ServicesConfig func(*Services) error
@@ -26,25 +31,122 @@ func WithLogMode(mode bool) ServicesConfig {
 }
 
 // WithUser ...
-func WithUser(hmacKey, pepper string) ServicesConfig {
+func WithUser(hmacKey, pepper string, cfgs ...UserServiceConfig) ServicesConfig {
+	return func(s *Services) error {
+		s.User = NewUserService(s.db, hmacKey, pepper, cfgs...)
+		return nil
+	}
+}
+
+// WithSession ...
+func WithSession(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.Session = NewSessionService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithAPIToken ...
+func WithAPIToken(hmacKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.APIToken = NewAPITokenService(s.db, hmacKey)
+		return nil
+	}
+}
+
+// WithOAuth encrypts the tokens users grant us with
+// encryptionKey
+func WithOAuth(encryptionKey string) ServicesConfig {
+	return func(s *Services) error {
+		s.OAuth = NewOAuthService(s.db, encryptionKey)
+		return nil
+	}
+}
+
+// WithIdentity must come after WithUser as linked identities
+// sign in as, and sometimes create, users
+func WithIdentity() ServicesConfig {
+	return func(s *Services) error {
+		if s.User == nil {
+			return ErrUserServiceRequired
+		}
+		s.Identity = NewIdentityService(s.db, s.User)
+		return nil
+	}
+}
+
+// WithTwoFactor must come after WithUser. encryptionKey is
+// used to encrypt the users' TOTP secrets.
+func WithTwoFactor(hmacKey, encryptionKey string) ServicesConfig {
+	return func(s *Services) error {
+		if s.User == nil {
+			return ErrUserServiceRequired
+		}
+		s.TwoFactor = NewTwoFactorService(s.db, s.User, hmacKey, encryptionKey)
+		return nil
+	}
+}
+
+// WithShareLink must come after WithUser as wrong share link
+// passwords are throttled like failed logins
+func WithShareLink(hmacKey, pepper string) ServicesConfig {
 	return func(s *Services) error {
-		s.User = NewUserService(s.db, hmacKey, pepper)
+		if s.User == nil {
+			return ErrUserServiceRequired
+		}
+		s.ShareLink = NewShareLinkService(s.db, s.User, hmacKey, pepper)
 		return nil
 	}
 }
 
-// WithGallery ...
+// WithGallery must come after WithImage as deleting a gallery
+// deletes its images
 func WithGallery() ServicesConfig {
 	return func(s *Services) error {
-		s.Gallery = NewGalleryService(s.db)
+		if s.Image == nil {
+			return ErrImageServiceRequired
+		}
+		s.Gallery = NewGalleryService(s.db, s.Image)
 		return nil
 	}
 }
 
 // WithImage ...
-func WithImage() ServicesConfig {
+func WithImage(store storage.Storage, limits UploadLimits) ServicesConfig {
+	return func(s *Services) error {
+		s.Image = NewImageService(s.db, store, limits)
+		return nil
+	}
+}
+
+// WithAudit ...
+func WithAudit() ServicesConfig {
+	return func(s *Services) error {
+		s.Audit = NewAuditService(s.db)
+		return nil
+	}
+}
+
+// WithExport ...
+func WithExport(store storage.Storage, hmacKey string) ServicesConfig {
 	return func(s *Services) error {
-		s.Image = NewImageService()
+		s.Export = NewExportService(s.db, store, hmacKey)
+		return nil
+	}
+}
+
+// WithAccountDeletion must come after WithImage and WithExport
+// as purging an account removes its image files and exports.
+// grace is how long users have to change their mind.
+func WithAccountDeletion(grace time.Duration) ServicesConfig {
+	return func(s *Services) error {
+		if s.Image == nil {
+			return ErrImageServiceRequired
+		}
+		if s.Export == nil {
+			return ErrExportServiceRequired
+		}
+		s.AccountDeletion = NewAccountDeletionService(s.db, s.Image, s.Export, grace)
 		return nil
 	}
 }
@@ -63,20 +165,42 @@ func NewServices(cfgs ...ServicesConfig) (*Services, error) {
 
 // Services ...
 type Services struct {
-	Gallery GalleryService
-	User    UserService
-	Image   ImageService
-	db      *gorm.DB
+	Gallery   GalleryService
+	User      UserService
+	Session   SessionService
+	Image     ImageService
+	ShareLink ShareLinkService
+	APIToken  APITokenService
+	OAuth     OAuthService
+	Identity  IdentityService
+	TwoFactor TwoFactorService
+	Export    ExportService
+	Audit     AuditService
+
+	AccountDeletion AccountDeletionService
+
+	db *gorm.DB
 }
 
 // AutoMigrate creates the defined models in the models package
 func (s *Services) AutoMigrate() error {
-	return s.db.AutoMigrate(&User{}, &Gallery{}).Error
+	err := s.db.AutoMigrate(&User{}, &Gallery{}, &pwReset{}, &Session{}, &Image{}, &ShareLink{}, &APIToken{}, &OAuth{}, &Identity{}, &RecoveryCode{}, &twoFactorChallenge{}, &LoginAttempt{}, &Export{}, &AuditEvent{}).Error
+	if err != nil {
+		return err
+	}
+
+	// remember tokens used to live on the users table before
+	// sessions got their own
+	if s.db.Dialect().HasColumn("users", "remember_hash") {
+		return s.db.Model(&User{}).DropColumn("remember_hash").Error
+	}
+
+	return nil
 }
 
 // DestructiveReset drops all tables and recreates them
 func (s *Services) DestructiveReset() error {
-	err := s.db.DropTableIfExists(&User{}, &Gallery{}).Error
+	err := s.db.DropTableIfExists(&User{}, &Gallery{}, &pwReset{}, &Session{}, &Image{}, &ShareLink{}, &APIToken{}, &OAuth{}, &Identity{}, &RecoveryCode{}, &twoFactorChallenge{}, &LoginAttempt{}, &Export{}, &AuditEvent{}).Error
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,252 @@
+package models
+
+import (
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/hash"
+	"github.com/arnoldokoth/lenslocked.com/rand"
+	"github.com/jinzhu/gorm"
+)
+
+// DefaultSessionTTL is how long a session stays valid after
+// the user signs in
+const DefaultSessionTTL = 30 * 24 * time.Hour
+
+// Session represents a single signed in device. The raw token
+// only ever lives in the user's cookie, we store its HMAC.
+type Session struct {
+	gorm.Model
+	UserID     uint   `gorm:"not null;index"`
+	Token      string `gorm:"-"`
+	TokenHash  string `gorm:"not null;unique_index"`
+	UserAgent  string
+	IPAddress  string
+	LastSeenAt time.Time
+	ExpiresAt  time.Time `gorm:"not null"`
+	// ImpersonatorID is set to the admin who signed in as the
+	// user to help them, it's 0 for the user's own sessions
+	ImpersonatorID uint `gorm:"not null;default:0"`
+}
+
+// IsImpersonation reports whether an admin is signed in as the
+// user rather than the user themselves
+func (s *Session) IsImpersonation() bool {
+	return s.ImpersonatorID != 0
+}
+
+// SessionDB ...
+type SessionDB interface {
+	ByToken(token string) (*Session, error)
+	ByUserID(userID uint) ([]Session, error)
+
+	Create(session *Session) error
+	Update(session *Session) error
+	Delete(id uint) error
+	// DeleteByUserID revokes every session the user has
+	DeleteByUserID(userID uint) error
+}
+
+// SessionService ...
+type SessionService interface {
+	SessionDB
+}
+
+// NewSessionService ...
+func NewSessionService(db *gorm.DB, hmacKey string) SessionService {
+	return &sessionService{
+		SessionDB: &sessionValidator{
+			hmac:      hash.NewHMAC(hmacKey),
+			SessionDB: &sessionGorm{db},
+		},
+	}
+}
+
+type sessionService struct {
+	SessionDB
+}
+
+type sessionValFunc func(*Session) error
+
+func runSessionValFuncs(session *Session, fns ...sessionValFunc) error {
+	for _, fn := range fns {
+		if err := fn(session); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type sessionValidator struct {
+	SessionDB
+	hmac hash.HMAC
+}
+
+var _ SessionDB = &sessionValidator{}
+
+func (sv *sessionValidator) requireUserID(session *Session) error {
+	if session.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) setTokenIfUnset(session *Session) error {
+	if session.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	session.Token = token
+	return nil
+}
+
+func (sv *sessionValidator) tokenMinBytes(session *Session) error {
+	if session.Token == "" {
+		return nil
+	}
+
+	n, err := rand.NBytes(session.Token)
+	if err != nil {
+		return err
+	}
+
+	if n < 32 {
+		return ErrRememberTooShort
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) hmacToken(session *Session) error {
+	if session.Token == "" {
+		return nil
+	}
+
+	session.TokenHash = sv.hmac.Hash(session.Token)
+	return nil
+}
+
+func (sv *sessionValidator) setTimestamps(session *Session) error {
+	now := time.Now()
+	if session.LastSeenAt.IsZero() {
+		session.LastSeenAt = now
+	}
+	if session.ExpiresAt.IsZero() {
+		session.ExpiresAt = now.Add(DefaultSessionTTL)
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) idGreaterThanZero(session *Session) error {
+	if session.ID <= 0 {
+		return ErrInvalidID
+	}
+
+	return nil
+}
+
+func (sv *sessionValidator) ByToken(token string) (*Session, error) {
+	session := Session{Token: token}
+	err := runSessionValFuncs(&session, sv.hmacToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return sv.SessionDB.ByToken(session.TokenHash)
+}
+
+func (sv *sessionValidator) ByUserID(userID uint) ([]Session, error) {
+	if userID <= 0 {
+		return nil, ErrUserIDRequired
+	}
+
+	return sv.SessionDB.ByUserID(userID)
+}
+
+func (sv *sessionValidator) Create(session *Session) error {
+	err := runSessionValFuncs(session, sv.requireUserID, sv.setTokenIfUnset,
+		sv.tokenMinBytes, sv.hmacToken, sv.setTimestamps)
+	if err != nil {
+		return err
+	}
+
+	return sv.SessionDB.Create(session)
+}
+
+func (sv *sessionValidator) Update(session *Session) error {
+	err := runSessionValFuncs(session, sv.idGreaterThanZero, sv.requireUserID)
+	if err != nil {
+		return err
+	}
+
+	return sv.SessionDB.Update(session)
+}
+
+func (sv *sessionValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+
+	return sv.SessionDB.Delete(id)
+}
+
+func (sv *sessionValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return sv.SessionDB.DeleteByUserID(userID)
+}
+
+var _ SessionDB = &sessionGorm{}
+
+type sessionGorm struct {
+	db *gorm.DB
+}
+
+// ByToken only returns sessions that have not yet expired
+func (sg *sessionGorm) ByToken(tokenHash string) (*Session, error) {
+	var session Session
+	db := sg.db.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now())
+	err := first(db, &session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (sg *sessionGorm) ByUserID(userID uint) ([]Session, error) {
+	var sessions []Session
+	err := sg.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("last_seen_at desc").Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (sg *sessionGorm) Create(session *Session) error {
+	return sg.db.Create(session).Error
+}
+
+func (sg *sessionGorm) Update(session *Session) error {
+	return sg.db.Save(session).Error
+}
+
+// Delete removes the session permanently, revoking its token
+func (sg *sessionGorm) Delete(id uint) error {
+	session := Session{Model: gorm.Model{ID: id}}
+	return sg.db.Unscoped().Delete(&session).Error
+}
+
+func (sg *sessionGorm) DeleteByUserID(userID uint) error {
+	return sg.db.Unscoped().Where("user_id = ?", userID).Delete(&Session{}).Error
+}
@@ -0,0 +1,251 @@
+package models
+
+import (
+	"crypto/hmac"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/hash"
+	"github.com/arnoldokoth/lenslocked.com/rand"
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ShareLink lets people without an account view a gallery,
+// optionally after entering a password
+type ShareLink struct {
+	gorm.Model
+	GalleryID    uint   `gorm:"not null;index"`
+	Token        string `gorm:"not null;unique_index"`
+	Password     string `gorm:"-"`
+	PasswordHash string
+	ExpiresAt    *time.Time
+	Views        int `gorm:"not null;default:0"`
+}
+
+// RequiresPassword ...
+func (sl *ShareLink) RequiresPassword() bool {
+	return sl.PasswordHash != ""
+}
+
+// IsExpired ...
+func (sl *ShareLink) IsExpired() bool {
+	return sl.ExpiresAt != nil && time.Now().After(*sl.ExpiresAt)
+}
+
+// ShareLinkDB ...
+type ShareLinkDB interface {
+	ByToken(token string) (*ShareLink, error)
+	ByGalleryID(galleryID uint) ([]ShareLink, error)
+
+	Create(link *ShareLink) error
+	Delete(id uint) error
+	// IncrementViews bumps the view counter without touching
+	// any other columns
+	IncrementViews(id uint) error
+}
+
+// ShareLinkService ...
+type ShareLinkService interface {
+	ShareLinkDB
+
+	// CheckPassword returns ErrInvalidPassword unless password
+	// is the one the link was created with. Wrong passwords are
+	// throttled per link like failed logins, from whichever IP
+	// address they come.
+	CheckPassword(link *ShareLink, password, ip string) error
+	// UnlockKey is stored in a cookie once a visitor has
+	// entered the link's password so they aren't asked again
+	UnlockKey(link *ShareLink) string
+	// IsUnlocked reports whether key came from UnlockKey
+	IsUnlocked(link *ShareLink, key string) bool
+}
+
+// NewShareLinkService ...
+func NewShareLinkService(db *gorm.DB, us UserService, hmacKey, pepper string) ShareLinkService {
+	return &shareLinkService{
+		ShareLinkDB: &shareLinkValidator{
+			ShareLinkDB: &shareLinkGorm{db},
+			pepper:      pepper,
+		},
+		us:     us,
+		hmac:   hash.NewHMAC(hmacKey),
+		pepper: pepper,
+	}
+}
+
+type shareLinkService struct {
+	ShareLinkDB
+	us     UserService
+	hmac   hash.HMAC
+	pepper string
+}
+
+func (sls *shareLinkService) CheckPassword(link *ShareLink, password, ip string) error {
+	if !link.RequiresPassword() {
+		return nil
+	}
+	if err := sls.us.CheckShareLink(link, ip); err != nil {
+		return err
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(link.PasswordHash), []byte(password+sls.pepper))
+	if err != nil {
+		switch err {
+		case bcrypt.ErrMismatchedHashAndPassword:
+			sls.us.ShareLinkFailed(link, ip)
+			return ErrInvalidPassword
+		default:
+			return err
+		}
+	}
+	sls.us.ShareLinkSucceeded(link)
+
+	return nil
+}
+
+func (sls *shareLinkService) UnlockKey(link *ShareLink) string {
+	// including the hash means changing the password locks
+	// everyone out again
+	return sls.hmac.Hash("share|" + link.Token + "|" + link.PasswordHash)
+}
+
+func (sls *shareLinkService) IsUnlocked(link *ShareLink, key string) bool {
+	if !link.RequiresPassword() {
+		return true
+	}
+
+	return key != "" && hmac.Equal([]byte(key), []byte(sls.UnlockKey(link)))
+}
+
+type shareLinkValFunc func(*ShareLink) error
+
+func runShareLinkValFuncs(link *ShareLink, fns ...shareLinkValFunc) error {
+	for _, fn := range fns {
+		if err := fn(link); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type shareLinkValidator struct {
+	ShareLinkDB
+	pepper string
+}
+
+func (slv *shareLinkValidator) requireGalleryID(link *ShareLink) error {
+	if link.GalleryID <= 0 {
+		return ErrGalleryIDRequired
+	}
+
+	return nil
+}
+
+func (slv *shareLinkValidator) setTokenIfUnset(link *ShareLink) error {
+	if link.Token != "" {
+		return nil
+	}
+
+	token, err := rand.String(slugBytes)
+	if err != nil {
+		return err
+	}
+	link.Token = token
+	return nil
+}
+
+func (slv *shareLinkValidator) passwordMinLength(link *ShareLink) error {
+	if link.Password == "" {
+		return nil
+	}
+
+	if len(link.Password) < 8 {
+		return ErrPasswordTooShort
+	}
+
+	return nil
+}
+
+func (slv *shareLinkValidator) bcryptPassword(link *ShareLink) error {
+	if link.Password == "" {
+		return nil
+	}
+
+	passwordBytes := []byte(link.Password + slv.pepper)
+	hashedBytes, err := bcrypt.GenerateFromPassword(passwordBytes, bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	link.PasswordHash = string(hashedBytes)
+	link.Password = ""
+
+	return nil
+}
+
+func (slv *shareLinkValidator) expiresInFuture(link *ShareLink) error {
+	if link.IsExpired() {
+		return ErrExpiryInPast
+	}
+
+	return nil
+}
+
+func (slv *shareLinkValidator) Create(link *ShareLink) error {
+	err := runShareLinkValFuncs(link, slv.requireGalleryID, slv.setTokenIfUnset,
+		slv.passwordMinLength, slv.bcryptPassword, slv.expiresInFuture)
+	if err != nil {
+		return err
+	}
+
+	return slv.ShareLinkDB.Create(link)
+}
+
+func (slv *shareLinkValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+
+	return slv.ShareLinkDB.Delete(id)
+}
+
+var _ ShareLinkDB = &shareLinkGorm{}
+
+type shareLinkGorm struct {
+	db *gorm.DB
+}
+
+func (slg *shareLinkGorm) ByToken(token string) (*ShareLink, error) {
+	var link ShareLink
+	db := slg.db.Where("token = ?", token)
+	err := first(db, &link)
+	if err != nil {
+		return nil, err
+	}
+
+	return &link, nil
+}
+
+func (slg *shareLinkGorm) ByGalleryID(galleryID uint) ([]ShareLink, error) {
+	var links []ShareLink
+	err := slg.db.Where("gallery_id = ?", galleryID).Order("id asc").Find(&links).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+func (slg *shareLinkGorm) Create(link *ShareLink) error {
+	return slg.db.Create(link).Error
+}
+
+func (slg *shareLinkGorm) Delete(id uint) error {
+	link := ShareLink{Model: gorm.Model{ID: id}}
+	return slg.db.Delete(&link).Error
+}
+
+func (slg *shareLinkGorm) IncrementViews(id uint) error {
+	return slg.db.Model(&ShareLink{}).Where("id = ?", id).
+		UpdateColumn("views", gorm.Expr("views + 1")).Error
+}
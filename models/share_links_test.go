@@ -0,0 +1,61 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShareLinkCheckPasswordThrottles(t *testing.T) {
+	policy := lenientPolicy()
+	policy.FreeAttempts = 3
+	policy.EmailLockout = 5
+	attempts := NewMemoryLoginAttemptStore()
+	us := &userService{loginPolicy: policy, loginAttempts: attempts}
+	sls := &shareLinkService{us: us, pepper: "pepper"}
+
+	link := &ShareLink{PasswordHash: mustHash(t, "secret"+"pepper")}
+	link.ID = 7
+	other := &ShareLink{PasswordHash: link.PasswordHash}
+	other.ID = 8
+
+	if err := sls.CheckPassword(link, "wrong", "10.0.0.1"); err != ErrInvalidPassword {
+		t.Fatalf("CheckPassword() wrong password err = %v, want ErrInvalidPassword", err)
+	}
+	// the right password forgets the wrong ones
+	if err := sls.CheckPassword(link, "secret", "10.0.0.1"); err != nil {
+		t.Fatalf("CheckPassword() err = %v", err)
+	}
+	if _, err := attempts.Get(shareLinkKey(link.ID)); err != ErrNotFound {
+		t.Errorf("attempts err = %v, want them forgotten", err)
+	}
+
+	// guesses are counted per link, changing IP address
+	// doesn't help
+	for i := 0; i < policy.FreeAttempts; i++ {
+		if err := sls.CheckPassword(link, "wrong", fmt.Sprintf("10.0.0.%d", i+1)); err != ErrInvalidPassword {
+			t.Fatalf("CheckPassword() wrong password %d err = %v, want ErrInvalidPassword", i, err)
+		}
+	}
+	if err := sls.CheckPassword(link, "secret", "10.0.0.9"); err != ErrLoginThrottled {
+		t.Errorf("CheckPassword() after %d wrong passwords err = %v, want ErrLoginThrottled", policy.FreeAttempts, err)
+	}
+	if err := sls.CheckPassword(other, "secret", "10.0.0.9"); err != nil {
+		t.Errorf("CheckPassword() for another link err = %v, want it unaffected", err)
+	}
+
+	// enough wrong passwords lock the link, these skip the
+	// wait between attempts
+	for i := policy.FreeAttempts; i < policy.EmailLockout; i++ {
+		us.ShareLinkFailed(link, "")
+	}
+	if err := sls.CheckPassword(link, "secret", ""); err != ErrLoginLocked {
+		t.Errorf("CheckPassword() err = %v, want ErrLoginLocked", err)
+	}
+}
+
+func TestShareLinkWithoutPassword(t *testing.T) {
+	sls := &shareLinkService{us: &userService{loginPolicy: DefaultLoginPolicy(), loginAttempts: NewMemoryLoginAttemptStore()}}
+	if err := sls.CheckPassword(&ShareLink{}, "", "10.0.0.1"); err != nil {
+		t.Errorf("CheckPassword() err = %v, want links without a password open", err)
+	}
+}
@@ -0,0 +1,654 @@
+package models
+
+import (
+	"encoding/base32"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/encrypt"
+	"github.com/arnoldokoth/lenslocked.com/hash"
+	"github.com/arnoldokoth/lenslocked.com/rand"
+	"github.com/arnoldokoth/lenslocked.com/totp"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// totpIssuer is the name authenticator apps show next to
+	// the user's email address
+	totpIssuer = "LensLocked.com"
+	// recoveryCodeCount is how many recovery codes a user gets
+	// each time they are generated
+	recoveryCodeCount = 10
+	// challengeTTL is how long a user has to enter their code
+	// after their password has been checked
+	challengeTTL = 5 * time.Minute
+	// challengeMaxFailures is how many wrong codes a challenge
+	// takes before the user has to enter their password again
+	challengeMaxFailures = 5
+)
+
+// RecoveryCode lets a user sign in once without their
+// authenticator app. Like passwords we only keep a hash.
+type RecoveryCode struct {
+	gorm.Model
+	UserID   uint   `gorm:"not null;index"`
+	Code     string `gorm:"-"`
+	CodeHash string `gorm:"not null;unique_index"`
+	UsedAt   *time.Time
+}
+
+// twoFactorChallenge is a user who got their password right
+// and still has to enter a code. Only a hash of the token in
+// their cookie is kept, and the challenge is deleted once it
+// has been used.
+type twoFactorChallenge struct {
+	gorm.Model
+	UserID    uint   `gorm:"not null;index"`
+	Token     string `gorm:"-"`
+	TokenHash string `gorm:"not null;unique_index"`
+	Failures  int    `gorm:"not null;default:0"`
+	ExpiresAt time.Time
+}
+
+// TwoFactorService ...
+type TwoFactorService interface {
+	// Enroll starts setting up two factor authentication with a
+	// new secret. It isn't required to sign in until Enable is
+	// called with a code generated from the secret.
+	Enroll(user *User) (string, error)
+	// Secret decrypts the user's secret so it can be shown again
+	// while they are still setting up
+	Secret(user *User) (string, error)
+	// ProvisioningURI is what the QR code scanned by the user's
+	// authenticator app contains
+	ProvisioningURI(user *User, secret string) string
+	// Enable turns two factor authentication on once code shows
+	// the user's app is set up, it returns their recovery codes
+	Enable(user *User, code string) ([]string, error)
+	// Disable turns two factor authentication off and throws
+	// away the secret and any recovery codes
+	Disable(user *User) error
+	// Verify accepts either a code from the user's app or one of
+	// their unused recovery codes. Every code only works once.
+	Verify(user *User, code string) error
+	// RegenerateRecoveryCodes replaces all of the user's
+	// recovery codes with new ones
+	RegenerateRecoveryCodes(user *User) ([]string, error)
+	// RecoveryCodesLeft counts the unused recovery codes
+	RecoveryCodesLeft(userID uint) (int, error)
+
+	// ChallengeToken starts a challenge for a user who got
+	// their password right, the token is exchanged for a
+	// session once they have entered their code. It replaces
+	// any earlier challenge for the user.
+	ChallengeToken(user *User) (string, error)
+	// ChallengeUser returns the user a challenge token was
+	// issued to if it is valid and has not expired
+	ChallengeUser(token string) (*User, error)
+	// CompleteChallenge checks code for the challenge and
+	// returns its user, the challenge can't be used again.
+	// Wrong codes count as failed logins for the user and
+	// after challengeMaxFailures the challenge is dropped.
+	CompleteChallenge(token, code, ip string) (*User, error)
+
+	// As returns a TwoFactorService that records actor against
+	// the failed codes it audits
+	As(actor Actor) TwoFactorService
+}
+
+// NewTwoFactorService ...
+func NewTwoFactorService(db *gorm.DB, us UserService, hmacKey, encryptionKey string) TwoFactorService {
+	hmac := hash.NewHMAC(hmacKey)
+
+	return &twoFactorService{
+		recoveryCodeDB: &recoveryCodeValidator{
+			hmac:           hmac,
+			recoveryCodeDB: &recoveryCodeGorm{db},
+		},
+		challenges: &challengeValidator{
+			hmac:        hmac,
+			challengeDB: &challengeGorm{db},
+		},
+		db:     db,
+		us:     us,
+		cipher: encrypt.NewAES(encryptionKey),
+	}
+}
+
+type twoFactorService struct {
+	recoveryCodeDB
+	challenges challengeDB
+	db         *gorm.DB
+	us         UserService
+	cipher     encrypt.AES
+}
+
+var _ TwoFactorService = &twoFactorService{}
+
+func (tfs *twoFactorService) Enroll(user *User) (string, error) {
+	if user.HasTwoFactor() {
+		return "", ErrTwoFactorEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	encrypted, err := tfs.cipher.Encrypt(secret)
+	if err != nil {
+		return "", err
+	}
+
+	user.TOTPSecret = encrypted
+	if err := tfs.us.Update(user); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+func (tfs *twoFactorService) Secret(user *User) (string, error) {
+	if user.TOTPSecret == "" {
+		return "", ErrTwoFactorNotStarted
+	}
+
+	return tfs.cipher.Decrypt(user.TOTPSecret)
+}
+
+func (tfs *twoFactorService) ProvisioningURI(user *User, secret string) string {
+	return totp.URI(secret, totpIssuer, user.EmailAddress)
+}
+
+func (tfs *twoFactorService) Enable(user *User, code string) ([]string, error) {
+	if user.HasTwoFactor() {
+		return nil, ErrTwoFactorEnabled
+	}
+	if err := tfs.verifyTOTP(user, code); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	user.TwoFactorEnabledAt = &now
+	if err := tfs.us.Update(user); err != nil {
+		return nil, err
+	}
+
+	return tfs.RegenerateRecoveryCodes(user)
+}
+
+func (tfs *twoFactorService) Disable(user *User) error {
+	if err := tfs.DeleteByUserID(user.ID); err != nil {
+		return err
+	}
+
+	user.TOTPSecret = ""
+	user.TwoFactorEnabledAt = nil
+	user.TOTPLastCounter = 0
+	return tfs.us.Update(user)
+}
+
+func (tfs *twoFactorService) Verify(user *User, code string) error {
+	if !user.HasTwoFactor() {
+		return ErrTwoFactorNotStarted
+	}
+
+	code = normalizeCode(code)
+	if len(code) == totp.Digits {
+		return tfs.verifyTOTP(user, code)
+	}
+
+	rc, err := tfs.ByCode(user.ID, code)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return ErrTwoFactorCodeInvalid
+	default:
+		return err
+	}
+
+	return tfs.Use(rc.ID)
+}
+
+// verifyTOTP checks code and records its time step so it
+// can't be replayed, even by two requests racing each other
+func (tfs *twoFactorService) verifyTOTP(user *User, code string) error {
+	secret, err := tfs.Secret(user)
+	if err != nil {
+		return err
+	}
+
+	counter, ok := totp.Validate(secret, normalizeCode(code), time.Now())
+	if !ok || counter <= user.TOTPLastCounter {
+		return ErrTwoFactorCodeInvalid
+	}
+
+	db := tfs.db.Model(&User{}).Where("id = ? AND totp_last_counter < ?", user.ID, counter).
+		UpdateColumn("totp_last_counter", counter)
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrTwoFactorCodeInvalid
+	}
+	user.TOTPLastCounter = counter
+
+	return nil
+}
+
+func (tfs *twoFactorService) RegenerateRecoveryCodes(user *User) ([]string, error) {
+	if err := tfs.DeleteByUserID(user.ID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		rc := RecoveryCode{UserID: user.ID}
+		if err := tfs.Create(&rc); err != nil {
+			return nil, err
+		}
+		codes = append(codes, rc.Code)
+	}
+
+	return codes, nil
+}
+
+func (tfs *twoFactorService) RecoveryCodesLeft(userID uint) (int, error) {
+	return tfs.CountUnused(userID)
+}
+
+func (tfs *twoFactorService) ChallengeToken(user *User) (string, error) {
+	if err := tfs.challenges.DeleteByUserID(user.ID); err != nil {
+		return "", err
+	}
+
+	challenge := twoFactorChallenge{
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(challengeTTL),
+	}
+	if err := tfs.challenges.Create(&challenge); err != nil {
+		return "", err
+	}
+
+	return challenge.Token, nil
+}
+
+func (tfs *twoFactorService) ChallengeUser(token string) (*User, error) {
+	_, user, err := tfs.challenge(token)
+	return user, err
+}
+
+func (tfs *twoFactorService) CompleteChallenge(token, code, ip string) (*User, error) {
+	challenge, user, err := tfs.challenge(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := tfs.us.CheckTwoFactor(user, ip); err != nil {
+		return nil, err
+	}
+
+	if err := tfs.Verify(user, code); err != nil {
+		if err != ErrTwoFactorCodeInvalid {
+			return nil, err
+		}
+		tfs.us.TwoFactorFailed(user, ip)
+
+		failures, err := tfs.challenges.Fail(challenge.ID)
+		if err != nil {
+			return nil, err
+		}
+		if failures >= challengeMaxFailures {
+			if err := tfs.challenges.Delete(challenge.ID); err != nil && err != ErrTokenInvalid {
+				log.Printf("two factor: could not drop challenge %d ERROR: %v", challenge.ID, err)
+			}
+			return nil, ErrTwoFactorTooManyCodes
+		}
+		return nil, ErrTwoFactorCodeInvalid
+	}
+
+	// whoever deletes the challenge first gets the session, so
+	// two requests racing with different codes can't both win
+	if err := tfs.challenges.Delete(challenge.ID); err != nil {
+		return nil, err
+	}
+	tfs.us.TwoFactorSucceeded(user)
+
+	return user, nil
+}
+
+func (tfs *twoFactorService) As(actor Actor) TwoFactorService {
+	copied := *tfs
+	copied.us = tfs.us.As(actor)
+	return &copied
+}
+
+// challenge returns the unexpired challenge for token and the
+// user it was issued to
+func (tfs *twoFactorService) challenge(token string) (*twoFactorChallenge, *User, error) {
+	challenge, err := tfs.challenges.ByToken(token)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return nil, nil, ErrTokenInvalid
+	default:
+		return nil, nil, err
+	}
+	if time.Now().After(challenge.ExpiresAt) {
+		return nil, nil, ErrTokenInvalid
+	}
+
+	user, err := tfs.us.ByID(challenge.UserID)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, nil, ErrTokenInvalid
+		}
+		return nil, nil, err
+	}
+
+	return challenge, user, nil
+}
+
+// normalizeCode lets users type codes with spaces or dashes
+// and in either case
+func normalizeCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+type recoveryCodeDB interface {
+	// ByCode only finds codes that haven't been used yet
+	ByCode(userID uint, code string) (*RecoveryCode, error)
+	CountUnused(userID uint) (int, error)
+
+	Create(rc *RecoveryCode) error
+	// Use marks the code as used, it fails if it already was
+	Use(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type recoveryCodeValFunc func(*RecoveryCode) error
+
+func runRecoveryCodeValFuncs(rc *RecoveryCode, fns ...recoveryCodeValFunc) error {
+	for _, fn := range fns {
+		if err := fn(rc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type recoveryCodeValidator struct {
+	recoveryCodeDB
+	hmac hash.HMAC
+}
+
+func (rcv *recoveryCodeValidator) requireUserID(rc *RecoveryCode) error {
+	if rc.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+// setCodeIfUnset generates codes like "k3x9q-7mzt2", 50
+// random bits is plenty for something that can only be
+// guessed while also knowing the password
+func (rcv *recoveryCodeValidator) setCodeIfUnset(rc *RecoveryCode) error {
+	if rc.Code != "" {
+		return nil
+	}
+
+	b, err := rand.Bytes(10)
+	if err != nil {
+		return err
+	}
+	code := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+	rc.Code = code[:5] + "-" + code[5:]
+	return nil
+}
+
+func (rcv *recoveryCodeValidator) hmacCode(rc *RecoveryCode) error {
+	if rc.Code == "" {
+		return nil
+	}
+
+	// the user id is included so equal codes for different
+	// users don't collide on the unique index
+	rc.CodeHash = rcv.hmac.Hash(fmt.Sprintf("recovery|%d|%s", rc.UserID, normalizeCode(rc.Code)))
+	return nil
+}
+
+func (rcv *recoveryCodeValidator) ByCode(userID uint, code string) (*RecoveryCode, error) {
+	rc := RecoveryCode{UserID: userID, Code: code}
+	if err := runRecoveryCodeValFuncs(&rc, rcv.requireUserID, rcv.hmacCode); err != nil {
+		return nil, err
+	}
+
+	return rcv.recoveryCodeDB.ByCode(userID, rc.CodeHash)
+}
+
+func (rcv *recoveryCodeValidator) Create(rc *RecoveryCode) error {
+	err := runRecoveryCodeValFuncs(rc, rcv.requireUserID, rcv.setCodeIfUnset, rcv.hmacCode)
+	if err != nil {
+		return err
+	}
+
+	return rcv.recoveryCodeDB.Create(rc)
+}
+
+func (rcv *recoveryCodeValidator) Use(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+
+	return rcv.recoveryCodeDB.Use(id)
+}
+
+var _ recoveryCodeDB = &recoveryCodeGorm{}
+
+type recoveryCodeGorm struct {
+	db *gorm.DB
+}
+
+func (rcg *recoveryCodeGorm) ByCode(userID uint, codeHash string) (*RecoveryCode, error) {
+	var rc RecoveryCode
+	db := rcg.db.Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash)
+	err := first(db, &rc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rc, nil
+}
+
+func (rcg *recoveryCodeGorm) CountUnused(userID uint) (int, error) {
+	var count int
+	err := rcg.db.Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count).Error
+	return count, err
+}
+
+func (rcg *recoveryCodeGorm) Create(rc *RecoveryCode) error {
+	return rcg.db.Create(rc).Error
+}
+
+func (rcg *recoveryCodeGorm) Use(id uint) error {
+	db := rcg.db.Model(&RecoveryCode{}).Where("id = ? AND used_at IS NULL", id).
+		UpdateColumn("used_at", time.Now())
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrTwoFactorCodeInvalid
+	}
+
+	return nil
+}
+
+// DeleteByUserID removes the codes permanently, they are
+// only ever replaced as a whole
+func (rcg *recoveryCodeGorm) DeleteByUserID(userID uint) error {
+	return rcg.db.Unscoped().Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error
+}
+
+type challengeDB interface {
+	ByToken(token string) (*twoFactorChallenge, error)
+	Create(challenge *twoFactorChallenge) error
+	// Fail counts a wrong code against the challenge and
+	// returns how many there have been
+	Fail(id uint) (int, error)
+	// Delete fails with ErrTokenInvalid if the challenge is
+	// already gone, which is what makes challenges single use
+	Delete(id uint) error
+	DeleteByUserID(userID uint) error
+}
+
+type challengeValFunc func(*twoFactorChallenge) error
+
+func runChallengeValFuncs(challenge *twoFactorChallenge, fns ...challengeValFunc) error {
+	for _, fn := range fns {
+		if err := fn(challenge); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type challengeValidator struct {
+	challengeDB
+	hmac hash.HMAC
+}
+
+func (cv *challengeValidator) requireUserID(challenge *twoFactorChallenge) error {
+	if challenge.UserID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return nil
+}
+
+func (cv *challengeValidator) setTokenIfUnset(challenge *twoFactorChallenge) error {
+	if challenge.Token != "" {
+		return nil
+	}
+
+	token, err := rand.RememberToken()
+	if err != nil {
+		return err
+	}
+	challenge.Token = token
+	return nil
+}
+
+func (cv *challengeValidator) hmacToken(challenge *twoFactorChallenge) error {
+	if challenge.Token == "" {
+		return nil
+	}
+
+	challenge.TokenHash = cv.hmac.Hash("2fa|" + challenge.Token)
+	return nil
+}
+
+func (cv *challengeValidator) ByToken(token string) (*twoFactorChallenge, error) {
+	challenge := twoFactorChallenge{Token: token}
+	if err := runChallengeValFuncs(&challenge, cv.hmacToken); err != nil {
+		return nil, err
+	}
+
+	return cv.challengeDB.ByToken(challenge.TokenHash)
+}
+
+func (cv *challengeValidator) Create(challenge *twoFactorChallenge) error {
+	err := runChallengeValFuncs(challenge, cv.requireUserID, cv.setTokenIfUnset, cv.hmacToken)
+	if err != nil {
+		return err
+	}
+
+	return cv.challengeDB.Create(challenge)
+}
+
+func (cv *challengeValidator) Fail(id uint) (int, error) {
+	if id <= 0 {
+		return 0, ErrInvalidID
+	}
+
+	return cv.challengeDB.Fail(id)
+}
+
+func (cv *challengeValidator) Delete(id uint) error {
+	if id <= 0 {
+		return ErrInvalidID
+	}
+
+	return cv.challengeDB.Delete(id)
+}
+
+func (cv *challengeValidator) DeleteByUserID(userID uint) error {
+	if userID <= 0 {
+		return ErrUserIDRequired
+	}
+
+	return cv.challengeDB.DeleteByUserID(userID)
+}
+
+var _ challengeDB = &challengeGorm{}
+
+type challengeGorm struct {
+	db *gorm.DB
+}
+
+func (cg *challengeGorm) ByToken(tokenHash string) (*twoFactorChallenge, error) {
+	var challenge twoFactorChallenge
+	db := cg.db.Where("token_hash = ?", tokenHash)
+	err := first(db, &challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return &challenge, nil
+}
+
+func (cg *challengeGorm) Create(challenge *twoFactorChallenge) error {
+	return cg.db.Create(challenge).Error
+}
+
+func (cg *challengeGorm) Fail(id uint) (int, error) {
+	db := cg.db.Model(&twoFactorChallenge{}).Where("id = ?", id).
+		UpdateColumn("failures", gorm.Expr("failures + 1"))
+	if db.Error != nil {
+		return 0, db.Error
+	}
+	if db.RowsAffected == 0 {
+		return 0, ErrTokenInvalid
+	}
+
+	var challenge twoFactorChallenge
+	if err := first(cg.db.Where("id = ?", id), &challenge); err != nil {
+		if err == ErrNotFound {
+			return 0, ErrTokenInvalid
+		}
+		return 0, err
+	}
+
+	return challenge.Failures, nil
+}
+
+// Delete removes the challenge permanently, a soft deleted one
+// would still hold its token hash
+func (cg *challengeGorm) Delete(id uint) error {
+	db := cg.db.Unscoped().Where("id = ?", id).Delete(&twoFactorChallenge{})
+	if db.Error != nil {
+		return db.Error
+	}
+	if db.RowsAffected == 0 {
+		return ErrTokenInvalid
+	}
+
+	return nil
+}
+
+func (cg *challengeGorm) DeleteByUserID(userID uint) error {
+	return cg.db.Unscoped().Where("user_id = ?", userID).Delete(&twoFactorChallenge{}).Error
+}
@@ -0,0 +1,266 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/arnoldokoth/lenslocked.com/hash"
+)
+
+// memUserDB finds users by ID
+type memUserDB struct {
+	UserDB
+	users []*User
+}
+
+func (db *memUserDB) ByID(id uint) (*User, error) {
+	for _, user := range db.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// memAuditDB keeps the events it's given
+type memAuditDB struct {
+	AuditDB
+	events []AuditEvent
+}
+
+func (db *memAuditDB) Create(event *AuditEvent) error {
+	db.events = append(db.events, *event)
+	return nil
+}
+
+// memRecoveryCodeDB keeps plain codes, which is enough as the
+// hashing is done by the validator
+type memRecoveryCodeDB struct {
+	recoveryCodeDB
+	codes []RecoveryCode
+}
+
+func (db *memRecoveryCodeDB) ByCode(userID uint, code string) (*RecoveryCode, error) {
+	for _, rc := range db.codes {
+		if rc.UserID == userID && rc.Code == code && rc.UsedAt == nil {
+			return &rc, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *memRecoveryCodeDB) Use(id uint) error {
+	for i := range db.codes {
+		if db.codes[i].ID == id && db.codes[i].UsedAt == nil {
+			now := time.Now()
+			db.codes[i].UsedAt = &now
+			return nil
+		}
+	}
+	return ErrTwoFactorCodeInvalid
+}
+
+// memChallengeDB keeps challenges by their token hash
+type memChallengeDB struct {
+	challenges []*twoFactorChallenge
+}
+
+func (db *memChallengeDB) ByToken(tokenHash string) (*twoFactorChallenge, error) {
+	for _, challenge := range db.challenges {
+		if challenge.TokenHash == tokenHash {
+			copied := *challenge
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *memChallengeDB) Create(challenge *twoFactorChallenge) error {
+	challenge.ID = uint(len(db.challenges) + 100)
+	copied := *challenge
+	db.challenges = append(db.challenges, &copied)
+	return nil
+}
+
+func (db *memChallengeDB) Fail(id uint) (int, error) {
+	for _, challenge := range db.challenges {
+		if challenge.ID == id {
+			challenge.Failures++
+			return challenge.Failures, nil
+		}
+	}
+	return 0, ErrTokenInvalid
+}
+
+func (db *memChallengeDB) Delete(id uint) error {
+	for i, challenge := range db.challenges {
+		if challenge.ID == id {
+			db.challenges = append(db.challenges[:i], db.challenges[i+1:]...)
+			return nil
+		}
+	}
+	return ErrTokenInvalid
+}
+
+func (db *memChallengeDB) DeleteByUserID(userID uint) error {
+	var kept []*twoFactorChallenge
+	for _, challenge := range db.challenges {
+		if challenge.UserID != userID {
+			kept = append(kept, challenge)
+		}
+	}
+	db.challenges = kept
+	return nil
+}
+
+// testTwoFactorService returns a service for a user with two
+// factor authentication on and the recovery codes codes
+func testTwoFactorService(policy LoginPolicy, codes ...string) (*twoFactorService, *User, *memAuditDB) {
+	now := time.Now()
+	user := &User{Name: "Jon", TwoFactorEnabledAt: &now}
+	user.ID = 1
+
+	audit := &memAuditDB{}
+	us := &userService{
+		UserDB:        &memUserDB{users: []*User{user}},
+		loginPolicy:   policy,
+		loginAttempts: NewMemoryLoginAttemptStore(),
+		audit:         auditor{db: audit},
+	}
+
+	rcs := &memRecoveryCodeDB{}
+	for i, code := range codes {
+		rc := RecoveryCode{UserID: user.ID, Code: normalizeCode(code)}
+		rc.ID = uint(i + 1)
+		rcs.codes = append(rcs.codes, rc)
+	}
+
+	tfs := &twoFactorService{
+		recoveryCodeDB: rcs,
+		challenges: &challengeValidator{
+			hmac:        hash.NewHMAC("secret"),
+			challengeDB: &memChallengeDB{},
+		},
+		us: us,
+	}
+
+	return tfs, user, audit
+}
+
+// lenientPolicy never slows anyone down, so only the
+// challenge's own limit applies
+func lenientPolicy() LoginPolicy {
+	policy := DefaultLoginPolicy()
+	policy.FreeAttempts = 100
+	policy.EmailLockout = 100
+	return policy
+}
+
+func TestCompleteChallengeIsSingleUse(t *testing.T) {
+	tfs, user, _ := testTwoFactorService(lenientPolicy(), "aaaaa-bbbbb", "ccccc-ddddd")
+
+	token, err := tfs.ChallengeToken(user)
+	if err != nil {
+		t.Fatalf("ChallengeToken() err = %v", err)
+	}
+	if got, err := tfs.ChallengeUser(token); err != nil || got != user {
+		t.Fatalf("ChallengeUser() = %v, %v, want the user", got, err)
+	}
+
+	got, err := tfs.CompleteChallenge(token, "AAAAA BBBBB", "10.0.0.1")
+	if err != nil || got != user {
+		t.Fatalf("CompleteChallenge() = %v, %v, want the user", got, err)
+	}
+
+	if _, err := tfs.CompleteChallenge(token, "ccccc-ddddd", "10.0.0.1"); err != ErrTokenInvalid {
+		t.Errorf("CompleteChallenge() replayed err = %v, want ErrTokenInvalid", err)
+	}
+	if _, err := tfs.ChallengeUser(token); err != ErrTokenInvalid {
+		t.Errorf("ChallengeUser() after use err = %v, want ErrTokenInvalid", err)
+	}
+}
+
+func TestCompleteChallengeDropsAfterWrongCodes(t *testing.T) {
+	tfs, user, audit := testTwoFactorService(lenientPolicy(), "aaaaa-bbbbb")
+
+	token, err := tfs.As(Actor{IPAddress: "10.0.0.1"}).ChallengeToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < challengeMaxFailures; i++ {
+		if _, err := tfs.As(Actor{IPAddress: "10.0.0.1"}).CompleteChallenge(token, "wrong-code", "10.0.0.1"); err != ErrTwoFactorCodeInvalid {
+			t.Fatalf("CompleteChallenge() wrong code %d err = %v, want ErrTwoFactorCodeInvalid", i, err)
+		}
+	}
+	if _, err := tfs.CompleteChallenge(token, "wrong-code", "10.0.0.1"); err != ErrTwoFactorTooManyCodes {
+		t.Fatalf("CompleteChallenge() last wrong code err = %v, want ErrTwoFactorTooManyCodes", err)
+	}
+	if _, err := tfs.CompleteChallenge(token, "aaaaa-bbbbb", "10.0.0.1"); err != ErrTokenInvalid {
+		t.Errorf("CompleteChallenge() after being dropped err = %v, want ErrTokenInvalid", err)
+	}
+
+	if len(audit.events) != challengeMaxFailures {
+		t.Fatalf("recorded %d events, want %d", len(audit.events), challengeMaxFailures)
+	}
+	for _, event := range audit.events {
+		if event.Action != AuditLoginFailed || event.TargetID != user.ID || event.TargetType != AuditTargetUser {
+			t.Errorf("recorded %+v, want a failed login for the user", event)
+		}
+	}
+	if audit.events[0].IPAddress != "10.0.0.1" {
+		t.Errorf("recorded IP address %q, want the actor's", audit.events[0].IPAddress)
+	}
+}
+
+func TestCompleteChallengeThrottlesPerUser(t *testing.T) {
+	policy := DefaultLoginPolicy()
+	tfs, user, _ := testTwoFactorService(policy, "aaaaa-bbbbb")
+
+	token, err := tfs.ChallengeToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < policy.FreeAttempts; i++ {
+		if _, err := tfs.CompleteChallenge(token, "wrong-code", "10.0.0.1"); err != ErrTwoFactorCodeInvalid {
+			t.Fatalf("CompleteChallenge() wrong code err = %v, want ErrTwoFactorCodeInvalid", err)
+		}
+	}
+
+	// logging in again starts a new challenge but the user's
+	// wrong codes still count
+	token, err = tfs.ChallengeToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tfs.CompleteChallenge(token, "aaaaa-bbbbb", "10.0.0.2"); err != ErrLoginThrottled {
+		t.Fatalf("CompleteChallenge() err = %v, want ErrLoginThrottled", err)
+	}
+
+	// a throttled attempt doesn't use up the challenge or the
+	// code, so the user can try again once they have waited
+	tfs.us.TwoFactorSucceeded(user)
+	if got, err := tfs.CompleteChallenge(token, "aaaaa-bbbbb", "10.0.0.2"); err != nil || got != user {
+		t.Errorf("CompleteChallenge() = %v, %v, want the user", got, err)
+	}
+}
+
+func TestChallengeExpires(t *testing.T) {
+	tfs, user, _ := testTwoFactorService(lenientPolicy(), "aaaaa-bbbbb")
+
+	token, err := tfs.ChallengeToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfs.challenges.(*challengeValidator).challengeDB.(*memChallengeDB).challenges[0].ExpiresAt = time.Now().Add(-time.Second)
+
+	if _, err := tfs.ChallengeUser(token); err != ErrTokenInvalid {
+		t.Errorf("ChallengeUser() err = %v, want ErrTokenInvalid", err)
+	}
+	if _, err := tfs.CompleteChallenge(token, "aaaaa-bbbbb", "10.0.0.1"); err != ErrTokenInvalid {
+		t.Errorf("CompleteChallenge() err = %v, want ErrTokenInvalid", err)
+	}
+	if _, err := tfs.ChallengeUser("made-up"); err != ErrTokenInvalid {
+		t.Errorf("ChallengeUser() of an unknown token err = %v, want ErrTokenInvalid", err)
+	}
+}
@@ -1,19 +1,30 @@
 package models
 
 import (
-	"errors"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/arnoldokoth/lenslocked.com/hash"
-	"github.com/arnoldokoth/lenslocked.com/rand"
 	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 
 	// initialize the postgres driver
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 )
 
+// Roles a user can have
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 // User ...
 type User struct {
 	gorm.Model
@@ -21,15 +32,70 @@ type User struct {
 	EmailAddress string `gorm:"type:varchar(100);not null;unique_index"`
 	Password     string `gorm:"-"`
 	PasswordHash string `gorm:"not null"`
-	Remember     string `gorm:"-"`
-	RememberHash string `gorm:"not null;unique_index"`
+
+	EmailVerifiedAt *time.Time
+	// PendingEmail is an address the user has asked to change
+	// to, it replaces EmailAddress once they have verified it
+	PendingEmail string `gorm:"type:varchar(100)"`
+
+	// KeepPhotoLocation leaves GPS coordinates in uploaded
+	// photos, by default they are stripped before storing along
+	// with any metadata of non JPEGs
+	KeepPhotoLocation bool `gorm:"not null;default:false"`
+
+	// TOTPSecret is encrypted and only set while two factor
+	// authentication is being set up or is enabled
+	TOTPSecret         string
+	TwoFactorEnabledAt *time.Time
+	// TOTPLastCounter is the time step of the last code used
+	// so a code can't be used twice
+	TOTPLastCounter int64 `gorm:"not null;default:0"`
+
+	// DeleteAfter is set when the user has asked for their
+	// account to be deleted, it is purged once this has passed
+	DeleteAfter *time.Time `gorm:"index"`
+
+	Role string `gorm:"not null;default:'user'"`
+	// DisabledAt is set when an admin has disabled the account,
+	// the user can't sign in until it's enabled again
+	DisabledAt *time.Time
+}
+
+// IsVerified reports whether the user has confirmed
+// that they own their email address
+func (u *User) IsVerified() bool {
+	return u.EmailVerifiedAt != nil
+}
+
+// HasTwoFactor reports whether signing in also needs a code
+// from the user's authenticator app
+func (u *User) HasTwoFactor() bool {
+	return u.TwoFactorEnabledAt != nil
+}
+
+// IsAdmin ...
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// IsDisabled ...
+func (u *User) IsDisabled() bool {
+	return u.DisabledAt != nil
+}
+
+// IsDeletionScheduled reports whether the user has asked for
+// their account to be deleted and not changed their mind yet
+func (u *User) IsDeletionScheduled() bool {
+	return u.DeleteAfter != nil
 }
 
 // UserDB ,,,
 type UserDB interface {
 	ByID(id uint) (*User, error)
 	ByEmail(emailAddress string) (*User, error)
-	ByRemember(token string) (*User, error)
+	// Search returns up to limit users whose name or email
+	// address contains query, newest first
+	Search(query string, limit int) ([]User, error)
 
 	Create(user *User) error
 	Update(user *User) error
@@ -38,16 +104,91 @@ type UserDB interface {
 
 // UserService ,,,
 type UserService interface {
-	Authenticate(emailAddress, password string) (*User, error)
+	// Authenticate checks the user's password. Repeated failures
+	// for the email address or from the ip address are slowed
+	// down and eventually locked out for a while.
+	Authenticate(emailAddress, password, ip string) (*User, error)
+	// CheckPassword is for asking a signed in user for their
+	// password again before a sensitive change. It isn't a
+	// login so it isn't audited, but wrong passwords are
+	// throttled per user the same way so a stolen session can't
+	// be used to guess the password.
+	CheckPassword(user *User, password, ip string) error
+	// CheckTwoFactor applies the same policy to two factor
+	// codes, counted per user rather than per email address.
+	// TwoFactorFailed records a wrong code as a failed login
+	// and TwoFactorSucceeded forgets the wrong codes.
+	CheckTwoFactor(user *User, ip string) error
+	TwoFactorFailed(user *User, ip string)
+	TwoFactorSucceeded(user *User)
+	// CheckShareLink, ShareLinkFailed and ShareLinkSucceeded do
+	// the same for share link passwords, counted per link.
+	// Nobody is told when a link gets locked.
+	CheckShareLink(link *ShareLink, ip string) error
+	ShareLinkFailed(link *ShareLink, ip string)
+	ShareLinkSucceeded(link *ShareLink)
+
+	// InitiateReset starts the password reset process by creating
+	// a reset token for the user with the provided email address
+	InitiateReset(emailAddress string) (string, error)
+	// CompleteReset sets the user's password to newPw if the
+	// token is valid and has not expired
+	CompleteReset(token, newPw string) (*User, error)
+
+	// VerificationToken returns a signed token that can be
+	// emailed to the user to prove they own their address
+	VerificationToken(user *User) (string, error)
+	// VerifyEmail marks the user the token was issued to as
+	// verified if the token is valid and has not expired. A
+	// token for their pending address makes it their address.
+	VerifyEmail(token string) (*User, error)
+	// ChangeEmail saves emailAddress as the user's pending
+	// address and returns a verification token for it, their
+	// address only changes once the token is used
+	ChangeEmail(user *User, emailAddress string) (string, error)
+
+	// Logout ends the session the user signed in with
+	Logout(session *Session) error
+	// As returns a UserService that records actor against the
+	// audit events it writes for logins, logouts and password
+	// changes
+	As(actor Actor) UserService
 	UserDB
 }
 
+// DefaultResetTTL is how long a password reset token stays
+// valid when no other window is configured
+const DefaultResetTTL = 12 * time.Hour
+
+// verifyTTL is how long an email verification link stays valid
+const verifyTTL = 72 * time.Hour
+
+// UserServiceConfig ...
+type UserServiceConfig func(*userService)
+
+// WithResetTTL sets how long password reset tokens remain valid
+func WithResetTTL(ttl time.Duration) UserServiceConfig {
+	return func(us *userService) {
+		if ttl > 0 {
+			us.resetTTL = ttl
+		}
+	}
+}
+
 // NewUserService ...
-func NewUserService(db *gorm.DB, hmacKey, pepper string) UserService {
+func NewUserService(db *gorm.DB, hmacKey, pepper string, cfgs ...UserServiceConfig) UserService {
 	hmac := hash.NewHMAC(hmacKey)
 
-	return &userService{
-		pepper: pepper,
+	us := &userService{
+		db:            db,
+		pepper:        pepper,
+		hmac:          hmac,
+		resetTTL:      DefaultResetTTL,
+		loginPolicy:   DefaultLoginPolicy(),
+		loginAttempts: NewMemoryLoginAttemptStore(),
+		pwResetDB:     newPwResetValidator(&pwResetGorm{db}, hmac),
+		sessionDB:     &sessionGorm{db},
+		audit:         newAuditor(db),
 		UserDB: &userValidator{
 			hmac:       hmac,
 			pepper:     pepper,
@@ -55,20 +196,47 @@ func NewUserService(db *gorm.DB, hmacKey, pepper string) UserService {
 			UserDB:     &userGorm{db},
 		},
 	}
+	for _, cfg := range cfgs {
+		cfg(us)
+	}
+
+	return us
 }
 
 // UserService ...
 type userService struct {
 	UserDB
-	pepper string
+	db        *gorm.DB
+	pepper    string
+	hmac      hash.HMAC
+	pwResetDB pwResetDB
+	sessionDB SessionDB
+	resetTTL  time.Duration
+	audit     auditor
+
+	loginPolicy   LoginPolicy
+	loginAttempts LoginAttemptStore
+	onLockout     LockoutNotifier
 }
 
 var _ UserService = &userService{}
 
 // Authenticate ...
-func (us *userService) Authenticate(emailAddress, password string) (*User, error) {
+func (us *userService) Authenticate(emailAddress, password, ip string) (*User, error) {
+	emailAddress = strings.TrimSpace(strings.ToLower(emailAddress))
+	if err := us.checkLogin(emailAddress, ip); err != nil {
+		return nil, err
+	}
+
 	foundUser, err := us.ByEmail(emailAddress)
 	if err != nil {
+		if err == ErrNotFound {
+			us.loginFailed(emailAddress, ip, nil)
+			us.audit.record(AuditEvent{
+				Action: AuditLoginFailed,
+				Detail: emailAddress,
+			})
+		}
 		return nil, err
 	}
 
@@ -76,15 +244,242 @@ func (us *userService) Authenticate(emailAddress, password string) (*User, error
 	if err != nil {
 		switch err {
 		case bcrypt.ErrMismatchedHashAndPassword:
+			us.loginFailed(emailAddress, ip, foundUser)
+			us.audit.record(AuditEvent{
+				Action:     AuditLoginFailed,
+				TargetType: AuditTargetUser,
+				TargetID:   foundUser.ID,
+			})
 			return nil, ErrInvalidPassword
 		default:
 			return nil, err
 		}
 	}
 
+	us.loginSucceeded(emailAddress)
+	if foundUser.IsDisabled() {
+		return nil, ErrAccountDisabled
+	}
+	us.audit.record(AuditEvent{
+		ActorID:    foundUser.ID,
+		Action:     AuditLogin,
+		TargetType: AuditTargetUser,
+		TargetID:   foundUser.ID,
+	})
+
 	return foundUser, nil
 }
 
+// CheckPassword ...
+func (us *userService) CheckPassword(user *User, password, ip string) error {
+	key := passwordCheckKey(user.ID)
+	if err := us.checkAttempts(key, ip); err != nil {
+		return err
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password+us.pepper))
+	switch err {
+	case nil:
+	case bcrypt.ErrMismatchedHashAndPassword:
+		us.attemptFailed(key, ip, user)
+		return ErrInvalidPassword
+	default:
+		return err
+	}
+
+	us.resetAttempts(key)
+
+	return nil
+}
+
+// Update records an audit event when the password is changed
+func (us *userService) Update(user *User) error {
+	passwordChanged := user.Password != ""
+	if err := us.UserDB.Update(user); err != nil {
+		return err
+	}
+
+	if passwordChanged {
+		us.audit.record(AuditEvent{
+			Action:     AuditPasswordChange,
+			TargetType: AuditTargetUser,
+			TargetID:   user.ID,
+		})
+	}
+
+	return nil
+}
+
+func (us *userService) Logout(session *Session) error {
+	if err := us.sessionDB.Delete(session.ID); err != nil {
+		return err
+	}
+
+	us.audit.record(AuditEvent{
+		ActorID:    session.UserID,
+		Action:     AuditLogout,
+		TargetType: AuditTargetUser,
+		TargetID:   session.UserID,
+	})
+
+	return nil
+}
+
+func (us *userService) As(actor Actor) UserService {
+	copied := *us
+	copied.audit.actor = actor
+	return &copied
+}
+
+// InitiateReset ...
+func (us *userService) InitiateReset(emailAddress string) (string, error) {
+	user, err := us.ByEmail(emailAddress)
+	if err != nil {
+		return "", err
+	}
+
+	pwr := pwReset{
+		UserID: user.ID,
+	}
+	if err := us.pwResetDB.Create(&pwr); err != nil {
+		return "", err
+	}
+
+	return pwr.Token, nil
+}
+
+// CompleteReset ...
+func (us *userService) CompleteReset(token, newPw string) (*User, error) {
+	pwr, err := us.pwResetDB.ByToken(token)
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	if time.Now().Sub(pwr.CreatedAt) > us.resetTTL {
+		us.pwResetDB.Delete(pwr.ID)
+		return nil, ErrTokenInvalid
+	}
+
+	user, err := us.ByID(pwr.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	user.Password = newPw
+	err = us.Update(user)
+	if err != nil {
+		return nil, err
+	}
+
+	us.pwResetDB.Delete(pwr.ID)
+	return user, nil
+}
+
+// VerificationToken ...
+func (us *userService) VerificationToken(user *User) (string, error) {
+	return us.verificationToken(user, user.EmailAddress)
+}
+
+// verificationToken signs a token that verifies emailAddress
+// for the user
+func (us *userService) verificationToken(user *User, emailAddress string) (string, error) {
+	if user.ID <= 0 {
+		return "", ErrInvalidID
+	}
+
+	expiresAt := time.Now().Add(verifyTTL).Unix()
+	payload := fmt.Sprintf("%d|%s|%d", user.ID, emailAddress, expiresAt)
+	encoded := base64.URLEncoding.EncodeToString([]byte(payload))
+
+	return encoded + "." + us.signVerification(payload), nil
+}
+
+// VerifyEmail ...
+func (us *userService) VerifyEmail(token string) (*User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrTokenInvalid
+	}
+
+	payloadBytes, err := base64.URLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	payload := string(payloadBytes)
+
+	signature := us.signVerification(payload)
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(parts[1])) != 1 {
+		return nil, ErrTokenInvalid
+	}
+
+	fields := strings.Split(payload, "|")
+	if len(fields) != 3 {
+		return nil, ErrTokenInvalid
+	}
+
+	id, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, ErrTokenInvalid
+	}
+	expiresAt, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return nil, ErrTokenInvalid
+	}
+
+	user, err := us.ByID(uint(id))
+	if err != nil {
+		if err == ErrNotFound {
+			return nil, ErrTokenInvalid
+		}
+		return nil, err
+	}
+
+	// the link only verifies the address it was sent to
+	switch {
+	case fields[1] == user.EmailAddress:
+		if user.IsVerified() {
+			return user, nil
+		}
+	case user.PendingEmail != "" && fields[1] == user.PendingEmail:
+		user.EmailAddress = user.PendingEmail
+		user.PendingEmail = ""
+	default:
+		return nil, ErrTokenInvalid
+	}
+
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	if err := us.Update(user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// ChangeEmail ...
+func (us *userService) ChangeEmail(user *User, emailAddress string) (string, error) {
+	if strings.TrimSpace(emailAddress) == "" {
+		return "", ErrEmailRequired
+	}
+
+	user.PendingEmail = emailAddress
+	if err := us.Update(user); err != nil {
+		return "", err
+	}
+	if user.PendingEmail == "" {
+		return "", ErrEmailUnchanged
+	}
+
+	return us.verificationToken(user, user.PendingEmail)
+}
+
+func (us *userService) signVerification(payload string) string {
+	return us.hmac.Hash("verify|" + payload)
+}
+
 type userValidator struct {
 	UserDB
 	hmac       hash.HMAC
@@ -150,48 +545,9 @@ func (uv *userValidator) passwordHashRequired(user *User) error {
 	return nil
 }
 
-func (uv *userValidator) hmacRemember(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-
-	user.RememberHash = uv.hmac.Hash(user.Remember)
-	return nil
-}
-
-func (uv *userValidator) rememberHashRequired(user *User) error {
-	if user.RememberHash == "" {
-		return errors.New("models: remember hash required")
-	}
-
-	return nil
-}
-
-func (uv *userValidator) setRememberIfUnset(user *User) error {
-	if user.Remember != "" {
-		return nil
-	}
-
-	token, err := rand.RememberToken()
-	if err != nil {
-		return err
-	}
-	user.Remember = token
-	return nil
-}
-
-func (uv *userValidator) rememberMinBytes(user *User) error {
-	if user.Remember == "" {
-		return nil
-	}
-
-	n, err := rand.NBytes(user.Remember)
-	if err != nil {
-		return err
-	}
-
-	if n < 32 {
-		return errors.New("models: remember token must be at least 32 bytes")
+func (uv *userValidator) nameMaxLength(user *User) error {
+	if utf8.RuneCountInString(user.Name) > 50 {
+		return ErrNameTooLong
 	}
 
 	return nil
@@ -243,11 +599,48 @@ func (uv *userValidator) emailIsAvailable(user *User) error {
 	return nil
 }
 
+// normalizePendingEmail drops a pending address that is the
+// same as the current one, there is nothing to change
+func (uv *userValidator) normalizePendingEmail(user *User) error {
+	user.PendingEmail = strings.TrimSpace(strings.ToLower(user.PendingEmail))
+	if user.PendingEmail == user.EmailAddress {
+		user.PendingEmail = ""
+	}
+
+	return nil
+}
+
+func (uv *userValidator) pendingEmailFormat(user *User) error {
+	if user.PendingEmail != "" && !uv.emailRegex.MatchString(user.PendingEmail) {
+		return ErrEmailInvalid
+	}
+
+	return nil
+}
+
+func (uv *userValidator) pendingEmailIsAvailable(user *User) error {
+	if user.PendingEmail == "" {
+		return nil
+	}
+
+	existing, err := uv.ByEmail(user.PendingEmail)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if user.ID != existing.ID {
+		return ErrEmailTaken
+	}
+
+	return nil
+}
+
 func (uv *userValidator) Create(user *User) error {
 	err := runUserValFuncs(user, uv.passwordRequired, uv.passwordMinLength,
-		uv.bcryptPassword, uv.passwordHashRequired, uv.setRememberIfUnset,
-		uv.rememberMinBytes, uv.hmacRemember, uv.rememberHashRequired, uv.normalizeEmail, uv.requireEmail,
-		uv.emailFormat, uv.emailIsAvailable)
+		uv.bcryptPassword, uv.passwordHashRequired, uv.nameMaxLength, uv.normalizeEmail,
+		uv.requireEmail, uv.emailFormat, uv.emailIsAvailable)
 	if err != nil {
 		return err
 	}
@@ -257,8 +650,9 @@ func (uv *userValidator) Create(user *User) error {
 
 func (uv *userValidator) Update(user *User) error {
 	err := runUserValFuncs(user, uv.passwordMinLength, uv.bcryptPassword,
-		uv.passwordHashRequired, uv.rememberMinBytes, uv.hmacRemember, uv.rememberHashRequired,
-		uv.normalizeEmail, uv.requireEmail, uv.emailFormat, uv.emailIsAvailable)
+		uv.passwordHashRequired, uv.nameMaxLength, uv.normalizeEmail, uv.requireEmail,
+		uv.emailFormat, uv.emailIsAvailable, uv.normalizePendingEmail, uv.pendingEmailFormat,
+		uv.pendingEmailIsAvailable)
 	if err != nil {
 		return err
 	}
@@ -295,16 +689,6 @@ func (uv *userValidator) ByEmail(emailAddress string) (*User, error) {
 	return uv.UserDB.ByEmail(user.EmailAddress)
 }
 
-func (uv *userValidator) ByRemember(token string) (*User, error) {
-	user := User{Remember: token}
-	err := runUserValFuncs(&user, uv.hmacRemember)
-	if err != nil {
-		return nil, err
-	}
-
-	return uv.UserDB.ByRemember(user.RememberHash)
-}
-
 type userGorm struct {
 	db *gorm.DB
 }
@@ -352,17 +736,24 @@ func (ug *userGorm) ByEmail(emailAddress string) (*User, error) {
 	return &user, err
 }
 
-// ByRemember ...
-func (ug *userGorm) ByRemember(rememberHash string) (*User, error) {
-	var user User
-	db := ug.db.Where("remember_hash = ?", rememberHash)
-
-	err := first(db, &user)
-	if err != nil {
+func (ug *userGorm) Search(query string, limit int) ([]User, error) {
+	var users []User
+	db := ug.db.Order("created_at desc").Limit(limit)
+	if query != "" {
+		like := "%" + escapeLike(query) + "%"
+		db = db.Where("name ILIKE ? OR email_address ILIKE ?", like, like)
+	}
+	if err := db.Find(&users).Error; err != nil {
 		return nil, err
 	}
 
-	return &user, err
+	return users, nil
+}
+
+// escapeLike stops the wildcards in s matching anything when
+// it's used in a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
 }
 
 func first(db *gorm.DB, dst interface{}) error {
@@ -373,3 +764,10 @@ func first(db *gorm.DB, dst interface{}) error {
 
 	return err
 }
+
+// isUniqueViolation reports whether err is postgres refusing a
+// row that would break a unique index
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
@@ -0,0 +1,185 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckPasswordThrottles(t *testing.T) {
+	user := &User{EmailAddress: "jon@example.com", PasswordHash: mustHash(t, "Password123!pepper")}
+	user.ID = 1
+
+	audit := &memAuditDB{}
+	attempts := NewMemoryLoginAttemptStore()
+	policy := DefaultLoginPolicy()
+	us := &userService{
+		pepper:        "pepper",
+		loginPolicy:   policy,
+		loginAttempts: attempts,
+		audit:         auditor{db: audit},
+	}
+
+	if err := us.CheckPassword(user, "wrong", "10.0.0.1"); err != ErrInvalidPassword {
+		t.Fatalf("CheckPassword() wrong password err = %v, want ErrInvalidPassword", err)
+	}
+	// a right password forgets the wrong ones
+	if err := us.CheckPassword(user, "Password123!", "10.0.0.1"); err != nil {
+		t.Fatalf("CheckPassword() err = %v", err)
+	}
+	for i := 0; i < policy.FreeAttempts; i++ {
+		if err := us.CheckPassword(user, "wrong", "10.0.0.1"); err != ErrInvalidPassword {
+			t.Fatalf("CheckPassword() wrong password %d err = %v, want ErrInvalidPassword", i, err)
+		}
+	}
+	if err := us.CheckPassword(user, "Password123!", "10.0.0.2"); err != ErrLoginThrottled {
+		t.Errorf("CheckPassword() after %d wrong passwords err = %v, want ErrLoginThrottled", policy.FreeAttempts, err)
+	}
+
+	la, err := attempts.Get(passwordCheckKey(user.ID))
+	if err != nil || la.Failures != policy.FreeAttempts {
+		t.Errorf("attempts = %+v, %v, want %d failures for the user", la, err, policy.FreeAttempts)
+	}
+	// it isn't a login so the owner can still log in and
+	// nothing shows up as a failed login
+	if _, err := attempts.Get(emailLoginKey(user.EmailAddress)); err != ErrNotFound {
+		t.Errorf("login attempts err = %v, want none recorded", err)
+	}
+	if len(audit.events) != 0 {
+		t.Errorf("recorded %v, want nothing", audit.events)
+	}
+}
+
+func TestCheckPasswordLocksOut(t *testing.T) {
+	user := &User{EmailAddress: "jon@example.com", PasswordHash: mustHash(t, "Password123!")}
+	user.ID = 1
+
+	policy := lenientPolicy()
+	policy.EmailLockout = 5
+	locked := make(chan *User, 1)
+	us := &userService{
+		loginPolicy:   policy,
+		loginAttempts: NewMemoryLoginAttemptStore(),
+		onLockout:     func(user *User, until time.Time) { locked <- user },
+	}
+
+	for i := 0; i < policy.EmailLockout; i++ {
+		if err := us.CheckPassword(user, "wrong", ""); err != ErrInvalidPassword {
+			t.Fatalf("CheckPassword() wrong password %d err = %v, want ErrInvalidPassword", i, err)
+		}
+	}
+	if err := us.CheckPassword(user, "Password123!", ""); err != ErrLoginLocked {
+		t.Errorf("CheckPassword() err = %v, want ErrLoginLocked", err)
+	}
+	select {
+	case got := <-locked:
+		if got != user {
+			t.Errorf("lockout notified for %v, want the user", got)
+		}
+	case <-time.After(time.Second):
+		t.Error("the user wasn't told about the lockout")
+	}
+}
+
+// mustHash returns a bcrypt hash of password, which must
+// include the service's pepper
+func mustHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func (db *memUserDB) ByEmail(emailAddress string) (*User, error) {
+	for _, user := range db.users {
+		if user.EmailAddress == emailAddress {
+			return user, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (db *memUserDB) Update(user *User) error {
+	for i, existing := range db.users {
+		if existing.ID == user.ID {
+			copied := *user
+			db.users[i] = &copied
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func TestChangeEmailWaitsForVerification(t *testing.T) {
+	now := time.Now()
+	jon := &User{Name: "Jon", EmailAddress: "jon@example.com", PasswordHash: "hash", EmailVerifiedAt: &now}
+	jon.ID = 1
+	sam := &User{Name: "Sam", EmailAddress: "sam@example.com", PasswordHash: "hash"}
+	sam.ID = 2
+	db := &memUserDB{users: []*User{jon, sam}}
+
+	us := NewUserService(nil, "secret", "pepper").(*userService)
+	us.UserDB.(*userValidator).UserDB = db
+
+	user := *jon
+	if _, err := us.ChangeEmail(&user, " JON@example.com "); err != ErrEmailUnchanged {
+		t.Errorf("ChangeEmail() to the same address err = %v, want ErrEmailUnchanged", err)
+	}
+	user = *jon
+	if _, err := us.ChangeEmail(&user, "sam@example.com"); err != ErrEmailTaken {
+		t.Errorf("ChangeEmail() to a taken address err = %v, want ErrEmailTaken", err)
+	}
+	user = *jon
+	if _, err := us.ChangeEmail(&user, "not an email"); err != ErrEmailInvalid {
+		t.Errorf("ChangeEmail() to an invalid address err = %v, want ErrEmailInvalid", err)
+	}
+
+	user = *jon
+	token, err := us.ChangeEmail(&user, "Jon@Example.org")
+	if err != nil {
+		t.Fatalf("ChangeEmail() err = %v", err)
+	}
+	saved, _ := db.ByID(jon.ID)
+	if saved.EmailAddress != "jon@example.com" || saved.PendingEmail != "jon@example.org" || !saved.IsVerified() {
+		t.Fatalf("saved %s pending %q, want the old address kept until verified", saved.EmailAddress, saved.PendingEmail)
+	}
+
+	// a link for the current address doesn't swap it in
+	current, err := us.VerificationToken(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.VerifyEmail(current); err != nil {
+		t.Fatalf("VerifyEmail() current address err = %v", err)
+	}
+	if saved, _ := db.ByID(jon.ID); saved.EmailAddress != "jon@example.com" {
+		t.Fatalf("email address = %s, want it unchanged", saved.EmailAddress)
+	}
+
+	verified, err := us.VerifyEmail(token)
+	if err != nil {
+		t.Fatalf("VerifyEmail() err = %v", err)
+	}
+	if verified.EmailAddress != "jon@example.org" || verified.PendingEmail != "" || !verified.IsVerified() {
+		t.Errorf("VerifyEmail() = %s pending %q, want the new address swapped in", verified.EmailAddress, verified.PendingEmail)
+	}
+	if saved, _ := db.ByID(jon.ID); saved.EmailAddress != "jon@example.org" {
+		t.Errorf("saved email address = %s, want jon@example.org", saved.EmailAddress)
+	}
+
+	// a link for an address the user has since changed their
+	// mind about doesn't work
+	user = *verified
+	stale, err := us.ChangeEmail(&user, "typo@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.ChangeEmail(&user, "jon@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := us.VerifyEmail(stale); err != ErrTokenInvalid {
+		t.Errorf("VerifyEmail() stale link err = %v, want ErrTokenInvalid", err)
+	}
+}
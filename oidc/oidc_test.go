@@ -0,0 +1,291 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID = "lenslocked"
+	testNonce    = "nonce-123"
+)
+
+// fakeProvider serves a discovery document and a JWKS holding
+// the public half of key
+type fakeProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp := &fakeProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 fp.URL,
+			"authorization_endpoint": fp.URL + "/authorize",
+			"token_endpoint":         fp.URL + "/token",
+			"jwks_uri":               fp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": "key-1",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	fp.Server = httptest.NewServer(mux)
+
+	return fp
+}
+
+// claims returns a valid set of claims for the provider
+func (fp *fakeProvider) claims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            fp.URL,
+		"sub":            "user-1",
+		"aud":            testClientID,
+		"exp":            now.Add(time.Hour).Unix(),
+		"iat":            now.Unix(),
+		"nonce":          testNonce,
+		"email":          "jon@example.com",
+		"email_verified": true,
+		"name":           "Jon",
+	}
+}
+
+// sign returns a JWT with the header and claims, signed by
+// signFn over the first two segments
+func sign(t *testing.T, header, claims map[string]interface{}, signFn func(signingInput string) []byte) string {
+	h, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signFn(signingInput))
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func(string) []byte {
+	return func(signingInput string) []byte {
+		hashed := sha256.Sum256([]byte(signingInput))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func TestVerify(t *testing.T) {
+	fp := newFakeProvider(t)
+	defer fp.Close()
+	p := NewProvider(fp.URL, nil)
+
+	rsaHeader := map[string]interface{}{"alg": "RS256", "kid": "key-1"}
+	raw := sign(t, rsaHeader, fp.claims(), rs256(t, fp.key))
+	token, err := p.Verify(context.Background(), raw, testClientID, testNonce)
+	if err != nil {
+		t.Fatalf("Verify() err = %v", err)
+	}
+	if token.Subject != "user-1" || token.Email != "jon@example.com" || !token.EmailVerified || token.Name != "Jon" {
+		t.Errorf("Verify() = %+v, want the token's claims", token)
+	}
+
+	// some providers send email_verified as a string
+	claims := fp.claims()
+	claims["email_verified"] = "true"
+	claims["aud"] = []string{testClientID, "other"}
+	claims["azp"] = testClientID
+	token, err = p.Verify(context.Background(), sign(t, rsaHeader, claims, rs256(t, fp.key)), testClientID, testNonce)
+	if err != nil {
+		t.Fatalf("Verify() with a string email_verified err = %v", err)
+	}
+	if !token.EmailVerified {
+		t.Error("Verify() EmailVerified = false, want true")
+	}
+	claims["email_verified"] = "false"
+	token, err = p.Verify(context.Background(), sign(t, rsaHeader, claims, rs256(t, fp.key)), testClientID, testNonce)
+	if err != nil {
+		t.Fatalf("Verify() err = %v", err)
+	}
+	if token.EmailVerified {
+		t.Error("Verify() EmailVerified = true, want false")
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	fp := newFakeProvider(t)
+	defer fp.Close()
+	p := NewProvider(fp.URL, nil)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&fp.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaHeader := map[string]interface{}{"alg": "RS256", "kid": "key-1"}
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := fp.claims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	// the provider's signature over different claims
+	valid := strings.Split(sign(t, rsaHeader, fp.claims(), rs256(t, fp.key)), ".")
+	forged := strings.Split(sign(t, rsaHeader, withClaim("sub", "admin"), rs256(t, otherKey)), ".")
+	tampered := forged[0] + "." + forged[1] + "." + valid[2]
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{
+			name:  "bad signature",
+			token: sign(t, rsaHeader, fp.claims(), rs256(t, otherKey)),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "tampered claims",
+			token: tampered,
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "unknown key",
+			token: sign(t, map[string]interface{}{"alg": "RS256", "kid": "key-2"}, fp.claims(), rs256(t, fp.key)),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "wrong audience",
+			token: sign(t, rsaHeader, withClaim("aud", "someone-else"), rs256(t, fp.key)),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "audience without azp",
+			token: sign(t, rsaHeader, withClaim("aud", []string{"someone-else", testClientID}), rs256(t, fp.key)),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "wrong issuer",
+			token: sign(t, rsaHeader, withClaim("iss", "https://evil.example.com"), rs256(t, fp.key)),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "expired",
+			token: sign(t, rsaHeader, withClaim("exp", time.Now().Add(-2*leeway).Unix()), rs256(t, fp.key)),
+			want:  ErrExpired,
+		},
+		{
+			name:  "no expiry",
+			token: sign(t, rsaHeader, withClaim("exp", nil), rs256(t, fp.key)),
+			want:  ErrExpired,
+		},
+		{
+			name:  "issued in the future",
+			token: sign(t, rsaHeader, withClaim("iat", time.Now().Add(2*leeway).Unix()), rs256(t, fp.key)),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "nonce mismatch",
+			token: sign(t, rsaHeader, withClaim("nonce", "someone-elses-nonce"), rs256(t, fp.key)),
+			want:  ErrInvalidToken,
+		},
+		{
+			name:  "missing nonce",
+			token: sign(t, rsaHeader, withClaim("nonce", nil), rs256(t, fp.key)),
+			want:  ErrInvalidToken,
+		},
+		{
+			name: "alg none",
+			token: sign(t, map[string]interface{}{"alg": "none", "kid": "key-1"}, fp.claims(),
+				func(string) []byte { return nil }),
+			want: ErrInvalidToken,
+		},
+		{
+			// the classic confusion attack, an HMAC keyed with
+			// the provider's public key
+			name: "alg HS256",
+			token: sign(t, map[string]interface{}{"alg": "HS256", "kid": "key-1"}, fp.claims(),
+				func(signingInput string) []byte {
+					mac := hmac.New(sha256.New, publicDER)
+					mac.Write([]byte(signingInput))
+					return mac.Sum(nil)
+				}),
+			want: ErrInvalidToken,
+		},
+		{
+			name:  "not a JWT",
+			token: "not.a-jwt",
+			want:  ErrInvalidToken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := p.Verify(context.Background(), tt.token, testClientID, testNonce)
+			if err != tt.want {
+				t.Errorf("Verify() = %+v, %v, want %v", token, err, tt.want)
+			}
+		})
+	}
+
+	// a token without a nonce mustn't pass when we lost ours
+	noNonce := sign(t, rsaHeader, withClaim("nonce", nil), rs256(t, fp.key))
+	if _, err := p.Verify(context.Background(), noNonce, testClientID, ""); err != ErrInvalidToken {
+		t.Errorf("Verify() without a nonce err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	fp := newFakeProvider(t)
+	defer fp.Close()
+
+	endpoint, err := NewProvider(fp.URL+"/", nil).Endpoint(context.Background())
+	if err != nil {
+		t.Fatalf("Endpoint() err = %v", err)
+	}
+	if endpoint.AuthURL != fp.URL+"/authorize" || endpoint.TokenURL != fp.URL+"/token" {
+		t.Errorf("Endpoint() = %+v", endpoint)
+	}
+
+	if _, err := NewProvider(fp.URL+"/other", nil).Endpoint(context.Background()); err == nil {
+		t.Error("Endpoint() for a different issuer err = nil, want an error")
+	}
+}
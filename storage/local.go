@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalConfig ...
+type LocalConfig func(*Local)
+
+// WithSignedURLs makes URL hand out links that stop working
+// after somewhere between ttl and twice ttl, and ServeHTTP only
+// serve files through such a link. Whoever was allowed to see
+// the page a link is on can fetch the file for a while, nobody
+// else can.
+func WithSignedURLs(key string, ttl time.Duration) LocalConfig {
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+
+	return func(l *Local) {
+		l.signingKey = []byte(key)
+		l.signedTTL = ttl
+	}
+}
+
+// NewLocal returns a Storage that keeps files in dir on the
+// local disk. baseURL is where dir is served from e.g. /images
+func NewLocal(dir, baseURL string, cfgs ...LocalConfig) *Local {
+	l := &Local{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+	for _, cfg := range cfgs {
+		cfg(l)
+	}
+
+	return l
+}
+
+// Local ...
+type Local struct {
+	dir        string
+	baseURL    string
+	signingKey []byte
+	signedTTL  time.Duration
+}
+
+var _ Storage = &Local{}
+
+// Put ...
+func (l *Local) Put(key string, r io.Reader) error {
+	fullPath := l.path(key)
+	err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Create(fullPath)
+	if err != nil {
+		return err
+	}
+
+	defer dst.Close()
+
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+// Get ...
+func (l *Local) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotExist
+	}
+
+	return f, err
+}
+
+// Delete ...
+func (l *Local) Delete(key string) error {
+	err := os.Remove(l.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotExist
+	}
+
+	return err
+}
+
+// List ...
+func (l *Local) List(prefix string) ([]string, error) {
+	// only walk the directory the prefix lives in
+	start := l.path(prefix)
+	if !strings.HasSuffix(prefix, "/") {
+		start = filepath.Dir(start)
+	}
+
+	var keys []string
+	err := filepath.Walk(start, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// URL ...
+func (l *Local) URL(key string) string {
+	u := l.baseURL + "/" + uriEncode(key, false)
+	if l.signingKey == nil {
+		return u
+	}
+
+	// expiries are rounded up to the next multiple of the ttl
+	// so a page links to the same URLs, and browsers can cache
+	// them, until the window moves on
+	now := time.Now().Unix()
+	window := int64(l.signedTTL / time.Second)
+	expires := (now/window + 2) * window
+
+	return fmt.Sprintf("%s?expires=%d&signature=%s", u, expires, l.signature(key, expires))
+}
+
+// ServeHTTP serves the stored files, it should be mounted
+// under the baseURL passed to NewLocal with the prefix
+// stripped. Directories are never listed.
+func (l *Local) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if key == "" || strings.HasSuffix(key, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if l.signingKey != nil {
+		expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+		if err != nil || time.Now().Unix() > expires ||
+			!hmac.Equal([]byte(r.URL.Query().Get("signature")), []byte(l.signature(key, expires))) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", expires-time.Now().Unix()))
+	}
+
+	f, err := os.Open(l.path(key))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+func (l *Local) signature(key string, expires int64) string {
+	mac := hmacSHA256(l.signingKey, fmt.Sprintf("%s|%d", path.Clean("/"+key), expires))
+	return base64.RawURLEncoding.EncodeToString(mac)
+}
+
+// path maps key onto the disk. Cleaning it as an absolute
+// path first means ".." can never climb out of dir.
+func (l *Local) path(key string) string {
+	cleaned := path.Clean("/" + key)
+	return filepath.Join(l.dir, filepath.FromSlash(cleaned))
+}
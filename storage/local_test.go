@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalPathStaysInDir(t *testing.T) {
+	l := NewLocal(filepath.FromSlash("/srv/images"), "/images")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"galleries/1/a.jpg", "/srv/images/galleries/1/a.jpg"},
+		{"/galleries/1/a.jpg", "/srv/images/galleries/1/a.jpg"},
+		{"galleries/1/../2/a.jpg", "/srv/images/galleries/2/a.jpg"},
+		{"../etc/passwd", "/srv/images/etc/passwd"},
+		{"galleries/../../../etc/passwd", "/srv/images/etc/passwd"},
+		{"/../../etc/passwd", "/srv/images/etc/passwd"},
+		{"galleries/./1//a.jpg", "/srv/images/galleries/1/a.jpg"},
+		{"", "/srv/images"},
+		{"..", "/srv/images"},
+	}
+
+	for _, tt := range tests {
+		if got := l.path(tt.key); got != filepath.FromSlash(tt.want) {
+			t.Errorf("path(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestLocalRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l := NewLocal(dir, "/images")
+
+	for _, key := range []string{"galleries/1/a.jpg", "galleries/1/b.jpg", "galleries/12/c.jpg"} {
+		if err := l.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatalf("Put(%q) err = %v", key, err)
+		}
+	}
+
+	keys, err := l.List("galleries/1/")
+	if err != nil {
+		t.Fatalf("List() err = %v", err)
+	}
+	if got, want := strings.Join(keys, ","), "galleries/1/a.jpg,galleries/1/b.jpg"; got != want {
+		t.Errorf("List() = %q, want %q", got, want)
+	}
+
+	if err := l.Delete("galleries/1/a.jpg"); err != nil {
+		t.Fatalf("Delete() err = %v", err)
+	}
+	if _, err := l.Get("galleries/1/a.jpg"); err != ErrNotExist {
+		t.Errorf("Get() after Delete() err = %v, want ErrNotExist", err)
+	}
+	if err := l.Delete("galleries/1/a.jpg"); err != ErrNotExist {
+		t.Errorf("Delete() twice err = %v, want ErrNotExist", err)
+	}
+}
+
+func TestLocalServeHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l := NewLocal(dir, "/images", WithSignedURLs("secret", time.Hour))
+	if err := l.Put("galleries/1/a b.jpg", strings.NewReader("jpeg bytes")); err != nil {
+		t.Fatal(err)
+	}
+	handler := http.StripPrefix("/images/", l)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		return w
+	}
+
+	signed := l.URL("galleries/1/a b.jpg")
+	if w := get(signed); w.Code != http.StatusOK || w.Body.String() != "jpeg bytes" {
+		t.Errorf("GET %s = %d %q, want 200 %q", signed, w.Code, w.Body.String(), "jpeg bytes")
+	}
+
+	u, _ := url.Parse(signed)
+	query := u.Query()
+	expires, _ := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if wait := time.Until(time.Unix(expires, 0)); wait < time.Hour || wait > 2*time.Hour {
+		t.Errorf("URL() expires in %v, want between 1h and 2h", wait)
+	}
+
+	tampered := url.Values{}
+	tampered.Set("expires", strconv.FormatInt(expires+3600, 10))
+	tampered.Set("signature", query.Get("signature"))
+	expired := url.Values{}
+	expired.Set("expires", "1")
+	expired.Set("signature", l.signature("galleries/1/a b.jpg", 1))
+
+	for _, target := range []string{
+		"/images/galleries/1/a%20b.jpg",
+		"/images/galleries/1/a%20b.jpg?" + tampered.Encode(),
+		"/images/galleries/1/a%20b.jpg?" + expired.Encode(),
+		"/images/galleries/1/other.jpg?" + query.Encode(),
+		"/images/galleries/1/",
+		"/images/galleries/1/?expires=" + query.Get("expires") + "&signature=" + l.signature("galleries/1/", expires),
+		"/images/galleries/1?expires=" + query.Get("expires") + "&signature=" + l.signature("galleries/1", expires),
+	} {
+		if w := get(target); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", target, w.Code)
+		}
+	}
+}
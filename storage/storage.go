@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// ErrNotExist is returned when the requested key is not
+// present in the storage backend
+var ErrNotExist = errors.New("storage: object does not exist")
+
+// Storage is implemented by every backend that can hold
+// uploaded files. Keys are slash separated paths such as
+// galleries/1/beach.jpg regardless of the backend.
+type Storage interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	// List returns every key that starts with prefix
+	List(prefix string) ([]string, error)
+	// URL returns the address browsers can fetch key from
+	URL(key string) string
+}
+
+// uriEncode percent encodes everything except the unreserved
+// characters, optionally leaving slashes alone so keys keep
+// their "directories"
+func uriEncode(s string, encodeSlash bool) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+
+	return b.String()
+}
@@ -25,7 +25,9 @@ type Alert struct {
 type Data struct {
 	Alert *Alert
 	User  *models.User
-	Yield interface{}
+	// Impersonating is set while an admin is signed in as User
+	Impersonating bool
+	Yield         interface{}
 }
 
 // SetAlert ...
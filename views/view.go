@@ -72,6 +72,9 @@ func (v *View) Render(w http.ResponseWriter, r *http.Request, data interface{})
 	}
 
 	vd.User = context.User(r.Context())
+	if session := context.Session(r.Context()); session != nil {
+		vd.Impersonating = session.IsImpersonation()
+	}
 
 	var buffer bytes.Buffer
 